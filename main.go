@@ -1,24 +1,46 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 const (
 	pollInterval     = 2 * time.Minute                             // 最大キャッシュ有効期限（2分）
+	maxPollAfter     = 30 * time.Minute                            // API が指定するポーリング間隔の上限（30分）
 	minFetchInterval = 45 * time.Second                            // 最小APIアクセス間隔（45秒）
+	fetchLockWait    = 5 * time.Second                             // 別プロセスの取得完了を待つ上限（5秒）
+	fetchLockMargin  = 10 * time.Second                            // 取得の最長時間を超えてロックファイルを異常終了したプロセスのものとみなすまでの余裕（10秒）
+	apiTimeout       = 10 * time.Second                            // API リクエスト1回あたりのタイムアウト（10秒）
+	keychainTimeout  = 10 * time.Second                            // Keychain からの取得（security コマンド）を待つ上限（10秒）
+	backgroundWait   = 15 * time.Second                            // 終了前にバックグラウンドの取得を待つ上限（15秒）
 	apiEndpoint      = "https://api.anthropic.com/api/oauth/usage" // Anthropic API エンドポイント
 	apiBeta          = "oauth-2025-04-20"                          // API ベータ版指定
+	apiVersion       = "2023-06-01"                                // API キーで認証する場合の API バージョン指定
 
 	// ANSI カラーコード
 	colorReset  = "\033[0m"
@@ -28,25 +50,56 @@ const (
 	colorRed    = "\033[31m"
 
 	// プログレスバー設定
-	barWidth = 20 // プログレスバーの幅（文字数）
+	barWidth        = 20 // プログレスバーの幅（文字数）
+	compactBarWidth = 10 // コンパクト表示でのプログレスバーの幅（bar_width が既定値の場合）
 
 	// 使用率の色閾値（%）
 	usageThresholdYellow = 25
 	usageThresholdOrange = 50
 	usageThresholdRed    = 75
 
-	// 部分ブロック閾値（6段階）
-	shadeSteps      = 6
-	shadeThreshold5 = 5.0 / shadeSteps // ▇
-	shadeThreshold4 = 4.0 / shadeSteps // ▆
-	shadeThreshold3 = 3.0 / shadeSteps // ▅
-	shadeThreshold2 = 2.0 / shadeSteps // ▃
-	shadeThreshold1 = 1.0 / shadeSteps // ▂
+	// 使用率の小数点以下のデフォルト桁数
+	defaultUsagePrecision = 1
+
+	// 部分ブロックのデフォルトの段階数
+	defaultShadeSteps = 6
+
+	// 使用率の分数表示のデフォルトの分母
+	defaultUsageFractionScale = 100
 
 	// アプリケーション名
 	appName = "go-statusline"
+
+	// プログレスバーのデフォルト文字
+	defaultFilledChar = "█"
+	defaultEmptyChar  = " "
+
+	// ASCII専用モードのバー文字
+	asciiFilledChar = "#"
+	asciiEmptyChar  = "-"
+
+	// API リクエストの再試行のデフォルト
+	defaultAPIMaxAttempts          = 3
+	defaultAPIRetryBaseDelayMillis = 200
+
+	// スパークラインのデフォルトの幅と保持する履歴数
+	defaultSparklineWidth   = 10
+	defaultSparklineSamples = 20
+
+	// キャッシュファイルに保存する履歴数の上限のデフォルト
+	defaultCacheMaxSamples = 100
+
+	// 週間使用率のデフォルトラベル
+	defaultWeekLabel = "week"
+
+	// 閾値通過時の通知方式
+	notifyMethodBell = "bell" // 端末ベル（BEL）
+	notifyMethodOSC9 = "osc9" // OSC 9 デスクトップ通知
 )
 
+// defaultProfile はプロファイルを指定しない場合のプロファイル名
+const defaultProfile = "default"
+
 // getConfigDir は設定ディレクトリのパスを返す
 // XDG Base Directory Specification に準拠
 func getConfigDir() string {
@@ -62,6 +115,32 @@ func getCacheFilePath() string {
 	return filepath.Join(getConfigDir(), "cache.json")
 }
 
+// profileDir は指定されたプロファイルの設定ディレクトリを返す
+// 空または "default" の場合はプロファイルを指定しない場合の設定ディレクトリ
+func profileDir(name string) string {
+	if name == "" || name == defaultProfile {
+		return getConfigDir()
+	}
+	return filepath.Join(getConfigDir(), "profiles", name)
+}
+
+// profileCacheFilePath は指定されたプロファイルのキャッシュファイルのパスを返す
+// "default" はプロファイルを指定しない場合のキャッシュファイル
+func profileCacheFilePath(name string) string {
+	return filepath.Join(profileDir(name), "cache.json")
+}
+
+// profileEnv はプロファイルを指定する環境変数（--profile が優先）
+const profileEnv = "GO_STATUSLINE_PROFILE"
+
+// offlineEnv はオフラインモードを有効にする環境変数（"1" などの真の値で有効）
+const offlineEnv = "OFFLINE"
+
+// validProfileName はプロファイル名がディレクトリ名として使えるかを判定する
+func validProfileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
 // getLegacyCacheFilePath は旧キャッシュファイルのパスを返す
 func getLegacyCacheFilePath() string {
 	homeDir, _ := os.UserHomeDir()
@@ -109,7 +188,144 @@ type Config struct {
 	ShowEffort       bool `json:"show_effort"`
 	ShowThinking     bool `json:"show_thinking"`
 	ShowOutputStyle  bool `json:"show_output_style"`
+	ShowContextPct   bool `json:"show_context_pct"`
 	BarWidth         int  `json:"bar_width"`
+
+	RefreshOnModelChange bool              `json:"refresh_on_model_change"`
+	ResetNowText         string            `json:"reset_now_text"`
+	NotifyAbove          float64           `json:"notify_above"`
+	NotifyMethod         string            `json:"notify_method"`
+	WeekLabel            string            `json:"week_label"`
+	ShowBandTicks        bool              `json:"show_band_ticks"`
+	DebounceMillis       int               `json:"debounce_millis"`
+	ASCIIOnly            bool              `json:"ascii_only"`
+	APIQuery             map[string]string `json:"api_query,omitempty"`
+	QuantizeUsage        int               `json:"quantize_usage"`
+	ClampSilently        bool              `json:"clamp_silently"`
+	MirrorFile           string            `json:"mirror_file"`
+
+	CacheTTLSeconds         int `json:"cache_ttl_seconds"`          // キャッシュの最大有効期限（秒）
+	MinFetchIntervalSeconds int `json:"min_fetch_interval_seconds"` // API へアクセスする最小間隔（秒）
+
+	HideWeekResetBeyondHours int      `json:"hide_week_reset_beyond_hours"`
+	Windows                  []string `json:"windows,omitempty"`
+	ShowHealthDot            bool     `json:"show_health_dot"`
+
+	// 使用率の小数点以下の桁数（未指定の場合は1桁）
+	// FiveHourPrecision / WeeklyPrecision は各バーで UsagePrecision を上書きする
+	UsagePrecision    *int `json:"usage_precision,omitempty"`
+	FiveHourPrecision *int `json:"five_hour_precision,omitempty"`
+	WeeklyPrecision   *int `json:"weekly_precision,omitempty"`
+
+	SnapToFullAbove float64 `json:"snap_to_full_above"`
+	NoColor         bool    `json:"no_color"`
+	GroupSeparator  string  `json:"group_separator"`
+	ForceColor      bool    `json:"force_color"`
+
+	// 使用率の色閾値（%）。0 <= yellow < orange < red <= 100 でなければデフォルトに戻す
+	ThresholdYellow float64 `json:"threshold_yellow"`
+	ThresholdOrange float64 `json:"threshold_orange"`
+	ThresholdRed    float64 `json:"threshold_red"`
+
+	// 週間使用率の色閾値（%）。週間の要素のみに適用し、条件は 5時間の閾値と同じ
+	WeeklyThresholdYellow float64 `json:"weekly_threshold_yellow"`
+	WeeklyThresholdOrange float64 `json:"weekly_threshold_orange"`
+	WeeklyThresholdRed    float64 `json:"weekly_threshold_red"`
+
+	// 使用率の段階ごとの色（ANSI SGR シーケンス。空の場合はデフォルト）
+	ColorGreen  string `json:"color_green"`
+	ColorYellow string `json:"color_yellow"`
+	ColorOrange string `json:"color_orange"`
+	ColorRed    string `json:"color_red"`
+
+	IdleLabel string `json:"idle_label"`
+
+	// プログレスバーの文字（1文字）。塗りつぶし文字がデフォルト以外の場合は部分ブロックを使わない
+	BarFilledChar string `json:"bar_filled_char"`
+	BarEmptyChar  string `json:"bar_empty_char"`
+
+	OutputFormat string `json:"output_format"` // "text" または "json"
+	Separator    string `json:"separator"`     // 要素間の区切り文字（空文字は不可）
+
+	CredentialsPath string `json:"credentials_path,omitempty"` // 認証情報ファイルのパス（空の場合は自動検出）
+	APIEndpoint     string `json:"api_endpoint,omitempty"`     // 使用状況を取得する API エンドポイント（社内ゲートウェイ経由の場合など）
+	ProxyURL        string `json:"proxy_url,omitempty"`        // API リクエストに使うプロキシ（空の場合は環境変数に従う）
+
+	SanityDeltaCap float64 `json:"sanity_delta_cap"` // 1回の取得でこれ以上変化した使用率は表示しない（0 で無効）
+
+	PrimaryWindow string `json:"primary_window"` // 通知などが基準にする使用枠（"five_hour" または "seven_day"、空の場合は5時間）
+
+	APIMaxAttempts          int `json:"api_max_attempts"`            // API リクエストの最大試行回数
+	APIRetryBaseDelayMillis int `json:"api_retry_base_delay_millis"` // 最初の再試行までの待機時間（以降は倍々）
+
+	ShowSparkline    bool `json:"show_sparkline"`
+	SparklineWidth   int  `json:"sparkline_width"`   // 表示する履歴数
+	SparklineSamples int  `json:"sparkline_samples"` // スパークラインの対象にする直近の履歴数（保存する履歴数は CacheMaxSamples）
+
+	StaleText string `json:"stale_text"` // 期限切れキャッシュで表示中に使用率の後ろへデータの経過時間とともに表示する文字列（空で無効）
+
+	CacheMaxSamples int `json:"cache_max_samples"` // キャッシュファイルに保存する履歴数の上限（0 で無制限）
+
+	ContextLimits map[string]int64 `json:"context_limits,omitempty"` // モデルの表示名ごとのコンテキスト上限（組み込みの値を上書き）
+
+	Labels map[string]string `json:"labels,omitempty"` // 要素のキーごとの見出し（"見出し: " の代わりにそのまま前置する）
+
+	Compact bool `json:"compact"` // 狭い端末向けに見出しを短くし、バーを細くする
+
+	WarnStaleHistoryHours int `json:"warn_stale_history_hours"` // history.jsonl がこの時間以上更新されていなければ警告（0 で無効）
+
+	ResetDisplay     string `json:"reset_display"`      // リセットの表示形式（"clock"、"relative"、"both"）
+	ResetAsCountdown bool   `json:"reset_as_countdown"` // リセットを "resets in 2h14m" のように残り時間で表示（reset_display より優先）
+
+	ShowSoonestResetCountdown bool `json:"show_soonest_reset_countdown"` // 5時間・週間のうち先に来るリセットまでの残り時間を "next limit in 38m (5h)" と表示
+
+	ShowCwd       bool `json:"show_cwd"`        // stdin の cwd のディレクトリ名を表示
+	ShowSession   bool `json:"show_session"`    // stdin の session_id の先頭8文字を表示
+	ShowGitBranch bool `json:"show_git_branch"` // stdin の cwd の git ブランチを表示（.git/HEAD を読む）
+	ShowAccount   bool `json:"show_account"`    // API レスポンスまたは認証情報に含まれるアカウント（メールアドレスまたは組織名）を表示
+
+	ShowUsageDelta bool `json:"show_usage_delta"` // 5時間使用率に前回取得時からの変化を "45.0% (+3.2)" のように表示
+	ShowBurnRate   bool `json:"show_burn_rate"`   // 直近の増加ペースで5時間枠を使い切るかの予測を "~over in 1h20m" または "~ok" と表示
+
+	ShowBar         bool   `json:"show_bar"`         // false の場合はプログレスバーを省略し使用率の数値のみ表示
+	PercentPosition string `json:"percent_position"` // 使用率の数値をバーの左右どちらに表示するか（"left"、"right"）
+
+	HideEmptySegments bool `json:"hide_empty_segments"` // データが無い使用率・リセットの要素を "N/A" の代わりに省略
+
+	ShadeSteps int `json:"shade_steps"` // プログレスバーの部分ブロックの段階数（1、3、6）
+
+	ShowRemaining bool `json:"show_remaining"` // 5時間・週間の使用率を残り容量（100 - 使用率）で表示
+
+	UsageAsFraction    bool `json:"usage_as_fraction"`    // 使用率を "45/100" のように usage_fraction_scale に対する分数で表示
+	UsageFractionScale int  `json:"usage_fraction_scale"` // 分数表示の分母
+
+	ResetRounding  string `json:"reset_rounding"`  // リセット時刻の分への丸め方（"nearest"、"up"、"down"）
+	ResetPrecision string `json:"reset_precision"` // リセット時刻の精度（"minute"、"second"）
+
+	TokenUnit      string `json:"token_unit"`      // トークン数の単位（"auto"、"k"、"raw"）
+	TokenSeparator string `json:"token_separator"` // 単位なしのトークン数の3桁区切り文字（""、","、"_"）
+
+	SaveRawResponsePath string `json:"save_raw_response_path,omitempty"` // デバッグ用に API の生レスポンスを保存するファイル（空で無効）
+
+	AsyncFirstRender bool `json:"async_first_render"` // キャッシュが無い場合は取得を待たずに "fetching…" を表示
+
+	TokenLookupBudgetMillis int `json:"token_lookup_budget_millis"` // トークン取得を待つ上限（ミリ秒）。超えたらキャッシュで表示（0 で無制限）
+
+	// リセット時刻の表示形式（Go の時刻レイアウト。例: "3:04 PM"）
+	ResetTimeLayout       string `json:"reset_time_layout"`
+	WeeklyResetTimeLayout string `json:"weekly_reset_time_layout"`
+
+	Timezone string `json:"timezone"` // リセット時刻を表示するタイムゾーン（IANA 名。空の場合はローカル時刻）
+
+	// 複数アカウントの5時間使用率をまとめて表示するプロファイル名と集計方法（"max" または "sum"）
+	AggregateProfiles []string `json:"aggregate_profiles,omitempty"`
+	AggregateMode     string   `json:"aggregate_mode"`
+
+	// 警告などを JSON Lines で追記するファイルと記録するレベル（"debug" または "warn"）
+	LogFile  string `json:"log_file"`
+	LogLevel string `json:"log_level"`
+
+	unknownKeys []string // 設定ファイルに含まれていた未知のキー（validate で警告する）
 }
 
 // defaultConfig はデフォルト設定を返す
@@ -124,13 +340,355 @@ func defaultConfig() *Config {
 		ShowWeekUsage:    true,
 		ShowWeekResets:   true,
 		BarWidth:         20,
+		ResetNowText:     "now",
+		NotifyMethod:     notifyMethodBell,
+		WeekLabel:        defaultWeekLabel,
+		ThresholdYellow:  usageThresholdYellow,
+		ThresholdOrange:  usageThresholdOrange,
+		ThresholdRed:     usageThresholdRed,
+
+		WeeklyThresholdYellow: usageThresholdYellow,
+		WeeklyThresholdOrange: usageThresholdOrange,
+		WeeklyThresholdRed:    usageThresholdRed,
+
+		SparklineWidth:   defaultSparklineWidth,
+		SparklineSamples: defaultSparklineSamples,
+		OutputFormat:     outputFormatText,
+		Separator:        defaultSeparator,
+
+		APIMaxAttempts:          defaultAPIMaxAttempts,
+		APIRetryBaseDelayMillis: defaultAPIRetryBaseDelayMillis,
+
+		CacheMaxSamples: defaultCacheMaxSamples,
+		ResetDisplay:    resetDisplayClock,
+		ShowBar:         true,
+		StaleText:       defaultStaleText,
+		PercentPosition: percentPositionLeft,
+		TokenUnit:       tokenUnitAuto,
+		ShadeSteps:      defaultShadeSteps,
+
+		UsageFractionScale: defaultUsageFractionScale,
+		ResetRounding:      resetRoundingNearest,
+		ResetPrecision:     resetPrecisionMinute,
+
+		CacheTTLSeconds:         int(pollInterval / time.Second),
+		MinFetchIntervalSeconds: int(minFetchInterval / time.Second),
+
+		ResetTimeLayout:       defaultResetTimeLayout,
+		WeeklyResetTimeLayout: defaultWeeklyResetTimeLayout,
+
+		AggregateMode: aggregateMax,
+		LogLevel:      logLevelWarn,
+	}
+}
+
+// showFlags は --show で指定できる要素のキーと対応する表示設定を返す
+func (c *Config) showFlags() map[string]*bool {
+	return map[string]*bool{
+		segHealth:     &c.ShowHealthDot,
+		segApp:        &c.ShowAppName,
+		segModel:      &c.ShowModel,
+		segEffort:     &c.ShowEffort,
+		segThinking:   &c.ShowThinking,
+		segStyle:      &c.ShowOutputStyle,
+		segTokens:     &c.ShowTokens,
+		segContext:    &c.ShowContextUsage,
+		segContextPct: &c.ShowContextPct,
+		seg5h:         &c.Show5hUsage,
+		segSparkline:  &c.ShowSparkline,
+		seg5hResets:   &c.Show5hResets,
+		segWeek:       &c.ShowWeekUsage,
+		segWeekResets: &c.ShowWeekResets,
+		segCost:       &c.ShowCost,
+		segNextReset:  &c.ShowSoonestResetCountdown,
+		segBurnRate:   &c.ShowBurnRate,
+		segAccount:    &c.ShowAccount,
+		segCwd:        &c.ShowCwd,
+		segSession:    &c.ShowSession,
+		segGitBranch:  &c.ShowGitBranch,
+	}
+}
+
+// applyShowList は指定された要素だけを表示するよう表示設定を上書きする
+// keys が空の場合は何もしない
+func (c *Config) applyShowList(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	flags := c.showFlags()
+	for _, key := range keys {
+		if _, ok := flags[key]; !ok {
+			return fmt.Errorf("unknown part %q", key)
+		}
+	}
+	for _, enabled := range flags {
+		*enabled = false
+	}
+	for _, key := range keys {
+		*flags[key] = true
+	}
+	return nil
+}
+
+// parseShowList はカンマ区切りの要素キーを分割する（空要素は無視）
+func parseShowList(value string) []string {
+	var keys []string
+	for _, key := range strings.Split(value, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// validate は設定値を検証し、不正な値をデフォルトに戻す
+// 戻り値は警告メッセージの一覧
+func (c *Config) validate() []string {
+	var warnings []string
+
+	for _, key := range c.unknownKeys {
+		warnings = append(warnings, fmt.Sprintf("unknown config key %q, ignored", key))
+	}
+	var unknownLabels []string
+	for key := range c.Labels {
+		if !labelKeys[key] {
+			unknownLabels = append(unknownLabels, key)
+		}
+	}
+	sort.Strings(unknownLabels)
+	for _, key := range unknownLabels {
+		warnings = append(warnings, fmt.Sprintf("unknown labels key %q, ignored", key))
+	}
+
+	if c.BarWidth < 0 {
+		warnings = append(warnings, fmt.Sprintf("invalid bar_width %d, using %d", c.BarWidth, barWidth))
+		c.BarWidth = barWidth
+	}
+
+	if !(colorThresholds{c.ThresholdYellow, c.ThresholdOrange, c.ThresholdRed}).valid() {
+		warnings = append(warnings, fmt.Sprintf(
+			"invalid color thresholds (yellow=%g, orange=%g, red=%g), using defaults",
+			c.ThresholdYellow, c.ThresholdOrange, c.ThresholdRed))
+		c.ThresholdYellow = usageThresholdYellow
+		c.ThresholdOrange = usageThresholdOrange
+		c.ThresholdRed = usageThresholdRed
+	}
+	if !(colorThresholds{c.WeeklyThresholdYellow, c.WeeklyThresholdOrange, c.WeeklyThresholdRed}).valid() {
+		warnings = append(warnings, fmt.Sprintf(
+			"invalid weekly color thresholds (yellow=%g, orange=%g, red=%g), using defaults",
+			c.WeeklyThresholdYellow, c.WeeklyThresholdOrange, c.WeeklyThresholdRed))
+		c.WeeklyThresholdYellow = usageThresholdYellow
+		c.WeeklyThresholdOrange = usageThresholdOrange
+		c.WeeklyThresholdRed = usageThresholdRed
+	}
+
+	if c.CacheTTLSeconds <= 0 || c.MinFetchIntervalSeconds <= 0 || c.MinFetchIntervalSeconds >= c.CacheTTLSeconds {
+		warnings = append(warnings, fmt.Sprintf(
+			"invalid cache intervals (cache_ttl_seconds=%d, min_fetch_interval_seconds=%d), using %d and %d",
+			c.CacheTTLSeconds, c.MinFetchIntervalSeconds, int(pollInterval/time.Second), int(minFetchInterval/time.Second)))
+		c.CacheTTLSeconds = int(pollInterval / time.Second)
+		c.MinFetchIntervalSeconds = int(minFetchInterval / time.Second)
+	}
+
+	if c.Separator == "" {
+		warnings = append(warnings, fmt.Sprintf("separator must not be empty, using %q", defaultSeparator))
+		c.Separator = defaultSeparator
+	}
+
+	switch c.PrimaryWindow {
+	case "", windowFiveHour, windowSevenDay:
+	default:
+		warnings = append(warnings, fmt.Sprintf("unknown primary_window %q, ignored", c.PrimaryWindow))
+		c.PrimaryWindow = ""
+	}
+
+	switch c.OutputFormat {
+	case outputFormatText, outputFormatJSON, outputFormatPowerline, outputFormatTmux:
+	default:
+		warnings = append(warnings, fmt.Sprintf("unknown output_format %q, using %q", c.OutputFormat, outputFormatText))
+		c.OutputFormat = outputFormatText
+	}
+
+	switch c.ResetDisplay {
+	case resetDisplayClock, resetDisplayRelative, resetDisplayBoth:
+	default:
+		warnings = append(warnings, fmt.Sprintf("unknown reset_display %q, using %q", c.ResetDisplay, resetDisplayClock))
+		c.ResetDisplay = resetDisplayClock
+	}
+
+	switch c.PercentPosition {
+	case percentPositionLeft, percentPositionRight:
+	default:
+		warnings = append(warnings, fmt.Sprintf("unknown percent_position %q, using %q", c.PercentPosition, percentPositionLeft))
+		c.PercentPosition = percentPositionLeft
+	}
+
+	if _, ok := shadeRamps[c.ShadeSteps]; !ok {
+		warnings = append(warnings, fmt.Sprintf("unsupported shade_steps %d, using %d", c.ShadeSteps, defaultShadeSteps))
+		c.ShadeSteps = defaultShadeSteps
+	}
+
+	if c.UsageFractionScale <= 0 {
+		warnings = append(warnings, fmt.Sprintf("invalid usage_fraction_scale %d, using %d", c.UsageFractionScale, defaultUsageFractionScale))
+		c.UsageFractionScale = defaultUsageFractionScale
+	}
+
+	switch c.ResetRounding {
+	case resetRoundingNearest, resetRoundingUp, resetRoundingDown:
+	default:
+		warnings = append(warnings, fmt.Sprintf("unknown reset_rounding %q, using %q", c.ResetRounding, resetRoundingNearest))
+		c.ResetRounding = resetRoundingNearest
+	}
+	switch c.ResetPrecision {
+	case resetPrecisionMinute, resetPrecisionSecond:
+	default:
+		warnings = append(warnings, fmt.Sprintf("unknown reset_precision %q, using %q", c.ResetPrecision, resetPrecisionMinute))
+		c.ResetPrecision = resetPrecisionMinute
+	}
+
+	switch c.TokenUnit {
+	case tokenUnitAuto, tokenUnitK, tokenUnitRaw:
+	default:
+		warnings = append(warnings, fmt.Sprintf("unknown token_unit %q, using %q", c.TokenUnit, tokenUnitAuto))
+		c.TokenUnit = tokenUnitAuto
+	}
+	switch c.TokenSeparator {
+	case "", ",", "_":
+	default:
+		warnings = append(warnings, fmt.Sprintf("unsupported token_separator %q, using none", c.TokenSeparator))
+		c.TokenSeparator = ""
+	}
+
+	for _, field := range []struct {
+		name  string
+		value *string
+	}{
+		{"color_green", &c.ColorGreen},
+		{"color_yellow", &c.ColorYellow},
+		{"color_orange", &c.ColorOrange},
+		{"color_red", &c.ColorRed},
+	} {
+		if *field.value != "" && !ansiSGRPattern.MatchString(*field.value) {
+			warnings = append(warnings, fmt.Sprintf("invalid %s %q (must be an ANSI SGR sequence like \"\\u001b[32m\"), using default", field.name, *field.value))
+			*field.value = ""
+		}
+	}
+
+	if c.APIEndpoint != "" && !validEndpoint(c.APIEndpoint) {
+		warnings = append(warnings, fmt.Sprintf("invalid api_endpoint %q, using %q", c.APIEndpoint, apiEndpoint))
+		c.APIEndpoint = apiEndpoint
+	}
+
+	if c.ProxyURL != "" && !validProxyURL(c.ProxyURL) {
+		warnings = append(warnings, fmt.Sprintf("invalid proxy_url %q, using proxy environment variables", c.ProxyURL))
+		c.ProxyURL = ""
+	}
+
+	if _, ok := logLevelRank[c.LogLevel]; !ok {
+		warnings = append(warnings, fmt.Sprintf("unknown log_level %q, using %q", c.LogLevel, logLevelWarn))
+		c.LogLevel = logLevelWarn
+	}
+
+	// プロファイル名はキャッシュファイルのパスになるため、ディレクトリ名として使えないものは除く
+	var profiles []string
+	for _, name := range c.AggregateProfiles {
+		if !validProfileName(name) {
+			warnings = append(warnings, fmt.Sprintf("invalid aggregate_profiles entry %q, ignored", name))
+			continue
+		}
+		profiles = append(profiles, name)
+	}
+	if len(profiles) != len(c.AggregateProfiles) {
+		c.AggregateProfiles = profiles
+	}
+
+	switch c.AggregateMode {
+	case aggregateMax, aggregateSum:
+	default:
+		warnings = append(warnings, fmt.Sprintf("unknown aggregate_mode %q, using %q", c.AggregateMode, aggregateMax))
+		c.AggregateMode = aggregateMax
+	}
+
+	if c.Timezone != "" {
+		if _, err := time.LoadLocation(c.Timezone); err != nil {
+			warnings = append(warnings, fmt.Sprintf("unknown timezone %q, using local time: %v", c.Timezone, err))
+			c.Timezone = ""
+		}
+	}
+
+	for _, layout := range []struct {
+		name  string
+		value *string
+		def   string
+	}{
+		{"reset_time_layout", &c.ResetTimeLayout, defaultResetTimeLayout},
+		{"weekly_reset_time_layout", &c.WeeklyResetTimeLayout, defaultWeeklyResetTimeLayout},
+	} {
+		if !validTimeLayout(*layout.value) {
+			warnings = append(warnings, fmt.Sprintf("invalid %s %q, using %q", layout.name, *layout.value, layout.def))
+			*layout.value = layout.def
+		}
 	}
+
+	for _, field := range []struct {
+		name  string
+		value *string
+	}{
+		{"bar_filled_char", &c.BarFilledChar},
+		{"bar_empty_char", &c.BarEmptyChar},
+	} {
+		if utf8.RuneCountInString(*field.value) > 1 {
+			r, _ := utf8.DecodeRuneInString(*field.value)
+			warnings = append(warnings, fmt.Sprintf("%s must be a single character, using %q", field.name, string(r)))
+			*field.value = string(r)
+		}
+	}
+
+	return warnings
 }
 
 // loadConfig は設定ファイルを読み込む
 func loadConfig() (*Config, error) {
-	configPath := filepath.Join(getConfigDir(), "config.json")
-	return loadConfigFromPath(configPath)
+	return loadConfigFromPath(getConfigFilePath())
+}
+
+// getConfigFilePath は設定ファイルのパスを返す
+func getConfigFilePath() string {
+	return profileConfigFilePath("")
+}
+
+// profileConfigFilePath は指定されたプロファイルの設定ファイルのパスを返す
+func profileConfigFilePath(name string) string {
+	return filepath.Join(profileDir(name), "config.json")
+}
+
+// loadConfig はプロファイルの設定ファイルを読み込む
+func (sl *StatusLine) loadConfig() (*Config, error) {
+	return loadConfigFromPath(profileConfigFilePath(sl.profile))
+}
+
+// unknownConfigKeys は設定ファイルの JSON に含まれる、Config に存在しないキーを名前順に返す
+func unknownConfigKeys(data []byte) []string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil
+	}
+	known := make(map[string]bool)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			known[name] = true
+		}
+	}
+	var unknown []string
+	for key := range fields {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
 }
 
 // loadConfigFromPath は指定されたパスから設定ファイルを読み込む
@@ -147,20 +705,26 @@ func loadConfigFromPath(configPath string) (*Config, error) {
 		return cfg, nil
 	}
 
-	file, err := os.Open(configPath)
+	data, err := os.ReadFile(configPath)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	// Windows のエディタが付ける UTF-8 BOM は JSON として読めないため取り除く
+	data = bytes.TrimPrefix(data, utf8BOM)
 
 	// デフォルト値の上にJSONをマージ
-	if err := json.NewDecoder(file).Decode(cfg); err != nil {
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(cfg); err != nil {
 		return nil, err
 	}
+	// 未知のキーは読み飛ばし、validate で警告する
+	cfg.unknownKeys = unknownConfigKeys(data)
 
 	return cfg, nil
 }
 
+// utf8BOM は UTF-8 のバイトオーダーマーク
+var utf8BOM = []byte("\xef\xbb\xbf")
+
 // saveConfig は設定をファイルに保存する
 func saveConfig(configPath string, cfg *Config) error {
 	// ディレクトリを作成
@@ -184,8 +748,41 @@ type StatusLine struct {
 	httpClient        *http.Client
 	getHistoryModTime func() (time.Time, error)
 	getAccessToken    func() (string, error)
-	execCommand       func(name string, arg ...string) *exec.Cmd
+	execCommand       func(ctx context.Context, name string, arg ...string) *exec.Cmd
+	isTerminal        func(w io.Writer) bool
+	gitBranch         func(dir string) (string, error)
 	stderr            io.Writer
+	now               func() time.Time
+	sleep             func(d time.Duration)
+	cfg               *Config       // 実行中の設定
+	model             string        // 入力で渡された現在のモデル名
+	forceRefresh      bool          // キャッシュの有効性に関わらず API から取得
+	dryRun            bool          // 取得やキャッシュの書き込みをせず、判定結果を stderr に出力
+	offline           bool          // API にアクセスせず、ディスク上のキャッシュ（期限切れでも）で表示
+	allowEmptyInput   bool          // 標準入力が空の場合にエラーにせず、ヒントを出して空の入力で表示
+	outputFormat      string        // コマンドラインで指定された出力形式
+	showList          []string      // コマンドラインで指定された表示する要素
+	compact           bool          // コマンドラインでコンパクト表示が指定されたか
+	profile           string        // 設定・キャッシュ・認証情報を切り替えるプロファイル名（空の場合は指定なし）
+	keychainTimeout   time.Duration // Keychain からの取得を待つ上限
+	backgroundWait    time.Duration // 終了前にバックグラウンドの取得を待つ上限
+
+	timingMu sync.Mutex               // timings の排他制御
+	timings  map[string]time.Duration // フェーズごとの所要時間（nil の場合は計測しない）
+
+	background sync.WaitGroup // 表示後も続くバックグラウンドの取得
+
+	logMu     sync.Mutex // stderr と LogFile へのログの書き込みの排他制御
+	verbosity string     // stderr に出力する最低のログレベル（デフォルトは警告のみ）
+	quiet     bool       // 警告を stderr に出力しない（-v のログや --timings、--dry-run の出力は残す）
+
+	token              atomic.Pointer[string] // API リクエストに使ったアクセストークン（ログから伏せるため）
+	credentialsAccount atomic.Pointer[string] // 認証情報に含まれていたアカウント
+	apiKeyAuth         atomic.Bool            // トークンが ANTHROPIC_API_KEY の API キーか（x-api-key ヘッダーで送る）
+
+	severity severity // 直近の表示での最も高い使用率の段階（--exit-status 用）
+
+	cacheReadOnly atomic.Bool // キャッシュが書き込めないことが判明したか
 }
 
 // StatusLineOption は StatusLine のオプション設定用関数型
@@ -194,12 +791,24 @@ type StatusLineOption func(*StatusLine)
 // NewStatusLine は新しい StatusLine インスタンスを作成
 func NewStatusLine(opts ...StatusLineOption) *StatusLine {
 	sl := &StatusLine{
-		httpClient:        &http.Client{Timeout: 10 * time.Second},
 		getHistoryModTime: getHistoryModTime,
-		getAccessToken:    getAccessToken,
-		execCommand:       exec.Command,
+		execCommand:       exec.CommandContext,
+		isTerminal:        isTerminal,
+		gitBranch:         gitBranch,
 		stderr:            os.Stderr,
+		now:               time.Now,
+		sleep:             time.Sleep,
+		cfg:               defaultConfig(),
+		verbosity:         logLevelWarn,
+		keychainTimeout:   keychainTimeout,
+		backgroundWait:    backgroundWait,
 	}
+	sl.getAccessToken = sl.defaultAccessToken
+
+	// プロキシは設定の proxy_url、HTTPS_PROXY などの環境変数の順に使う
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = sl.proxy
+	sl.httpClient = &http.Client{Timeout: apiTimeout, Transport: transport}
 
 	for _, opt := range opts {
 		opt(sl)
@@ -208,7 +817,16 @@ func NewStatusLine(opts ...StatusLineOption) *StatusLine {
 	return sl
 }
 
-// WithHTTPClient はカスタムHTTPクライアントを設定
+// proxy は API リクエストに使うプロキシを返す
+// ProxyURL が設定されていればそれを使い、それ以外は HTTPS_PROXY / HTTP_PROXY / NO_PROXY 環境変数に従う
+func (sl *StatusLine) proxy(req *http.Request) (*url.URL, error) {
+	if sl.cfg.ProxyURL != "" {
+		return url.Parse(sl.cfg.ProxyURL)
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// WithHTTPClient はカスタムHTTPクライアントを設定（プロキシの設定は適用しない）
 func WithHTTPClient(client *http.Client) StatusLineOption {
 	return func(sl *StatusLine) {
 		sl.httpClient = client
@@ -229,13 +847,27 @@ func WithAccessTokenFunc(fn func() (string, error)) StatusLineOption {
 	}
 }
 
-// WithExecCommand はカスタムのexec.Command関数を設定（テスト用）
-func WithExecCommand(fn func(name string, arg ...string) *exec.Cmd) StatusLineOption {
+// WithExecCommand はカスタムのexec.CommandContext関数を設定（テスト用）
+func WithExecCommand(fn func(ctx context.Context, name string, arg ...string) *exec.Cmd) StatusLineOption {
 	return func(sl *StatusLine) {
 		sl.execCommand = fn
 	}
 }
 
+// WithKeychainTimeout は Keychain からの取得を待つ上限を設定（テスト用）
+func WithKeychainTimeout(d time.Duration) StatusLineOption {
+	return func(sl *StatusLine) {
+		sl.keychainTimeout = d
+	}
+}
+
+// WithBackgroundWait は終了前にバックグラウンドの取得を待つ上限を設定（テスト用）
+func WithBackgroundWait(d time.Duration) StatusLineOption {
+	return func(sl *StatusLine) {
+		sl.backgroundWait = d
+	}
+}
+
 // WithStderr はカスタムのstderr出力先を設定（テスト用）
 func WithStderr(w io.Writer) StatusLineOption {
 	return func(sl *StatusLine) {
@@ -243,6 +875,120 @@ func WithStderr(w io.Writer) StatusLineOption {
 	}
 }
 
+// WithQuiet は警告を stderr に出力しないようにする（LogFile への記録は変わらない）
+func WithQuiet(enabled bool) StatusLineOption {
+	return func(sl *StatusLine) {
+		sl.quiet = enabled
+	}
+}
+
+// WithNowFunc はカスタムの現在時刻取得関数を設定（テスト用）
+func WithNowFunc(fn func() time.Time) StatusLineOption {
+	return func(sl *StatusLine) {
+		sl.now = fn
+	}
+}
+
+// WithSleepFunc はカスタムの待機関数を設定（テスト用）
+func WithSleepFunc(fn func(d time.Duration)) StatusLineOption {
+	return func(sl *StatusLine) {
+		sl.sleep = fn
+	}
+}
+
+// WithTimings は各処理フェーズの所要時間計測を有効化
+func WithTimings(enabled bool) StatusLineOption {
+	return func(sl *StatusLine) {
+		if enabled {
+			sl.timings = make(map[string]time.Duration)
+		}
+	}
+}
+
+// WithIsTerminalFunc はカスタムの端末判定関数を設定
+func WithIsTerminalFunc(fn func(w io.Writer) bool) StatusLineOption {
+	return func(sl *StatusLine) {
+		sl.isTerminal = fn
+	}
+}
+
+// WithGitBranchFunc はカスタムの git ブランチ取得関数を設定
+func WithGitBranchFunc(fn func(dir string) (string, error)) StatusLineOption {
+	return func(sl *StatusLine) {
+		sl.gitBranch = fn
+	}
+}
+
+// WithForceRefresh はキャッシュの有効性チェックを省略して常に API から取得するよう指定
+func WithForceRefresh(enabled bool) StatusLineOption {
+	return func(sl *StatusLine) {
+		sl.forceRefresh = enabled
+	}
+}
+
+// WithOutputFormat は設定ファイルの出力形式を上書きする（空の場合は上書きしない）
+func WithOutputFormat(format string) StatusLineOption {
+	return func(sl *StatusLine) {
+		sl.outputFormat = format
+	}
+}
+
+// WithShowList は表示する要素を指定されたキーだけに上書きする（空の場合は上書きしない）
+func WithShowList(keys []string) StatusLineOption {
+	return func(sl *StatusLine) {
+		sl.showList = keys
+	}
+}
+
+// WithDryRun は取得せずにキャッシュの判定結果を出力するモードを設定
+func WithDryRun(enabled bool) StatusLineOption {
+	return func(sl *StatusLine) {
+		sl.dryRun = enabled
+	}
+}
+
+// WithOffline は API にアクセスせずキャッシュだけで表示するモードを設定
+func WithOffline(enabled bool) StatusLineOption {
+	return func(sl *StatusLine) {
+		sl.offline = enabled
+	}
+}
+
+// WithAllowEmptyInput は標準入力が空の場合に空の入力で表示するかを設定
+func WithAllowEmptyInput(enabled bool) StatusLineOption {
+	return func(sl *StatusLine) {
+		sl.allowEmptyInput = enabled
+	}
+}
+
+// WithVerbosity は stderr に出力する最低のログレベルを設定（"debug"、"info"、"warn"）
+func WithVerbosity(level string) StatusLineOption {
+	return func(sl *StatusLine) {
+		sl.verbosity = level
+	}
+}
+
+// WithProfile はプロファイルを設定（空の場合はプロファイルを使わない）
+func WithProfile(name string) StatusLineOption {
+	return func(sl *StatusLine) {
+		sl.profile = name
+	}
+}
+
+// WithCompact はコンパクト表示を有効にする（設定ファイルの値より優先）
+func WithCompact(compact bool) StatusLineOption {
+	return func(sl *StatusLine) {
+		sl.compact = compact
+	}
+}
+
+// WithConfig は使用する設定を指定（テスト用）
+func WithConfig(cfg *Config) StatusLineOption {
+	return func(sl *StatusLine) {
+		sl.cfg = cfg
+	}
+}
+
 // InputData は Claude Code から渡される標準入力のJSON構造
 type InputData struct {
 	Model struct {
@@ -275,22 +1021,189 @@ type InputData struct {
 	OutputStyle *struct {
 		Name string `json:"name"`
 	} `json:"output_style"`
+	SessionID string `json:"session_id"`
+	Cwd       string `json:"cwd"`
+	Workspace struct {
+		CurrentDir string `json:"current_dir"`
+	} `json:"workspace"`
 }
 
-// CacheData はキャッシュされる使用状況データ
-type CacheData struct {
-	ResetsAt          string  `json:"resets_at"`          // 5時間リセット時刻（ISO8601形式）
-	Utilization       float64 `json:"utilization"`        // 5時間使用率（0-100）
-	WeeklyUtilization float64 `json:"weekly_utilization"` // 週間使用率（0-100）
-	WeeklyResetsAt    string  `json:"weekly_resets_at"`   // 週間リセット時刻（ISO8601形式）
-	CachedAt          int64   `json:"cached_at"`          // キャッシュ作成時刻（Unix時刻）
-}
-
-// Credentials は OAuth 認証情報
+// gitBranch は dir を含む git リポジトリの現在のブランチ名を .git/HEAD から読み取る（git コマンドは使わない）
+// リポジトリ外の場合や detached HEAD の場合は空文字列を返す
+func gitBranch(dir string) (string, error) {
+	gitDir, err := findGitDir(dir)
+	if err != nil || gitDir == "" {
+		return "", err
+	}
+	head, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+	ref, ok := strings.CutPrefix(strings.TrimSpace(string(head)), "ref: ")
+	if !ok {
+		return "", nil // detached HEAD（コミットハッシュ）
+	}
+	return strings.TrimPrefix(ref, "refs/heads/"), nil
+}
+
+// findGitDir は dir から親ディレクトリを遡って .git を探し、git ディレクトリのパスを返す（見つからない場合は空）
+// worktree やサブモジュールの .git ファイル（"gitdir: パス"）にも対応する
+func findGitDir(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		gitPath := filepath.Join(dir, ".git")
+		info, err := os.Stat(gitPath)
+		if err == nil {
+			if info.IsDir() {
+				return gitPath, nil
+			}
+			data, err := os.ReadFile(gitPath)
+			if err != nil {
+				return "", err
+			}
+			target, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "gitdir: ")
+			if !ok {
+				return "", fmt.Errorf("invalid .git file: %s", gitPath)
+			}
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(dir, target)
+			}
+			return target, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// sessionIDLength は表示するセッション ID の文字数
+const sessionIDLength = 8
+
+// cwdName は作業ディレクトリのディレクトリ名を返す（cwd が無い場合は workspace.current_dir を使い、どちらも無い場合は空）
+func (in *InputData) cwdName() string {
+	dir := firstNonEmpty(in.Cwd, in.Workspace.CurrentDir)
+	if dir == "" {
+		return ""
+	}
+	return filepath.Base(dir)
+}
+
+// shortSessionID はセッション ID の先頭 sessionIDLength 文字を返す
+func (in *InputData) shortSessionID() string {
+	if len(in.SessionID) > sessionIDLength {
+		return in.SessionID[:sessionIDLength]
+	}
+	return in.SessionID
+}
+
+// CacheData はキャッシュされる使用状況データ
+type CacheData struct {
+	ResetsAt          string  `json:"resets_at"`                 // 5時間リセット時刻（ISO8601形式）
+	Utilization       float64 `json:"utilization"`               // 5時間使用率（0-100）
+	WeeklyUtilization float64 `json:"weekly_utilization"`        // 週間使用率（0-100）
+	WeeklyResetsAt    string  `json:"weekly_resets_at"`          // 週間リセット時刻（ISO8601形式）
+	CachedAt          int64   `json:"cached_at"`                 // キャッシュ作成時刻（Unix時刻）
+	LastModel         string  `json:"last_model,omitempty"`      // 取得時のモデル名
+	NextPollAfter     int64   `json:"next_poll_after,omitempty"` // API が推奨する次回取得時刻（Unix時刻）
+	RetryAfter        int64   `json:"retry_after,omitempty"`     // Rate Limit によりこの時刻まで取得しない（Unix時刻）
+
+	Windows map[string]UsageWindow `json:"windows,omitempty"` // API が返した全ての使用枠（キーは "five_hour" など）
+	Stale   bool                   `json:"-"`                 // 取得に失敗し期限切れキャッシュを返したか
+	Samples []float64              `json:"samples,omitempty"` // 直近の5時間使用率（古い順、API 取得ごとに追加）
+
+	PrevUtilization *float64 `json:"prev_utilization,omitempty"` // 前回取得時の5時間使用率（初回は nil）
+	PrevCachedAt    int64    `json:"prev_cached_at,omitempty"`   // 前回取得時刻（Unix時刻）
+
+	Account string `json:"account,omitempty"` // 使用状況の対象アカウント（メールアドレスまたは組織名）
+}
+
+// appendSample は履歴に使用率を追加し、古いものから capacity 件を超えた分を捨てる
+// capacity が0以下の場合は捨てない
+func appendSample(samples []float64, usage float64, capacity int) []float64 {
+	samples = append(append([]float64(nil), samples...), usage)
+	if capacity > 0 && len(samples) > capacity {
+		samples = samples[len(samples)-capacity:]
+	}
+	return samples
+}
+
+// sparklineChars はスパークラインの文字（低い順）
+var sparklineChars = []rune("▁▂▃▅▆▇█")
+
+// asciiSparklineChars は ASCIIOnly の場合のスパークラインの文字（低い順）
+var asciiSparklineChars = []rune("_.-=+*#")
+
+// renderSparkline は直近 width 件の使用率をスパークラインで表す
+// 各文字の高さは 0-100% の絶対値に対応する（ascii の場合は ASCII 文字で表す）
+func renderSparkline(samples []float64, width int, ascii bool) string {
+	chars := sparklineChars
+	if ascii {
+		chars = asciiSparklineChars
+	}
+	if width <= 0 {
+		width = defaultSparklineWidth
+	}
+	if len(samples) > width {
+		samples = samples[len(samples)-width:]
+	}
+
+	var b strings.Builder
+	for _, usage := range samples {
+		idx := int(usage / 100.0 * float64(len(chars)))
+		if idx < 0 {
+			idx = 0
+		}
+		if idx >= len(chars) {
+			idx = len(chars) - 1
+		}
+		b.WriteRune(chars[idx])
+	}
+	return b.String()
+}
+
+// UsageWindow は API レスポンスに含まれる1つの使用枠
+type UsageWindow struct {
+	ResetsAt    string  `json:"resets_at"`   // リセット時刻（ISO8601形式）
+	Utilization float64 `json:"utilization"` // 使用率（0-100）
+}
+
+// Credentials は OAuth 認証情報
 type Credentials struct {
 	ClaudeAiOauth struct {
 		AccessToken string `json:"accessToken"`
 	} `json:"claudeAiOauth"`
+	OAuthAccount struct {
+		EmailAddress     string `json:"emailAddress"`
+		OrganizationName string `json:"organizationName"`
+	} `json:"oauthAccount"` // ログイン中のアカウント（含まれない場合もある）
+}
+
+// accessToken はアクセストークンを返す（空の場合はエラー）
+func (c *Credentials) accessToken() (string, error) {
+	if c.ClaudeAiOauth.AccessToken == "" {
+		return "", fmt.Errorf("access token is empty")
+	}
+	return c.ClaudeAiOauth.AccessToken, nil
+}
+
+// account はアカウントのメールアドレス、無ければ組織名を返す（どちらも無い場合は空）
+func (c *Credentials) account() string {
+	return firstNonEmpty(c.OAuthAccount.EmailAddress, c.OAuthAccount.OrganizationName)
+}
+
+// firstNonEmpty は最初の空でない文字列を返す
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
 }
 
 const defaultRetryAfter = 60 * time.Second
@@ -304,6 +1217,23 @@ func (e *RateLimitError) Error() string {
 	return fmt.Sprintf("rate limited: retry after %v", e.RetryAfter)
 }
 
+// maxRawResponseBytes は SaveRawResponsePath に保存するレスポンスボディの上限
+const maxRawResponseBytes = 64 * 1024
+
+// saveRawResponse はデバッグ用にパース前のレスポンスボディを SaveRawResponsePath に保存する
+// 上限を超えた部分は切り捨て、書き込みに失敗しても警告のみで取得は継続する
+func (sl *StatusLine) saveRawResponse(body []byte) {
+	if sl.cfg.SaveRawResponsePath == "" {
+		return
+	}
+	if len(body) > maxRawResponseBytes {
+		body = body[:maxRawResponseBytes]
+	}
+	if err := writeFileAtomic(sl.cfg.SaveRawResponsePath, body); err != nil {
+		sl.warnf("failed to save raw response: %v", err)
+	}
+}
+
 // parseRetryAfter は Retry-After ヘッダーの値をパースする
 // 秒数形式のみサポート。パース失敗時はデフォルト値を返す
 func parseRetryAfter(value string) time.Duration {
@@ -327,290 +1257,2254 @@ type APIResponse struct {
 		ResetsAt    string  `json:"resets_at"`
 		Utilization float64 `json:"utilization"`
 	} `json:"seven_day"`
+	PollAfterSeconds int64 `json:"poll_after_seconds"` // 次回ポーリングまでの推奨秒数（任意）
+	Account          struct {
+		EmailAddress     string `json:"email_address"`
+		OrganizationName string `json:"organization_name"`
+	} `json:"account"` // 使用状況の対象アカウント（任意）
+
+	Windows map[string]UsageWindow `json:"-"` // utilization を持つ全ての使用枠
 }
 
-func main() {
-	sl := NewStatusLine()
-	if err := sl.run(os.Stdin, os.Stdout, ""); err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
-		os.Exit(1)
+// parseAPIResponse は API レスポンスボディをパースする
+// フラットな形式と {"data": {...}} でラップされた形式の両方に対応
+func parseAPIResponse(body []byte) (*APIResponse, error) {
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, err
 	}
-}
 
-// run はメインロジックを実行（テスト可能）
-// cacheFileが空の場合はデフォルトパスを使用
-func (sl *StatusLine) run(stdin io.Reader, stdout io.Writer, cacheFile string) error {
-	// 設定ファイルを読み込む
-	cfg, err := loadConfig()
+	// data キーがオブジェクトの場合はその中身をパース
+	if len(envelope.Data) > 0 && envelope.Data[0] == '{' {
+		body = envelope.Data
+	}
+
+	body, err := normalizeResetTimes(body)
 	if err != nil {
-		fmt.Fprintf(sl.stderr, "warning: failed to load config: %v\n", err)
-		cfg = defaultConfig()
+		return nil, err
 	}
 
-	return sl.runWithConfig(stdin, stdout, cacheFile, cfg)
+	var apiResp APIResponse
+	if err := json.Unmarshal(body, &apiResp); err != nil {
+		return nil, err
+	}
+	apiResp.Windows = parseUsageWindows(body)
+	return &apiResp, nil
 }
 
-// runWithConfig は指定された設定でメインロジックを実行（テスト用）
-func (sl *StatusLine) runWithConfig(stdin io.Reader, stdout io.Writer, cacheFile string, cfg *Config) error {
-	// 標準入力からJSONを読み込む
-	var input InputData
-	if err := json.NewDecoder(stdin).Decode(&input); err != nil {
-		return fmt.Errorf("failed to read input: %w", err)
+// normalizeResetTimes は数値（エポック秒）で返された resets_at を ISO8601 文字列に変換する
+func normalizeResetTimes(body []byte) ([]byte, error) {
+	var windows map[string]json.RawMessage
+	if err := json.Unmarshal(body, &windows); err != nil {
+		return nil, err
 	}
 
-	// 累積トークン数を計算
-	totalTokens := input.ContextWindow.TotalInputTokens + input.ContextWindow.TotalOutputTokens
-	totalTokensStr := formatTokens(totalTokens)
-
-	// 使用率データを取得
-	// stdin に rate_limits がある場合はそれを優先し、ない場合は API にフォールバック
-	var cache *CacheData
-
-	if input.RateLimits != nil && input.RateLimits.FiveHour != nil {
-		// stdin から直接取得
-		cache = &CacheData{
-			Utilization: input.RateLimits.FiveHour.UsedPercentage,
-			ResetsAt:    unixToISO8601(input.RateLimits.FiveHour.ResetsAt),
+	changed := false
+	for key, raw := range windows {
+		var window map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &window); err != nil {
+			continue
 		}
-		if input.RateLimits.SevenDay != nil {
-			cache.WeeklyUtilization = input.RateLimits.SevenDay.UsedPercentage
-			cache.WeeklyResetsAt = unixToISO8601(input.RateLimits.SevenDay.ResetsAt)
-		}
-	} else {
-		// キャッシュファイルのパスを取得
-		if cacheFile == "" {
-			cacheFile = getCacheFilePath()
-
-			// 旧キャッシュファイルからの移行
-			legacyPath := getLegacyCacheFilePath()
-			if err := migrateLegacyCache(legacyPath, cacheFile); err != nil {
-				fmt.Fprintf(sl.stderr, "warning: failed to migrate cache: %v\n", err)
-			}
+		var epoch float64
+		if err := json.Unmarshal(window["resets_at"], &epoch); err != nil {
+			continue
 		}
-
-		// キャッシュの有効性をチェックし、必要に応じて取得
-		var err error
-		cache, err = sl.getCachedOrFetch(cacheFile, apiEndpoint)
+		converted, err := json.Marshal(unixToISO8601(int64(epoch)))
 		if err != nil {
-			// デフォルト値で継続
-			cache = &CacheData{Utilization: 0.0}
+			return nil, err
+		}
+		window["resets_at"] = converted
+		if windows[key], err = json.Marshal(window); err != nil {
+			return nil, err
 		}
+		changed = true
 	}
 
-	// リセット時刻をフォーマット
-	resetTime := formatResetTime(cache.ResetsAt)
-	weeklyResetTime := formatResetTimeWithDate(cache.WeeklyResetsAt)
+	if !changed {
+		return body, nil
+	}
+	return json.Marshal(windows)
+}
 
-	// 使用率をフォーマット（色付き、設定されたバー幅で）
-	fiveHourUsage := colorizeUsageWithWidth(cache.Utilization, cfg.BarWidth)
-	weeklyUsage := colorizeUsageWithWidth(cache.WeeklyUtilization, cfg.BarWidth)
+// parseUsageWindows は utilization を持つ全てのオブジェクトを使用枠として取り出す
+func parseUsageWindows(body []byte) map[string]UsageWindow {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil
+	}
 
-	// 異常値の警告
-	if cache.Utilization < 0 || cache.Utilization > 100 {
-		fmt.Fprintf(sl.stderr, "warning: unexpected usage value: %.1f\n", cache.Utilization)
+	windows := make(map[string]UsageWindow)
+	for key, raw := range fields {
+		var window struct {
+			ResetsAt    string   `json:"resets_at"`
+			Utilization *float64 `json:"utilization"`
+		}
+		if err := json.Unmarshal(raw, &window); err != nil || window.Utilization == nil {
+			continue
+		}
+		windows[key] = UsageWindow{ResetsAt: window.ResetsAt, Utilization: *window.Utilization}
 	}
-	if cache.WeeklyUtilization < 0 || cache.WeeklyUtilization > 100 {
-		fmt.Fprintf(sl.stderr, "warning: unexpected weekly usage value: %.1f\n", cache.WeeklyUtilization)
+	if len(windows) == 0 {
+		return nil
 	}
+	return windows
+}
 
-	// ステータスラインを動的に構築
-	var parts []string
+// Options はコマンドライン引数で指定する実行時オプション
+type Options struct {
+	Timings     bool     // 各処理フェーズの所要時間を stderr に出力
+	Refresh     bool     // キャッシュを無視して API から取得
+	Prefetch    bool     // 使用状況を取得してキャッシュに書き込むだけで終了
+	PrintConfig bool     // 有効な設定を JSON で出力して終了
+	Version     bool     // バージョン情報を出力して終了
+	Compact     bool     // 狭い端末向けのコンパクト表示
+	ExitStatus  bool     // 使用率の段階を終了コードで返す
+	DryRun      bool     // 取得せずにキャッシュを使うか取得するかの判定を出力
+	Offline     bool     // API にアクセスせずキャッシュだけで表示（OFFLINE=1 でも有効）
+	AllowEmpty  bool     // 標準入力が空でもエラーにせず表示
+	Doctor      bool     // 設定・認証情報・API・キャッシュ・履歴を診断して終了
+	Verbose     bool     // デバッグログを stderr に出力
+	Quiet       bool     // 警告を stderr に出力しない（致命的なエラーは main が出力）
+	Profile     string   // プロファイル名（空の場合は GO_STATUSLINE_PROFILE、それも無ければ指定なし）
+	CacheFile   string   // キャッシュファイルのパス（空の場合はプロファイルのキャッシュファイル）
+	Output      string   // 出力形式（空の場合は設定ファイルの値）
+	Show        []string // 表示する要素のキー（空の場合は設定ファイルの値）
+}
 
-	if cfg.ShowAppName {
-		parts = append(parts, "go-statusline")
+// parseArgs はコマンドライン引数をパースする
+func parseArgs(args []string, output io.Writer) (*Options, error) {
+	opts := &Options{}
+	fs := flag.NewFlagSet(appName, flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.BoolVar(&opts.Timings, "timings", false, "print the wall time of each phase to stderr")
+	fs.BoolVar(&opts.Refresh, "refresh", false, "ignore the cache and fetch fresh usage data from the API")
+	fs.BoolVar(&opts.Refresh, "f", false, "shorthand for --refresh")
+	fs.BoolVar(&opts.Prefetch, "prefetch", false, "fetch usage data into the cache and exit without reading stdin")
+	fs.BoolVar(&opts.Doctor, "doctor", false, "check the config, credentials, API, cache and history, print the results and exit")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the effective config as JSON and exit without reading stdin")
+	fs.BoolVar(&opts.ExitStatus, "exit-status", false, "exit with 0/10/20/30 for green/yellow/orange/red usage")
+	fs.BoolVar(&opts.Verbose, "verbose", false, "print debug logs (cache decisions, API requests, timings) to stderr")
+	fs.BoolVar(&opts.Verbose, "v", false, "shorthand for --verbose")
+	fs.BoolVar(&opts.Quiet, "quiet", false, "suppress warnings on stderr (fatal errors, -v logs, --timings and --dry-run output are still printed)")
+	fs.BoolVar(&opts.Quiet, "q", false, "shorthand for --quiet")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "print whether the cache would be used or the API fetched, without fetching")
+	fs.BoolVar(&opts.Offline, "offline", false, "never call the API; render from the cache even if stale (also enabled by "+offlineEnv+"=1)")
+	fs.BoolVar(&opts.AllowEmpty, "allow-empty-input", false, "render with an empty input and print a hint instead of failing when stdin is empty")
+	fs.BoolVar(&opts.Compact, "compact", false, "use short labels and narrower bars for narrow terminals")
+	fs.BoolVar(&opts.Version, "version", false, "print version information and exit")
+	fs.BoolVar(&opts.Version, "V", false, "shorthand for --version")
+	fs.StringVar(&opts.Profile, "profile", "", "use the config, cache and credentials under profiles/NAME (overrides "+profileEnv+")")
+	fs.StringVar(&opts.CacheFile, "cache-file", "", "read and write the cache at PATH instead of the profile's cache.json (skips the legacy cache migration)")
+	fs.StringVar(&opts.Output, "output", "", "output format: text, json, powerline or tmux (overrides output_format)")
+	show := fs.String("show", "", "comma-separated parts to show, overriding the show_* settings (e.g. tokens,5h,week)")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
 	}
-	if cfg.ShowModel {
-		modelStr := input.Model.DisplayName
-		if cfg.ShowEffort && input.Effort != nil && input.Effort.Level != "" {
-			modelStr = fmt.Sprintf("%s - %s", modelStr, input.Effort.Level)
-		}
-		parts = append(parts, fmt.Sprintf("Model: %s", modelStr))
+	opts.Show = parseShowList(*show)
+	if err := defaultConfig().applyShowList(opts.Show); err != nil {
+		err = fmt.Errorf("invalid value %q for flag -show: %w", *show, err)
+		fmt.Fprintln(output, err)
+		return nil, err
 	}
-	if cfg.ShowThinking && input.Thinking != nil && input.Thinking.Enabled {
-		parts = append(parts, "thinking")
+	if opts.Profile == "" {
+		opts.Profile = os.Getenv(profileEnv)
 	}
-	if cfg.ShowOutputStyle && input.OutputStyle != nil && input.OutputStyle.Name != "" {
-		parts = append(parts, fmt.Sprintf("style: %s", input.OutputStyle.Name))
+	if !opts.Offline {
+		opts.Offline, _ = strconv.ParseBool(os.Getenv(offlineEnv))
 	}
-	if cfg.ShowTokens {
-		parts = append(parts, fmt.Sprintf("Total Tokens: %s", totalTokensStr))
+	if opts.Profile != "" && !validProfileName(opts.Profile) {
+		err := fmt.Errorf("invalid profile name %q: must be a directory name", opts.Profile)
+		fmt.Fprintln(output, err)
+		return nil, err
 	}
-	if cfg.ShowContextUsage {
-		ctxPct := 0.0
-		if input.ContextWindow.UsedPercentage != nil {
-			ctxPct = *input.ContextWindow.UsedPercentage
-		}
-		parts = append(parts, fmt.Sprintf("ctx: %s", colorizeUsageWithWidth(ctxPct, cfg.BarWidth)))
+	switch opts.Output {
+	case "", outputFormatText, outputFormatJSON, outputFormatPowerline, outputFormatTmux:
+	default:
+		err := fmt.Errorf("invalid value %q for flag -output: must be text, json, powerline or tmux", opts.Output)
+		fmt.Fprintln(output, err)
+		return nil, err
 	}
-	if cfg.Show5hUsage {
-		parts = append(parts, fmt.Sprintf("5h: %s", fiveHourUsage))
+	return opts, nil
+}
+
+// ビルド時に -ldflags "-X main.version=... -X main.buildDate=... -X main.commit=..." で埋め込む
+var (
+	version   = "dev"
+	buildDate = "unknown"
+	commit    = ""
+)
+
+// versionInfo は --version で出力するバージョン情報を返す
+// コミットは埋め込まれている場合のみ出力する
+func versionInfo() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s\n", appName, version)
+	if commit != "" {
+		fmt.Fprintf(&b, "  commit: %s\n", commit)
 	}
-	if cfg.Show5hResets {
-		if resetTime != "" {
-			parts = append(parts, fmt.Sprintf("resets: %s", resetTime))
-		} else {
-			parts = append(parts, "resets: N/A")
+	fmt.Fprintf(&b, "  built:  %s\n", buildDate)
+	fmt.Fprintf(&b, "  go:     %s\n", runtime.Version())
+	return b.String()
+}
+
+// statusLineOptions はオプションに対応する StatusLine の設定を返す
+func (o *Options) statusLineOptions() []StatusLineOption {
+	return []StatusLineOption{
+		WithTimings(o.Timings),
+		WithForceRefresh(o.Refresh),
+		WithOutputFormat(o.Output),
+		WithShowList(o.Show),
+		WithCompact(o.Compact),
+		WithDryRun(o.DryRun),
+		WithOffline(o.Offline),
+		WithAllowEmptyInput(o.AllowEmpty),
+		WithVerbosity(o.verbosity()),
+		WithProfile(o.Profile),
+		WithQuiet(o.Quiet),
+	}
+}
+
+// verbosity は stderr に出力する最低のログレベルを返す（-v は LOG_LEVEL より優先）
+func (o *Options) verbosity() string {
+	if o.Verbose {
+		return logLevelDebug
+	}
+	return verbosityFromEnv()
+}
+
+func main() {
+	// 出力を受け取るステータスバーが先にパイプを閉じても SIGPIPE で異常終了しない
+	// （書き込みは EPIPE エラーとなり、runWithConfig で無視される）
+	signal.Ignore(syscall.SIGPIPE)
+
+	opts, err := parseArgs(os.Args[1:], os.Stderr)
+	if err != nil {
+		os.Exit(2)
+	}
+	if opts.Version {
+		fmt.Print(versionInfo())
+		return
+	}
+
+	sl := NewStatusLine(opts.statusLineOptions()...)
+	if opts.PrintConfig {
+		if err := sl.printConfig(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
 		}
+		return
 	}
-	if cfg.ShowWeekUsage {
-		parts = append(parts, fmt.Sprintf("week: %s", weeklyUsage))
+	if opts.Doctor {
+		if err := sl.doctor(os.Stdout, opts.CacheFile); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return
 	}
-	if cfg.ShowWeekResets {
-		if weeklyResetTime != "" {
-			parts = append(parts, fmt.Sprintf("resets: %s", weeklyResetTime))
-		} else {
-			parts = append(parts, "resets: N/A")
+	if opts.Prefetch {
+		if err := sl.prefetch(opts.CacheFile); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
 		}
+		return
 	}
-	if cfg.ShowCost && input.Cost != nil {
-		parts = append(parts, fmt.Sprintf("cost: $%.4f", input.Cost.TotalCostUSD))
+	if err := sl.run(os.Stdin, os.Stdout, opts.CacheFile); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if opts.ExitStatus {
+		os.Exit(exitCodeFor(sl.severity))
+	}
+}
+
+// run はメインロジックを実行（テスト可能）
+// cacheFileが空の場合はデフォルトパスを使用
+func (sl *StatusLine) run(stdin io.Reader, stdout io.Writer, cacheFile string) error {
+	// 設定ファイルを読み込む
+	start := sl.now()
+	cfg, err := sl.loadConfig()
+	sl.recordTiming(phaseConfig, start)
+	if err != nil {
+		sl.warnf("failed to load config: %v", err)
+		cfg = defaultConfig()
+	}
+	sl.cfg = cfg
+	applyEnvOverrides(cfg)
+	for _, warning := range cfg.validate() {
+		sl.warnf("%s", warning)
 	}
 
-	// 出力
-	fmt.Fprintf(stdout, "%s\n", strings.Join(parts, " | "))
+	if sl.outputFormat != "" {
+		cfg.OutputFormat = sl.outputFormat
+	}
+	if sl.compact {
+		cfg.Compact = true
+	}
+	if err := cfg.applyShowList(sl.showList); err != nil {
+		sl.warnf("%v", err)
+	}
+	if sl.colorDisabledForOutput(stdout, cfg) {
+		cfg.NoColor = true
+	}
 
-	return nil
+	err = sl.runWithConfig(stdin, stdout, cacheFile, cfg)
+	sl.printTimings()
+	return err
 }
 
-// unixToISO8601 は Unix エポック秒を ISO8601 (RFC3339) 文字列に変換する
-// 0 の場合は空文字列を返す
-func unixToISO8601(epoch int64) string {
-	if epoch == 0 {
-		return ""
+// printConfig はデフォルト値・設定ファイル・環境変数をマージした有効な設定を、
+// 設定ファイルのパスとともに JSON で出力する（標準入力は読まない）
+func (sl *StatusLine) printConfig(stdout io.Writer) error {
+	cfg, err := sl.loadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	applyEnvOverrides(cfg)
+	for _, warning := range cfg.validate() {
+		sl.warnf("%s", warning)
 	}
-	return time.Unix(epoch, 0).UTC().Format(time.RFC3339)
-}
 
-// formatTokens はトークン数をフォーマット（1000以上は"k"単位）
-func formatTokens(tokens int64) string {
-	if tokens >= 1000 {
-		return fmt.Sprintf("%.1fk", float64(tokens)/1000.0)
+	data, err := json.MarshalIndent(struct {
+		ConfigPath string  `json:"config_path"`
+		Config     *Config `json:"config"`
+	}{profileConfigFilePath(sl.profile), cfg}, "", "  ")
+	if err != nil {
+		return err
 	}
-	return fmt.Sprintf("%d", tokens)
+	_, err = fmt.Fprintf(stdout, "%s\n", data)
+	return err
 }
 
-// colorizeUsageWithWidth は指定された幅で使用率を色付けしたプログレスバーを返す
-// 下方向部分ブロック文字(▁▂▃▅▆▇)で6段階の小数部を表現
-func colorizeUsageWithWidth(usage float64, width int) string {
-	var color string
-	switch {
-	case usage < usageThresholdYellow:
-		color = colorGreen
-	case usage < usageThresholdOrange:
-		color = colorYellow
-	case usage < usageThresholdRed:
-		color = colorOrange
-	default:
-		color = colorRed
-	}
+// doctorCheck は --doctor の1つの診断結果
+type doctorCheck struct {
+	name   string // 診断の名前
+	ok     bool   // 成功したか
+	detail string // 結果の詳細
+	hint   string // 失敗した場合の対処方法
+}
 
-	// バーの塗りつぶし文字数を計算
-	totalBlocks := usage / 100.0 * float64(width)
+// doctor は設定ファイル・認証情報・API・キャッシュ・履歴を順に診断し、1行ずつ結果を出力する（標準入力は読まない）
+// API への疎通確認ではキャッシュを書き換えない。失敗した診断があればエラーを返す
+// cacheFileが空の場合はデフォルトパスを使用
+func (sl *StatusLine) doctor(stdout io.Writer, cacheFile string) error {
+	var checks []doctorCheck
 
-	// 負の値は0にクリップ
-	if totalBlocks < 0 {
-		totalBlocks = 0
+	configPath := profileConfigFilePath(sl.profile)
+	cfg, err := sl.loadConfig()
+	if err != nil {
+		checks = append(checks, doctorCheck{"config", false, fmt.Sprintf("%s: %v", configPath, err),
+			"fix the JSON syntax or remove the file to recreate the defaults"})
+		cfg = defaultConfig()
 	}
-
-	filled := int(totalBlocks)
-	if filled > width {
-		filled = width
+	applyEnvOverrides(cfg)
+	// 不正な値はデフォルトで動作するが、設定の誤りとして報告する
+	warnings := cfg.validate()
+	for _, warning := range warnings {
+		checks = append(checks, doctorCheck{"config", false, warning,
+			fmt.Sprintf("fix the value in %s or the environment (the default is used until then)", configPath)})
+	}
+	if err == nil && len(warnings) == 0 {
+		checks = append(checks, doctorCheck{"config", true, configPath, ""})
 	}
+	sl.cfg = cfg
 
-	// 小数部分から下方向部分ブロック文字を選択
-	var shade string
-	shadeWidth := 0
-	if filled < width {
-		fraction := totalBlocks - float64(filled)
-		switch {
-		case fraction >= shadeThreshold5:
-			shade = "▇"
-			shadeWidth = 1
-		case fraction >= shadeThreshold4:
-			shade = "▆"
-			shadeWidth = 1
-		case fraction >= shadeThreshold3:
-			shade = "▅"
-			shadeWidth = 1
-		case fraction >= shadeThreshold2:
-			shade = "▃"
-			shadeWidth = 1
-		case fraction >= shadeThreshold1:
-			shade = "▂"
-			shadeWidth = 1
-		case fraction > 0:
-			shade = "▁"
-			shadeWidth = 1
-		}
+	token, err := sl.accessTokenWithin(sl.keychainTimeout)
+	switch {
+	case err != nil:
+		checks = append(checks, doctorCheck{"credentials", false, err.Error(),
+			"log in to Claude Code (/login), set credentials_path, or set " + apiKeyEnv + "; on macOS, allow the Keychain prompt for security"})
+	case token == "":
+		checks = append(checks, doctorCheck{"credentials", false, "access token is empty",
+			"log in to Claude Code (/login) again, or set " + apiKeyEnv})
+	case sl.apiKeyAuth.Load():
+		checks = append(checks, doctorCheck{"credentials", true, "API key found in " + apiKeyEnv, ""})
+	default:
+		checks = append(checks, doctorCheck{"credentials", true, "access token found", ""})
 	}
 
-	// バーを構築: 完全ブロック + シェード + 空白
-	empty := width - filled - shadeWidth
-	bar := strings.Repeat("█", filled) + shade + strings.Repeat(" ", empty)
-	return fmt.Sprintf("%s%.1f%% [%s]%s", color, usage, bar, colorReset)
-}
+	checks = append(checks, sl.checkAPI(cfg.endpoint(), token))
 
-// isCacheValid はキャッシュが有効かどうかをチェック
-func (sl *StatusLine) isCacheValid(cache *CacheData) bool {
-	if cache.CachedAt == 0 {
-		return false
+	if cacheFile == "" {
+		cacheFile = profileCacheFilePath(sl.profile)
 	}
-	// キャッシュに有効なデータが含まれているか検証
-	if cache.ResetsAt == "" {
-		return false
+	if err := checkWritable(filepath.Dir(cacheFile)); err != nil {
+		checks = append(checks, doctorCheck{"cache", false, err.Error(),
+			"make the directory writable or point XDG_CONFIG_HOME to a writable directory"})
+	} else {
+		checks = append(checks, doctorCheck{"cache", true, cacheFile, ""})
 	}
 
-	cacheTime := time.Unix(cache.CachedAt, 0)
-	cacheAge := time.Since(cacheTime)
-
-	// 最小インターバル以内なら常に有効（API保護）
-	if cacheAge < minFetchInterval {
-		return true
+	if modTime, err := sl.getHistoryModTime(); err != nil {
+		checks = append(checks, doctorCheck{"history", false, err.Error(),
+			"run Claude Code once, or set CLAUDE_CONFIG_DIR if it uses a different directory"})
+	} else {
+		checks = append(checks, doctorCheck{"history", true, fmt.Sprintf("updated %s ago", sl.now().Sub(modTime).Round(time.Second)), ""})
 	}
 
-	// 最大キャッシュ有効期限を超えていたら無効
-	if cacheAge >= pollInterval {
-		return false
+	failed := 0
+	for _, c := range checks {
+		status := "PASS"
+		if !c.ok {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Fprintf(stdout, "%s %-11s %s\n", status, c.name, redact(c.detail, token))
+		if !c.ok {
+			fmt.Fprintf(stdout, "     hint: %s\n", c.hint)
+		}
 	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
 
-	// history.jsonl がキャッシュより新しければ無効
-	historyModTime, err := sl.getHistoryModTime()
-	if err == nil && historyModTime.After(cacheTime) {
-		return false
+// accessTokenWithin はアクセストークンを取得する
+// Keychain の確認ダイアログ待ちなどで d を超えた場合は待つのをやめてエラーを返す
+func (sl *StatusLine) accessTokenWithin(d time.Duration) (string, error) {
+	type result struct {
+		token string
+		err   error
 	}
+	done := make(chan result, 1)
+	go func() {
+		token, err := sl.getAccessToken()
+		done <- result{token, err}
+	}()
 
-	return true
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.token, r.err
+	case <-timer.C:
+		return "", fmt.Errorf("timed out after %v waiting for the access token", d)
+	}
+}
+
+// checkAPI はアクセストークンで API にアクセスできるか（HTTP 200 が返るか）を確認する
+func (sl *StatusLine) checkAPI(endpoint string, token string) doctorCheck {
+	if token == "" {
+		return doctorCheck{"api", false, "skipped: no access token", "fix the credentials first"}
+	}
+	req, err := sl.newUsageRequest(endpoint, token)
+	if err != nil {
+		return doctorCheck{"api", false, err.Error(), "check api_endpoint and api_query in the config"}
+	}
+	resp, err := sl.httpClient.Do(req)
+	if err != nil {
+		return doctorCheck{"api", false, err.Error(), "check the network connection and proxy_url"}
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return doctorCheck{"api", true, fmt.Sprintf("%s returned %d", req.URL.Host, resp.StatusCode), ""}
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return doctorCheck{"api", false, statusWithBody(resp, token),
+			"the token was rejected; log in to Claude Code (/login) again"}
+	default:
+		return doctorCheck{"api", false, statusWithBody(resp, token),
+			"the API may be unavailable; try again later"}
+	}
+}
+
+// checkWritable はディレクトリにファイルを作成できるかを確認する（ディレクトリが無ければ作成する）
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// prefetch は標準入力を読まずに使用状況を取得してキャッシュに書き込む（cron でのキャッシュ更新用）
+// 最小取得間隔内のキャッシュがある場合は取得しない（--refresh 指定時を除く）
+// オフラインモードでは何もせず、Retry-After 期間の確認と取得ロックは表示時の取得と同じ
+// cacheFileが空の場合はデフォルトパスを使用
+func (sl *StatusLine) prefetch(cacheFile string) error {
+	cfg, err := sl.loadConfig()
+	if err != nil {
+		sl.warnf("failed to load config: %v", err)
+		cfg = defaultConfig()
+	}
+	sl.cfg = cfg
+	applyEnvOverrides(cfg)
+	for _, warning := range cfg.validate() {
+		sl.warnf("%s", warning)
+	}
+
+	if cacheFile == "" {
+		cacheFile = sl.defaultCacheFile()
+	}
+
+	if sl.offline {
+		sl.info("offline, skipping prefetch", map[string]any{"cache_file": cacheFile})
+		return nil
+	}
+
+	readModTime := fileModTime(cacheFile)
+	cache, err := readCache(cacheFile)
+	if err == nil && !sl.forceRefresh && cache.ResetsAt != "" &&
+		sl.now().Sub(time.Unix(cache.CachedAt, 0)) < cfg.minFetchInterval() {
+		return nil
+	}
+
+	if _, err := sl.fetchGuarded(cacheFile, cfg.endpoint(), cache, err, readModTime); err != nil {
+		return fmt.Errorf("failed to fetch from API: %w", err)
+	}
+	return nil
+}
+
+// defaultCacheFile はプロファイルのキャッシュファイルのパスを返す
+// プロファイルを指定していない場合のみ、旧キャッシュファイルが残っていれば移行する
+func (sl *StatusLine) defaultCacheFile() string {
+	cacheFile := profileCacheFilePath(sl.profile)
+	if profileDir(sl.profile) != getConfigDir() {
+		return cacheFile
+	}
+	if err := migrateLegacyCache(getLegacyCacheFilePath(), cacheFile); err != nil {
+		sl.warnf("failed to migrate cache: %v", err)
+	}
+	return cacheFile
+}
+
+// applyEnvOverrides は環境変数による設定の上書きを適用する
+// NO_COLOR が空でない値で設定されている場合はカラー出力を無効化する（https://no-color.org/）
+// ANTHROPIC_USAGE_ENDPOINT が設定されている場合は API エンドポイントを上書きする
+func applyEnvOverrides(cfg *Config) {
+	if os.Getenv("NO_COLOR") != "" {
+		cfg.NoColor = true
+	}
+	if endpoint := os.Getenv("ANTHROPIC_USAGE_ENDPOINT"); endpoint != "" {
+		cfg.APIEndpoint = endpoint
+	}
+}
+
+// isTerminal は w が端末（キャラクタデバイス）に接続されているかを判定する
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// colorDisabledForOutput は出力先が端末でないためカラーを無効化すべきかを判定する
+// Claude Code はパイプ経由で出力を受け取りカラーを描画するため、CLAUDECODE 環境変数がある場合は判定しない
+// tmux 形式は tmux が色を描画するため判定しない
+func (sl *StatusLine) colorDisabledForOutput(stdout io.Writer, cfg *Config) bool {
+	if cfg.ForceColor || cfg.OutputFormat == outputFormatTmux || os.Getenv("CLAUDECODE") != "" {
+		return false
+	}
+	return !sl.isTerminal(stdout)
+}
+
+// 使用状況データの取得状態
+const (
+	healthOK     = iota // 取得成功または有効なキャッシュ
+	healthStale         // 取得に失敗し期限切れキャッシュを表示中
+	healthFailed        // トークンなし、または API 取得に失敗
+)
+
+// healthDot は取得状態を色付きのドットで表す
+// noColor の場合は色の代わりに記号で状態を表す（ascii の場合は "*"、"~"、"x"）
+func healthDot(health int, noColor bool, ascii bool) string {
+	if ascii {
+		symbol := "*"
+		switch health {
+		case healthStale:
+			symbol = "~"
+		case healthFailed:
+			symbol = "x"
+		}
+		if noColor {
+			return symbol
+		}
+		return healthColor(health) + symbol + colorReset
+	}
+	if noColor {
+		switch health {
+		case healthStale:
+			return "◐"
+		case healthFailed:
+			return "○"
+		}
+		return "●"
+	}
+
+	return healthColor(health) + "●" + colorReset
+}
+
+// healthColor は取得状態に対応する色を返す
+func healthColor(health int) string {
+	switch health {
+	case healthStale:
+		return colorYellow
+	case healthFailed:
+		return colorRed
+	}
+	return colorGreen
+}
+
+// 計測対象の処理フェーズ
+const (
+	phaseConfig    = "config"
+	phaseToken     = "token"
+	phaseCacheRead = "cache_read"
+	phaseAPIFetch  = "api_fetch"
+	phaseRender    = "render"
+)
+
+// timingPhases は計測結果を出力する順序
+var timingPhases = []string{phaseConfig, phaseToken, phaseCacheRead, phaseAPIFetch, phaseRender}
+
+// recordTiming は start からの経過時間をフェーズの所要時間に加算する
+// 計測が無効な場合はデバッグログへの記録のみ行う
+func (sl *StatusLine) recordTiming(phase string, start time.Time) {
+	elapsed := sl.now().Sub(start)
+	sl.debug("phase finished", map[string]any{"phase": phase, "elapsed": elapsed})
+	if sl.timings == nil {
+		return
+	}
+	sl.timingMu.Lock()
+	sl.timings[phase] += elapsed
+	sl.timingMu.Unlock()
+}
+
+// printTimings は計測結果を stderr に出力する
+// 実行されなかったフェーズは 0s として出力する
+func (sl *StatusLine) printTimings() {
+	if sl.timings == nil {
+		return
+	}
+	sl.timingMu.Lock()
+	defer sl.timingMu.Unlock()
+	for _, phase := range timingPhases {
+		fmt.Fprintf(sl.stderr, "timing: %s %v\n", phase, sl.timings[phase])
+	}
+}
+
+// ログレベル
+const (
+	logLevelDebug = "debug"
+	logLevelInfo  = "info"
+	logLevelWarn  = "warn"
+)
+
+// logLevelRank はログレベルの重要度（大きいほど重要）
+var logLevelRank = map[string]int{
+	logLevelDebug: 0,
+	logLevelInfo:  1,
+	logLevelWarn:  2,
+}
+
+// logEntry は LogFile に出力する1行の JSON ログ
+type logEntry struct {
+	Time    string         `json:"time"`
+	Level   string         `json:"level"`
+	Message string         `json:"message"`
+	Fields  map[string]any `json:"fields,omitempty"`
+}
+
+// warnf は警告を stderr に出力し、LogFile が設定されていれば JSON ログにも記録する
+func (sl *StatusLine) warnf(format string, args ...any) {
+	sl.log(logLevelWarn, fmt.Sprintf(format, args...), nil)
+}
+
+// info は動作の概要を記録する（stderr には -v または LOG_LEVEL=info 以下の場合のみ出力）
+func (sl *StatusLine) info(msg string, fields map[string]any) {
+	sl.log(logLevelInfo, msg, fields)
+}
+
+// debug はデバッグ情報を記録する（stderr には -v または LOG_LEVEL=debug の場合のみ出力）
+func (sl *StatusLine) debug(msg string, fields map[string]any) {
+	sl.log(logLevelDebug, msg, fields)
+}
+
+// log は verbosity 以上のメッセージを stderr に出力し、LogFile にも記録する
+// quiet の場合は警告だけ stderr に出力しない
+// API リクエストに使ったアクセストークンはメッセージと fields から伏せる
+// stderr には "warning: メッセージ" のように1行で出力し、fields は key=value の形で名前順に続ける
+func (sl *StatusLine) log(level, msg string, fields map[string]any) {
+	if token := sl.token.Load(); token != nil {
+		msg = redact(msg, *token)
+		redacted := make(map[string]any, len(fields))
+		for key, value := range fields {
+			if text := fmt.Sprint(value); strings.Contains(text, *token) {
+				value = redact(text, *token)
+			}
+			redacted[key] = value
+		}
+		fields = redacted
+	}
+	if logLevelRank[level] >= logLevelRank[sl.verbosity] && !(sl.quiet && level == logLevelWarn) {
+		prefix := level
+		if level == logLevelWarn {
+			prefix = "warning"
+		}
+		keys := make([]string, 0, len(fields))
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s: %s", prefix, msg)
+		for _, key := range keys {
+			fmt.Fprintf(&b, " %s=%v", key, fields[key])
+		}
+		sl.logMu.Lock()
+		fmt.Fprintln(sl.stderr, b.String())
+		sl.logMu.Unlock()
+	}
+	sl.writeLog(level, msg, fields)
+}
+
+// verbosityFromEnv は LOG_LEVEL 環境変数に対応する stderr のログレベルを返す
+// 未設定または不明な値の場合は警告のみ（logLevelWarn）
+func verbosityFromEnv() string {
+	level := strings.ToLower(os.Getenv("LOG_LEVEL"))
+	if _, ok := logLevelRank[level]; ok {
+		return level
+	}
+	return logLevelWarn
+}
+
+// writeLog は LogLevel 以上のメッセージを LogFile に JSON 1行で追記する
+// ログの書き込みに失敗しても本来の処理は継続する
+func (sl *StatusLine) writeLog(level, msg string, fields map[string]any) {
+	cfg := sl.cfg
+	if cfg == nil || cfg.LogFile == "" || logLevelRank[level] < logLevelRank[cfg.LogLevel] {
+		return
+	}
+	data, err := json.Marshal(logEntry{
+		Time:    sl.now().Format(time.RFC3339),
+		Level:   level,
+		Message: msg,
+		Fields:  fields,
+	})
+	if err != nil {
+		return
+	}
+
+	sl.logMu.Lock()
+	defer sl.logMu.Unlock()
+	file, err := os.OpenFile(cfg.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	file.Write(append(data, '\n'))
+}
+
+// runWithConfig は指定された設定でメインロジックを実行（テスト用）
+func (sl *StatusLine) runWithConfig(stdin io.Reader, stdout io.Writer, cacheFile string, cfg *Config) error {
+	// 標準入力からJSONを読み込む
+	var input InputData
+	if err := json.NewDecoder(stdin).Decode(&input); errors.Is(err, io.EOF) && sl.allowEmptyInput {
+		// 手動で実行した場合など、入力が無ければモデル不明のまま表示する
+		sl.warnf("no input on stdin; %s expects the status line JSON from Claude Code", appName)
+	} else if err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	}
+	sl.cfg = cfg
+	sl.model = input.Model.DisplayName
+
+	// 表示後も続くバックグラウンドの取得は終了前に完了を待つ
+	defer sl.waitBackground()
+
+	// 累積トークン数を計算
+	totalTokens := input.ContextWindow.TotalInputTokens + input.ContextWindow.TotalOutputTokens
+	totalTokensStr := formatTokensWithUnit(totalTokens, cfg.TokenUnit, cfg.TokenSeparator)
+
+	// 使用率データを取得
+	// stdin に rate_limits がある場合はそれを優先し、ない場合は API にフォールバック
+	var cache *CacheData
+	health := healthOK
+	fetching := false // 初回の取得をバックグラウンドで実行中か
+
+	if input.RateLimits != nil && input.RateLimits.FiveHour != nil {
+		// stdin から直接取得
+		cache = &CacheData{
+			Utilization: input.RateLimits.FiveHour.UsedPercentage,
+			ResetsAt:    unixToISO8601(input.RateLimits.FiveHour.ResetsAt),
+		}
+		cache.Windows = map[string]UsageWindow{
+			windowFiveHour: {ResetsAt: cache.ResetsAt, Utilization: cache.Utilization},
+		}
+		if input.RateLimits.SevenDay != nil {
+			cache.WeeklyUtilization = input.RateLimits.SevenDay.UsedPercentage
+			cache.WeeklyResetsAt = unixToISO8601(input.RateLimits.SevenDay.ResetsAt)
+			cache.Windows[windowSevenDay] = UsageWindow{ResetsAt: cache.WeeklyResetsAt, Utilization: cache.WeeklyUtilization}
+		}
+	} else {
+		// キャッシュファイルのパスを取得（dry-run では旧キャッシュの移行もしない）
+		if cacheFile == "" && sl.dryRun {
+			cacheFile = profileCacheFilePath(sl.profile)
+		} else if cacheFile == "" {
+			cacheFile = sl.defaultCacheFile()
+		}
+
+		sl.warnStaleHistory(stateFilePath(cacheFile), cfg.WarnStaleHistoryHours)
+
+		// キャッシュの有効性をチェックし、必要に応じて取得
+		var err error
+		if sl.dryRun {
+			cache = sl.dryRunCache(cacheFile)
+		} else if cfg.AsyncFirstRender && !sl.forceRefresh && !sl.offline && !fileExists(cacheFile) {
+			// 初回はキャッシュが無いため取得を待たずに表示する
+			// ヘルスドットはキャッシュの経過時間と取得エラーだけで決めるため、取得中であることは反映しない
+			sl.fetchInBackground(cacheFile, cfg.endpoint())
+			cache = &CacheData{}
+			fetching = true
+		} else {
+			cache, err = sl.getCachedOrFetch(cacheFile, cfg.endpoint())
+		}
+		if err != nil {
+			// デフォルト値で継続
+			cache = &CacheData{Utilization: 0.0}
+			health = healthFailed
+		} else if cache.Stale {
+			health = healthStale
+		}
+	}
+
+	// リセット時刻をフォーマット
+	renderStart := sl.now()
+	defer sl.recordTiming(phaseRender, renderStart)
+	loc := cfg.location()
+	layout, weeklyLayout, rounding := cfg.resetTimeFormat()
+	resetTime := sl.formatReset(cache.ResetsAt, formatResetTimeIn(cache.ResetsAt, layout, loc, rounding), cfg)
+	weeklyResetTime := sl.formatReset(cache.WeeklyResetsAt, formatResetTimeIn(cache.WeeklyResetsAt, weeklyLayout, loc, rounding), cfg)
+
+	// 使用率をフォーマット（色付き、設定されたバー幅で）
+	style := cfg.barStyle()
+	fiveHourStyle := style.withPrecision(cfg.FiveHourPrecision)
+	fiveHourStyle.bandTicks = cfg.ShowBandTicks
+	fiveHourStyle.remaining = cfg.ShowRemaining
+	fiveHourUsage := colorizeUsageWithStyle(cache.Utilization, fiveHourStyle)
+	weeklyStyle := style.withPrecision(cfg.WeeklyPrecision)
+	weeklyStyle.thresholds = cfg.weeklyThresholds()
+	weeklyStyle.remaining = cfg.ShowRemaining
+	weeklyUsage := colorizeUsageWithStyle(cache.WeeklyUtilization, weeklyStyle)
+	if cfg.ShowUsageDelta && cache.PrevUtilization != nil {
+		delta := cache.Utilization - *cache.PrevUtilization
+		if cfg.ShowRemaining {
+			delta = -delta
+		}
+		fiveHourUsage += fmt.Sprintf(" (%+.1f)", delta)
+	}
+	if fetching {
+		fiveHourUsage, weeklyUsage = fetchingText, fetchingText
+	}
+	if cache.Stale && cfg.StaleText != "" {
+		staleText := " " + staleTextWithAge(cfg.StaleText, sl.now().Sub(time.Unix(cache.CachedAt, 0)))
+		fiveHourUsage += staleText
+		weeklyUsage += staleText
+	}
+
+	// 異常値の警告（複数の枠が範囲外でも1行にまとめる）
+	// バーは常に 0-100% にクリップされる
+	if !cfg.ClampSilently {
+		var anomalies []string
+		if cache.Utilization < 0 || cache.Utilization > 100 {
+			anomalies = append(anomalies, fmt.Sprintf("5h=%.1f", cache.Utilization))
+		}
+		if cache.WeeklyUtilization < 0 || cache.WeeklyUtilization > 100 {
+			anomalies = append(anomalies, fmt.Sprintf("week=%.1f", cache.WeeklyUtilization))
+		}
+		if len(anomalies) > 0 {
+			sl.warnf("unexpected usage value: %s", strings.Join(anomalies, ", "))
+		}
+	}
+
+	// ステータスラインを動的に構築
+	var parts []segment
+	labels := cfg.labels()
+
+	if cfg.ShowHealthDot {
+		parts = append(parts, segment{key: segHealth, text: healthDot(health, cfg.NoColor, cfg.ASCIIOnly)})
+	}
+	if cfg.ShowAppName {
+		parts = append(parts, segment{key: segApp, text: cfg.labelOr(segApp, appName)})
+	}
+	// reasoning effort はモデル名の末尾に付与し、モデル名を表示しない場合（--show effort など）は単独で表示する
+	hasEffort := cfg.ShowEffort && input.Effort != nil && input.Effort.Level != ""
+	if cfg.ShowModel {
+		modelStr := input.Model.DisplayName
+		if hasEffort {
+			modelStr = fmt.Sprintf("%s - %s", modelStr, input.Effort.Level)
+		}
+		parts = append(parts, segment{key: segModel, text: cfg.labeled(segModel, labels.model, modelStr)})
+	} else if hasEffort {
+		parts = append(parts, segment{key: segEffort, text: fmt.Sprintf("effort: %s", input.Effort.Level)})
+	}
+	if cfg.ShowAccount && cache.Account != "" {
+		parts = append(parts, segment{key: segAccount, text: fmt.Sprintf("acct: %s", cache.Account)})
+	}
+	if name := input.cwdName(); cfg.ShowCwd && name != "" {
+		parts = append(parts, segment{key: segCwd, text: fmt.Sprintf("cwd: %s", name)})
+	}
+	if dir := firstNonEmpty(input.Cwd, input.Workspace.CurrentDir); cfg.ShowGitBranch && dir != "" {
+		branch, err := sl.gitBranch(dir)
+		if err != nil {
+			sl.debug("failed to read git branch", map[string]any{"dir": dir, "error": err})
+		} else if branch != "" {
+			parts = append(parts, segment{key: segGitBranch, text: fmt.Sprintf("branch: %s", branch)})
+		}
+	}
+	if id := input.shortSessionID(); cfg.ShowSession && id != "" {
+		parts = append(parts, segment{key: segSession, text: fmt.Sprintf("session: %s", id)})
+	}
+	if cfg.ShowThinking && input.Thinking != nil && input.Thinking.Enabled {
+		parts = append(parts, segment{key: segThinking, text: "thinking"})
+	}
+	if cfg.ShowOutputStyle && input.OutputStyle != nil && input.OutputStyle.Name != "" {
+		parts = append(parts, segment{key: segStyle, text: fmt.Sprintf("style: %s", input.OutputStyle.Name)})
+	}
+	if cfg.ShowTokens {
+		parts = append(parts, segment{key: segTokens, text: cfg.labeled(segTokens, labels.tokens, totalTokensStr)})
+	}
+	if cfg.ShowContextUsage {
+		ctxPct := 0.0
+		if input.ContextWindow.UsedPercentage != nil {
+			ctxPct = *input.ContextWindow.UsedPercentage
+		}
+		parts = append(parts, segment{key: segContext, text: fmt.Sprintf("ctx: %s", colorizeUsageWithStyle(ctxPct, style)), usage: true, level: style.levelFor(ctxPct)})
+	}
+	if cfg.ShowContextPct {
+		limit := contextLimit(input.Model.DisplayName, cfg.ContextLimits)
+		pct := float64(totalTokens) / float64(limit) * 100
+		parts = append(parts, segment{key: segContextPct, text: fmt.Sprintf("limit: %s", colorizeUsageWithStyle(pct, style)), usage: true, level: style.levelFor(pct)})
+	}
+	// データが無い要素は hide_empty_segments の場合に省略する（取得中の表示は残す）
+	hasFiveHour := cache.ResetsAt != "" || fetching
+	hasWeekly := cache.WeeklyResetsAt != "" || fetching
+	if cfg.Show5hUsage && (hasFiveHour || !cfg.HideEmptySegments) {
+		parts = append(parts, segment{key: seg5h, text: cfg.labeled(seg5h, "5h", fiveHourUsage), usage: true, level: fiveHourStyle.levelFor(cache.Utilization)})
+	}
+	if cfg.ShowBurnRate {
+		if text, ok := sl.burnRateText(cache, cfg.ResetNowText); ok {
+			parts = append(parts, segment{key: segBurnRate, text: text})
+		}
+	}
+	if cfg.ShowSparkline && len(cache.Samples) > 0 {
+		// キャッシュには cache_max_samples 件まで保存し、表示時に直近の sparkline_samples 件に絞る
+		samples := cache.Samples
+		if n := cfg.SparklineSamples; n > 0 && len(samples) > n {
+			samples = samples[len(samples)-n:]
+		}
+		parts = append(parts, segment{key: segSparkline, text: renderSparkline(samples, cfg.SparklineWidth, cfg.ASCIIOnly)})
+	}
+	if cfg.Show5hResets && (resetTime != "" || !cfg.HideEmptySegments) {
+		parts = append(parts, segment{key: seg5hResets, text: resetSegmentText(seg5hResets, labels.resets, resetTime, cfg)})
+	}
+	if cfg.ShowWeekUsage && (hasWeekly || !cfg.HideEmptySegments) {
+		parts = append(parts, segment{key: segWeek, text: cfg.labeled(segWeek, labels.week, weeklyUsage), usage: true, level: weeklyStyle.levelFor(cache.WeeklyUtilization)})
+	}
+	if cfg.ShowWeekResets && (weeklyResetTime != "" || !cfg.HideEmptySegments) && !sl.weekResetTooFar(cache.WeeklyResetsAt, cfg.HideWeekResetBeyondHours) {
+		parts = append(parts, segment{key: segWeekResets, text: resetSegmentText(segWeekResets, labels.resets, weeklyResetTime, cfg)})
+	}
+	if cfg.ShowSoonestResetCountdown {
+		if name, d, ok := sl.soonestReset(cache, labels); ok {
+			parts = append(parts, segment{key: segNextReset, text: fmt.Sprintf("next limit in %s (%s)", formatRemaining(d, cfg.ResetNowText), name)})
+		}
+	}
+	for _, key := range cfg.Windows {
+		window, ok := cache.Windows[key]
+		if !ok {
+			sl.warnf("unknown usage window: %s", key)
+			continue
+		}
+		parts = append(parts, segment{key: key, text: fmt.Sprintf("%s: %s", key, colorizeUsageWithStyle(window.Utilization, style)), usage: true, level: style.levelFor(window.Utilization)})
+	}
+	if cfg.ShowCost && input.Cost != nil {
+		parts = append(parts, segment{key: segCost, text: fmt.Sprintf("cost: $%.4f", input.Cost.TotalCostUSD)})
+	}
+	if len(cfg.AggregateProfiles) > 0 {
+		if usage, top, ok := aggregateUsage(cfg.AggregateProfiles, cfg.AggregateMode, sl.now(), cfg.cacheTTL()); ok {
+			parts = append(parts, segment{key: segAggregate, text: fmt.Sprintf("all: %s (%s)", colorizeUsageWithStyle(usage, style), top), usage: true, level: style.levelFor(usage)})
+		}
+	}
+
+	// --exit-status のため、最も高い使用率の段階を記録する
+	// 5時間と週間は閾値が異なるため、それぞれの段階の高い方を使う（primary_window を指定した場合はその使用枠のみ）
+	switch cfg.PrimaryWindow {
+	case windowFiveHour:
+		sl.severity = fiveHourStyle.levelFor(cache.Utilization)
+	case windowSevenDay:
+		sl.severity = weeklyStyle.levelFor(cache.WeeklyUtilization)
+	default:
+		sl.severity = max(fiveHourStyle.levelFor(cache.Utilization), weeklyStyle.levelFor(cache.WeeklyUtilization))
+	}
+
+	// 通知やアイドル判定など単一の指標を使う機能は主要な使用枠を基準にする
+	primary, primaryLabel := cfg.primaryWindow(cache)
+
+	// 閾値を上方向に通過した場合は通知を出力（JSON や tmux の書式を壊さないよう、これらの形式では出力しない）
+	jsonOutput := cfg.OutputFormat == outputFormatJSON
+	if cfg.NotifyAbove > 0 && !jsonOutput && cfg.OutputFormat != outputFormatTmux {
+		stateFile := cacheFile
+		if stateFile == "" {
+			stateFile = profileCacheFilePath(sl.profile)
+		}
+		if sl.crossedNotifyThreshold(stateFilePath(stateFile), primary.Utilization) {
+			fmt.Fprint(stdout, notificationSequence(cfg.NotifyMethod, primaryLabel, primary.Utilization))
+		}
+	}
+
+	// 出力（ASCII のみの場合は、非 ASCII 文字を除いて空になった要素を区切り文字ごと省く）
+	if cfg.ASCIIOnly {
+		parts = asciiSegments(parts)
+	}
+	line := joinSegments(parts, cfg)
+	if cfg.OutputFormat == outputFormatPowerline {
+		line = renderPowerline(parts, cfg.NoColor)
+	}
+	if cfg.IdleLabel != "" && primary.Utilization == 0 && totalTokens == 0 {
+		// 使用率もトークン数も0のセッションはアイドルとして1つの表示にまとめる
+		line = cfg.IdleLabel
+	}
+	// tmux 形式への変換はアイドル表示の後に行い、利用者が指定した "#" もエスケープする
+	if cfg.OutputFormat == outputFormatTmux {
+		line = ansiToTmux(line)
+	}
+	if cfg.ASCIIOnly {
+		line = toASCII(line)
+	}
+	if jsonOutput {
+		data, err := json.Marshal(newStatusJSON(input.Model.DisplayName, totalTokens, cache, cfg))
+		if err != nil {
+			return fmt.Errorf("failed to encode output: %w", err)
+		}
+		line = string(data)
+	}
+	// 出力先が先に閉じられた場合（パイプの切断）はエラーにしない
+	if _, err := fmt.Fprintf(stdout, "%s\n", line); err != nil && !isBrokenPipe(err) {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+
+	// 描画結果を他のプログラム向けにファイルへ書き出す（dry-run では書き込まない）
+	if cfg.MirrorFile != "" && !sl.dryRun {
+		if err := writeFileAtomic(cfg.MirrorFile, []byte(line+"\n")); err != nil {
+			sl.warnf("failed to write mirror file: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// 出力形式
+const (
+	outputFormatText      = "text"
+	outputFormatJSON      = "json"
+	outputFormatPowerline = "powerline"
+	outputFormatTmux      = "tmux"
+)
+
+// StatusJSON は JSON 出力形式のステータスライン
+// 週間データが無い場合は Weekly を省略し、実際の 0% と区別できるようにする
+type StatusJSON struct {
+	Model       string      `json:"model"`
+	TotalTokens int64       `json:"total_tokens"`
+	FiveHour    *WindowJSON `json:"five_hour,omitempty"`
+	Weekly      *WindowJSON `json:"weekly,omitempty"`
+}
+
+// WindowJSON は JSON 出力形式の1つの使用枠
+type WindowJSON struct {
+	Utilization  float64 `json:"utilization"`
+	ResetsAt     string  `json:"resets_at,omitempty"`      // リセット時刻（RFC3339形式）
+	ResetsAtText string  `json:"resets_at_text,omitempty"` // 表示用にフォーマットしたリセット時刻
+}
+
+// newStatusJSON は描画に使うデータから JSON 出力用の構造体を作成する
+// リセット時刻の文字列はテキスト出力と同じレイアウト・タイムゾーン・丸めでフォーマットする
+func newStatusJSON(model string, totalTokens int64, cache *CacheData, cfg *Config) *StatusJSON {
+	out := &StatusJSON{Model: model, TotalTokens: totalTokens}
+	loc := cfg.location()
+	layout, weeklyLayout, rounding := cfg.resetTimeFormat()
+	if cache.ResetsAt != "" {
+		out.FiveHour = &WindowJSON{
+			Utilization:  cache.Utilization,
+			ResetsAt:     formatRFC3339(cache.ResetsAt),
+			ResetsAtText: formatResetTimeIn(cache.ResetsAt, layout, loc, rounding),
+		}
+	}
+	if cache.WeeklyResetsAt != "" {
+		out.Weekly = &WindowJSON{
+			Utilization:  cache.WeeklyUtilization,
+			ResetsAt:     formatRFC3339(cache.WeeklyResetsAt),
+			ResetsAtText: formatResetTimeIn(cache.WeeklyResetsAt, weeklyLayout, loc, rounding),
+		}
+	}
+	return out
+}
+
+// formatRFC3339 はリセット時刻を UTC の RFC3339 形式に揃える
+func formatRFC3339(resetsAt string) string {
+	t, err := parseResetTime(resetsAt)
+	if err != nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// isBrokenPipe は読み手が既に閉じたパイプへの書き込みエラーかを判定する
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, os.ErrClosed)
+}
+
+// crossedNotifyThreshold は使用率が通知閾値を下から上に通過したかを判定する
+// 前回の状態は状態ファイルに保存し、閾値以上の間は再通知しない（dry-run では保存しない）
+func (sl *StatusLine) crossedNotifyThreshold(stateFile string, usage float64) bool {
+	state := readState(stateFile)
+
+	above := usage >= sl.cfg.NotifyAbove
+	crossed := above && !state.AboveNotify
+
+	if above != state.AboveNotify && !sl.dryRun {
+		state.AboveNotify = above
+		sl.persistState(stateFile, state)
+	}
+
+	return crossed
+}
+
+// notificationSequence は通知方式に応じた端末制御シーケンスを返す
+// label は通知対象の使用枠の表示名（"5h" など）
+func notificationSequence(method string, label string, usage float64) string {
+	if method == notifyMethodOSC9 {
+		return fmt.Sprintf("\033]9;%s: %s usage %.1f%%\a", appName, label, usage)
+	}
+	return "\a"
+}
+
+// unixToISO8601 は Unix エポック秒を ISO8601 (RFC3339) 文字列に変換する
+// 0 の場合は空文字列を返す
+func unixToISO8601(epoch int64) string {
+	if epoch == 0 {
+		return ""
+	}
+	return time.Unix(epoch, 0).UTC().Format(time.RFC3339)
+}
+
+// トークン数の単位
+const (
+	tokenUnitAuto = "auto" // 1000以上は "k"、100万以上は "M"
+	tokenUnitK    = "k"    // 1000以上は "k"
+	tokenUnitRaw  = "raw"  // 単位を付けない
+)
+
+// formatTokens はトークン数をフォーマット（1000以上は"k"単位、100万以上は"M"単位）
+func formatTokens(tokens int64) string {
+	return formatTokensWithUnit(tokens, tokenUnitAuto, "")
+}
+
+// formatTokensWithUnit は指定された単位でトークン数をフォーマットする
+// auto では "k" に丸めると 1000.0k になる値（999950 以上）も "M" で表す
+// 単位を付けない場合は separator で3桁ごとに区切る（空の場合は区切らない）
+func formatTokensWithUnit(tokens int64, unit, separator string) string {
+	if unit == tokenUnitRaw || tokens < 1000 {
+		return groupDigits(tokens, separator)
+	}
+	k := float64(tokens) / 1000.0
+	if unit != tokenUnitK && math.Round(k*10)/10 >= 1000 {
+		return fmt.Sprintf("%.1fM", float64(tokens)/1000000.0)
+	}
+	return fmt.Sprintf("%.1fk", k)
+}
+
+// groupDigits は整数を separator で3桁ごとに区切った文字列を返す（空の場合は区切らない）
+func groupDigits(n int64, separator string) string {
+	digits := strconv.FormatInt(n, 10)
+	sign := ""
+	if n < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	if separator == "" || len(digits) <= 3 {
+		return sign + digits
+	}
+	var b strings.Builder
+	b.WriteString(sign)
+	head := len(digits) % 3
+	if head > 0 {
+		b.WriteString(digits[:head])
+	}
+	for i := head; i < len(digits); i += 3 {
+		if i > 0 {
+			b.WriteString(separator)
+		}
+		b.WriteString(digits[i : i+3])
+	}
+	return b.String()
+}
+
+// barStyle はプログレスバーの描画設定
+type barStyle struct {
+	width     int     // バーの幅（文字数）
+	bandTicks bool    // 色閾値の位置に目盛りを表示
+	ascii     bool    // ASCII文字のみで描画（部分ブロックなし）
+	quantize  int     // 使用率を 1/quantize 単位で表示（0 で無効）
+	precision *int    // 使用率の小数点以下の桁数（nil の場合は defaultUsagePrecision）
+	snapAbove float64 // 使用率がこの値を超えたらバーを満杯で描画（0 で無効）
+	noColor   bool    // ANSI カラーコードを出力しない
+	hideBar   bool    // プログレスバーを描画せず使用率の数値のみ表示
+	labelLast bool    // 使用率の数値をバーの右に表示
+	shades    int     // 部分ブロックの段階数（shadeRamps のキー。0 の場合は defaultShadeSteps）
+	fraction  int     // 使用率をこの値を分母とする分数で表示（0 で無効、quantize が優先）
+	remaining bool    // 数値とバーを残り容量（100 - 使用率）で表示（色は使用率の段階のまま）
+
+	filledChar string // 塗りつぶし部分の文字（空の場合はデフォルト）
+	emptyChar  string // 空き部分の文字（空の場合はデフォルト）
+
+	thresholds colorThresholds // 色の閾値（ゼロ値の場合はデフォルト）
+	colors     bandColors      // 段階ごとの色（空の場合はデフォルト）
+}
+
+// colorThresholds は使用率に応じて色を切り替える閾値（%）
+type colorThresholds struct {
+	yellow, orange, red float64
+}
+
+// defaultColorThresholds はデフォルトの色閾値
+var defaultColorThresholds = colorThresholds{usageThresholdYellow, usageThresholdOrange, usageThresholdRed}
+
+// orDefault はゼロ値の場合にデフォルトの閾値を返す
+func (t colorThresholds) orDefault() colorThresholds {
+	if t == (colorThresholds{}) {
+		return defaultColorThresholds
+	}
+	return t
+}
+
+// severity は使用率の色分けに対応する段階
+type severity int
+
+const (
+	severityGreen severity = iota
+	severityYellow
+	severityOrange
+	severityRed
+)
+
+// severityColors は段階ごとの色
+var severityColors = [...]string{
+	severityGreen:  colorGreen,
+	severityYellow: colorYellow,
+	severityOrange: colorOrange,
+	severityRed:    colorRed,
+}
+
+// valid は閾値が 0 <= yellow < orange < red <= 100 を満たすかどうかを返す
+func (t colorThresholds) valid() bool {
+	return 0 <= t.yellow && t.yellow < t.orange && t.orange < t.red && t.red <= 100
+}
+
+// severityFor は使用率に対応する段階を返す
+func (t colorThresholds) severityFor(usage float64) severity {
+	switch {
+	case usage < t.yellow:
+		return severityGreen
+	case usage < t.orange:
+		return severityYellow
+	case usage < t.red:
+		return severityOrange
+	default:
+		return severityRed
+	}
+}
+
+// colorFor は使用率に対応する色を返す
+func (t colorThresholds) colorFor(usage float64) string {
+	return severityColors[t.severityFor(usage)]
+}
+
+// bandColors は段階ごとに設定された色（ANSI SGR シーケンス）
+type bandColors [len(severityColors)]string
+
+// forSeverity は段階の色を返す（設定されていない場合はデフォルトの色）
+func (c bandColors) forSeverity(s severity) string {
+	if c[s] != "" {
+		return c[s]
+	}
+	return severityColors[s]
+}
+
+// ansiSGRPattern は ANSI SGR シーケンス（例: "\033[38;5;208m"）にマッチする
+var ansiSGRPattern = regexp.MustCompile(`^\x1b\[[0-9;]*m$`)
+
+// exitCodeFor は --exit-status で使う終了コードを返す（緑 0、黄 10、橙 20、赤 30）
+func exitCodeFor(s severity) int {
+	return int(s) * 10
+}
+
+// barStyle は設定からプログレスバーの描画設定を生成する
+func (c *Config) barStyle() barStyle {
+	width := c.BarWidth
+	if c.Compact && width == barWidth {
+		width = compactBarWidth
+	}
+	return barStyle{
+		width:     width,
+		ascii:     c.ASCIIOnly,
+		quantize:  c.QuantizeUsage,
+		precision: c.UsagePrecision,
+		snapAbove: c.SnapToFullAbove,
+		noColor:   c.NoColor,
+		hideBar:   !c.ShowBar,
+		labelLast: c.PercentPosition == percentPositionRight,
+		shades:    c.ShadeSteps,
+		fraction:  c.usageFraction(),
+
+		filledChar: c.BarFilledChar,
+		emptyChar:  c.BarEmptyChar,
+		thresholds: colorThresholds{c.ThresholdYellow, c.ThresholdOrange, c.ThresholdRed},
+		colors:     bandColors{c.ColorGreen, c.ColorYellow, c.ColorOrange, c.ColorRed},
+	}
+}
+
+// usageFraction は分数表示の分母を返す（分数表示しない場合は 0）
+func (c *Config) usageFraction() int {
+	if !c.UsageAsFraction {
+		return 0
+	}
+	if c.UsageFractionScale <= 0 {
+		return defaultUsageFractionScale
+	}
+	return c.UsageFractionScale
+}
+
+// weeklyThresholds は週間の要素に使う色の閾値を返す
+func (c *Config) weeklyThresholds() colorThresholds {
+	return colorThresholds{c.WeeklyThresholdYellow, c.WeeklyThresholdOrange, c.WeeklyThresholdRed}
+}
+
+// cacheTTL はキャッシュの最大有効期限を返す（未設定の場合は pollInterval）
+func (c *Config) cacheTTL() time.Duration {
+	if c.CacheTTLSeconds <= 0 {
+		return pollInterval
+	}
+	return time.Duration(c.CacheTTLSeconds) * time.Second
+}
+
+// minFetchInterval は API へアクセスする最小間隔を返す（未設定の場合は minFetchInterval）
+func (c *Config) minFetchInterval() time.Duration {
+	if c.MinFetchIntervalSeconds <= 0 {
+		return minFetchInterval
+	}
+	return time.Duration(c.MinFetchIntervalSeconds) * time.Second
+}
+
+// levelFor は描画設定の閾値で使用率に対応する段階を返す
+func (s barStyle) levelFor(usage float64) severity {
+	return s.thresholds.orDefault().severityFor(usage)
+}
+
+// withPrecision は override が指定されていれば小数点以下の桁数を上書きした描画設定を返す
+func (s barStyle) withPrecision(override *int) barStyle {
+	if override != nil {
+		s.precision = override
+	}
+	return s
+}
+
+// colorizeUsageWithWidth は指定された幅で使用率を色付けしたプログレスバーを返す
+// 幅0の場合はバーを省略し、負の場合はデフォルトの幅を使う
+func colorizeUsageWithWidth(usage float64, width int) string {
+	return colorizeUsageWithStyle(usage, barStyle{width: width})
+}
+
+// shadeRamps は段階数ごとの部分ブロック文字（小数部の小さい順）
+var shadeRamps = map[int][]string{
+	1: {"▄"},
+	3: {"▂", "▄", "▆"},
+	6: {"▁", "▂", "▃", "▅", "▆", "▇"},
+}
+
+// shadeFor は 0 以上 1 未満の小数部に対応する部分ブロック文字を返す（0 の場合は空文字列）
+// 小数部を steps 等分した区間ごとに1文字を割り当てる。未対応の段階数は defaultShadeSteps として扱う
+func shadeFor(fraction float64, steps int) string {
+	ramp, ok := shadeRamps[steps]
+	if !ok {
+		ramp = shadeRamps[defaultShadeSteps]
+	}
+	if fraction <= 0 {
+		return ""
+	}
+	i := int(fraction * float64(len(ramp)))
+	if i >= len(ramp) {
+		i = len(ramp) - 1
+	}
+	return ramp[i]
+}
+
+// colorizeUsageWithStyle は描画設定に従って使用率を色付けしたプログレスバーを返す
+// 下方向部分ブロック文字(▁▂▃▅▆▇)で小数部を表現（段階数は shade_steps で変更可）
+func colorizeUsageWithStyle(usage float64, style barStyle) string {
+	width := style.width
+	if width < 0 {
+		width = barWidth
+	}
+	filledChar, emptyChar := defaultFilledChar, defaultEmptyChar
+	if style.ascii {
+		filledChar, emptyChar = asciiFilledChar, asciiEmptyChar
+	}
+	if style.filledChar != "" {
+		filledChar = style.filledChar
+	}
+	if style.emptyChar != "" {
+		emptyChar = style.emptyChar
+	}
+	thresholds := style.thresholds.orDefault()
+	color := style.colors.forSeverity(thresholds.severityFor(usage))
+
+	// 残り容量の表示では数値とバーを反転し、色は使用率から決める（残りが多いほど緑）
+	if style.remaining {
+		usage = 100.0 - usage
+		thresholds = colorThresholds{100 - thresholds.red, 100 - thresholds.orange, 100 - thresholds.yellow}
+	}
+
+	// 表示する数値とバーに反映する使用率
+	precision := defaultUsagePrecision
+	if style.precision != nil && *style.precision >= 0 {
+		precision = *style.precision
+	}
+	label := fmt.Sprintf("%.*f%%", precision, usage)
+	barUsage := usage
+	if style.quantize > 0 {
+		steps := quantizeUsage(usage, style.quantize)
+		label = fmt.Sprintf("%d/%d", steps, style.quantize)
+		barUsage = float64(steps) / float64(style.quantize) * 100.0
+	} else if style.fraction > 0 {
+		label = fmt.Sprintf("%.0f/%d", usage/100.0*float64(style.fraction), style.fraction)
+	}
+	// 幅0はバーなし（使用率の数値のみ）
+	if style.hideBar || width == 0 {
+		if style.noColor {
+			return label
+		}
+		return fmt.Sprintf("%s%s%s", color, label, colorReset)
+	}
+
+	// 満杯直前の部分ブロックは「まだ余裕がある」ように見えるため満杯に揃える
+	if style.snapAbove > 0 && usage > style.snapAbove {
+		barUsage = 100.0
+	}
+
+	// バーの塗りつぶし文字数を計算
+	totalBlocks := barUsage / 100.0 * float64(width)
+
+	// 負の値は0にクリップ
+	if totalBlocks < 0 {
+		totalBlocks = 0
+	}
+
+	filled := int(totalBlocks)
+	if filled > width {
+		filled = width
+	}
+
+	// 小数部分から下方向部分ブロック文字を選択
+	// 部分ブロックはブロック文字で塗りつぶす場合のみ意味を持つ
+	var shade string
+	shadeWidth := 0
+	if filled < width && filledChar == defaultFilledChar {
+		if shade = shadeFor(totalBlocks-float64(filled), style.shades); shade != "" {
+			shadeWidth = 1
+		}
+	}
+
+	// バーを構築: 完全ブロック + シェード + 空白
+	cells := make([]string, 0, width)
+	for i := 0; i < filled; i++ {
+		cells = append(cells, filledChar)
+	}
+	if shadeWidth > 0 {
+		cells = append(cells, shade)
+	}
+	for len(cells) < width {
+		cells = append(cells, emptyChar)
+	}
+	if style.bandTicks {
+		overlayBandTicks(cells, filled+shadeWidth, thresholds)
+	}
+	bar := strings.Join(cells, "")
+	text := fmt.Sprintf("%s [%s]", label, bar)
+	if style.labelLast {
+		text = fmt.Sprintf("[%s] %s", bar, label)
+	}
+	if style.noColor {
+		return text
+	}
+	return color + text + colorReset
+}
+
+// 使用率の数値の位置（Config.PercentPosition）
+const (
+	percentPositionLeft  = "left"  // バーの左（例: "45.0% [████     ]"）
+	percentPositionRight = "right" // バーの右（例: "[████     ] 45.0%"）
+)
+
+// ステータスラインの各要素を識別するキー
+// 使用枠（Config.Windows）の要素はその枠のキーを使う
+const (
+	segHealth     = "health"
+	segApp        = "app"
+	segModel      = "model"
+	segEffort     = "effort"
+	segThinking   = "thinking"
+	segStyle      = "style"
+	segTokens     = "tokens"
+	segContext    = "ctx"
+	segContextPct = "ctx_pct"
+	seg5h         = "5h"
+	seg5hResets   = "5h_resets"
+	segSparkline  = "sparkline"
+	segWeek       = "week"
+	segWeekResets = "week_resets"
+	segCost       = "cost"
+	segAggregate  = "aggregate"
+	segNextReset  = "next_reset"
+	segBurnRate   = "burn"
+	segAccount    = "acct"
+	segCwd        = "cwd"
+	segSession    = "session"
+	segGitBranch  = "branch"
+)
+
+// segmentLabels は各要素の見出し
+type segmentLabels struct {
+	model  string
+	tokens string
+	week   string
+	resets string
+}
+
+// labels は各要素の見出しを返す。Compact の場合は狭い端末向けに短い見出しを使う
+func (c *Config) labels() segmentLabels {
+	labels := segmentLabels{model: "Model", tokens: "Total Tokens", week: c.WeekLabel, resets: "resets"}
+	if labels.week == "" {
+		labels.week = defaultWeekLabel
+	}
+	if c.Compact {
+		labels.model, labels.tokens, labels.resets = "M", "T", "r"
+		if labels.week == defaultWeekLabel {
+			labels.week = "w"
+		}
+	}
+	return labels
+}
+
+// labelKeys は labels で見出しを変更できる要素のキー
+var labelKeys = map[string]bool{
+	segApp: true, segModel: true, segTokens: true,
+	seg5h: true, seg5hResets: true, segWeek: true, segWeekResets: true,
+}
+
+// labeled は要素のテキストを "見出し: 値" の形式で返す
+// labels に key の見出しがある場合は "見出し: " の代わりにそれをそのまま前置する（例: "🤖 " で "🤖 Opus"）
+func (c *Config) labeled(key, label, value string) string {
+	if custom, ok := c.Labels[key]; ok {
+		return custom + value
+	}
+	return fmt.Sprintf("%s: %s", label, value)
+}
+
+// labelOr は labels に key の見出しがあればそれを、無ければ def を返す
+func (c *Config) labelOr(key, def string) string {
+	if custom, ok := c.Labels[key]; ok {
+		return custom
+	}
+	return def
+}
+
+// 複数プロファイルの使用率の集計方法
+const (
+	aggregateMax = "max" // 最も高い使用率
+	aggregateSum = "sum" // 使用率の合計
+)
+
+// aggregateUsage は複数プロファイルのキャッシュから5時間使用率を集計する
+// キャッシュが無い、または取得から ttl を超えたプロファイルは飛ばし、1つも読めなければ ok は false
+// リセット時刻を過ぎたプロファイルは使用率 0 として扱う
+// top は使用率が最も高いプロファイル
+func aggregateUsage(profiles []string, mode string, now time.Time, ttl time.Duration) (usage float64, top string, ok bool) {
+	highest := 0.0
+	for _, name := range profiles {
+		cache, err := readCache(profileCacheFilePath(name))
+		if err != nil || cache.ResetsAt == "" || now.Sub(time.Unix(cache.CachedAt, 0)) > ttl {
+			continue
+		}
+		utilization := cache.Utilization
+		if resetsAt, err := parseResetTime(cache.ResetsAt); err == nil && !now.Before(resetsAt) {
+			utilization = 0
+		}
+		if !ok || utilization > highest {
+			highest, top = utilization, name
+		}
+		ok = true
+		if mode == aggregateSum {
+			usage += utilization
+		}
+	}
+	if mode != aggregateSum {
+		usage = highest
+	}
+	return usage, top, ok
+}
+
+// defaultContextLimit は上限が分からないモデルのコンテキストウィンドウ（トークン数）
+const defaultContextLimit = 200000
+
+// modelContextLimits はモデルの表示名ごとのコンテキストウィンドウ（トークン数）
+var modelContextLimits = map[string]int64{
+	"Opus 4":                  200000,
+	"Opus 4.1":                200000,
+	"Opus 4.5":                200000,
+	"Sonnet 4":                200000,
+	"Sonnet 4.5":              200000,
+	"Haiku 4.5":               200000,
+	"Sonnet 4 (1M context)":   1000000,
+	"Sonnet 4.5 (1M context)": 1000000,
+}
+
+// contextLimit はモデルのコンテキストウィンドウを返す
+// overrides、組み込みの値の順に表示名で探し、見つからなければ defaultContextLimit を返す
+func contextLimit(model string, overrides map[string]int64) int64 {
+	if limit, ok := overrides[model]; ok && limit > 0 {
+		return limit
+	}
+	if limit, ok := modelContextLimits[model]; ok {
+		return limit
+	}
+	return defaultContextLimit
+}
+
+// defaultSeparator は要素間のデフォルトの区切り文字
+const defaultSeparator = " | "
+
+// segment はステータスラインを構成する1つの要素
+type segment struct {
+	key   string   // 要素の種類（seg* 定数または使用枠のキー）
+	text  string   // 描画されたテキスト
+	usage bool     // 使用率を表す要素か（Powerline 形式で段階の色を背景にする）
+	level severity // 使用率の段階（usage の場合のみ）
+}
+
+// segmentGroup は要素が属するグループ（5時間 / 週間）を返す
+func segmentGroup(key string) string {
+	switch key {
+	case seg5h, segBurnRate, segSparkline, seg5hResets:
+		return seg5h
+	case segWeek, segWeekResets:
+		return segWeek
+	}
+	return ""
+}
+
+// joinSegments は要素を区切り文字で連結する
+// GroupSeparator が設定されている場合は5時間グループと週間グループの境界にのみ使う
+func joinSegments(parts []segment, cfg *Config) string {
+	separator := cfg.Separator
+	if separator == "" {
+		separator = defaultSeparator
+	}
+
+	var b strings.Builder
+	for i, part := range parts {
+		if i > 0 {
+			sep := separator
+			if cfg.GroupSeparator != "" && segmentGroup(parts[i-1].key) == seg5h && segmentGroup(part.key) == segWeek {
+				sep = cfg.GroupSeparator
+			}
+			b.WriteString(sep)
+		}
+		b.WriteString(part.text)
+	}
+	return b.String()
+}
+
+// Powerline 形式の区切り文字
+const (
+	powerlineArrow     = "\ue0b0" // 背景色の異なる要素の間
+	powerlineThinArrow = "\ue0b1" // 背景色が同じ要素の間
+)
+
+// powerlineNeutralColor は使用率以外の要素の背景色（256色パレットの番号）
+const powerlineNeutralColor = 238
+
+// powerlineSeverityColors は使用率の段階ごとの背景色（256色パレットの番号）
+var powerlineSeverityColors = [...]int{
+	severityGreen:  2,
+	severityYellow: 3,
+	severityOrange: 208,
+	severityRed:    1,
+}
+
+// renderPowerline は要素ごとに背景色を付け、Powerline の矢印で連結する
+// 使用率の要素は段階の色、それ以外は灰色を背景にする。要素内の ANSI の色は取り除く
+// noColor の場合は色を付けず、矢印だけで区切る
+func renderPowerline(parts []segment, noColor bool) string {
+	var b strings.Builder
+	prev := -1
+	for _, part := range parts {
+		bg, fg := powerlineNeutralColor, 15
+		if part.usage {
+			bg, fg = powerlineSeverityColors[part.level], 0
+		}
+		text := stripANSI(part.text)
+		if noColor {
+			if prev >= 0 {
+				b.WriteString(" " + powerlineThinArrow)
+			}
+			b.WriteString(" " + text)
+			prev = bg
+			continue
+		}
+		switch {
+		case prev < 0:
+		case prev == bg:
+			fmt.Fprintf(&b, "\033[38;5;%dm%s", fg, powerlineThinArrow)
+		default:
+			fmt.Fprintf(&b, "\033[38;5;%d;48;5;%dm%s", prev, bg, powerlineArrow)
+		}
+		fmt.Fprintf(&b, "\033[38;5;%d;48;5;%dm %s ", fg, bg, text)
+		prev = bg
+	}
+	if prev < 0 {
+		return ""
+	}
+	if noColor {
+		b.WriteString(" " + powerlineArrow)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "%s\033[38;5;%dm%s%s", colorReset, prev, powerlineArrow, colorReset)
+	return b.String()
+}
+
+// ansiSequencePattern は文字列中の ANSI SGR シーケンスにマッチする
+var ansiSequencePattern = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// stripANSI は文字列から ANSI SGR シーケンスを取り除く
+func stripANSI(s string) string {
+	return ansiSequencePattern.ReplaceAllString(s, "")
+}
+
+// tmuxColorNames は ANSI の基本8色に対応する tmux の色名
+var tmuxColorNames = [...]string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+// tmuxAttributes は ANSI の文字属性に対応する tmux の属性名
+var tmuxAttributes = map[int]string{1: "bold", 2: "dim", 3: "italics", 4: "underscore", 7: "reverse"}
+
+// ansiToTmux は ANSI SGR シーケンスを tmux の書式（#[fg=green] など）に置き換える
+// リセットは #[default] にし、テキスト中の # は tmux の書式と解釈されないよう ## にする
+func ansiToTmux(s string) string {
+	s = strings.ReplaceAll(s, "#", "##")
+	return ansiSequencePattern.ReplaceAllStringFunc(s, func(seq string) string {
+		styles := tmuxStyles(strings.TrimSuffix(strings.TrimPrefix(seq, "\x1b["), "m"))
+		if len(styles) == 0 {
+			return ""
+		}
+		return "#[" + strings.Join(styles, ",") + "]"
+	})
+}
+
+// tmuxStyles は SGR のパラメータ（"38;5;208" など）を tmux のスタイルの一覧に変換する
+// 対応していないパラメータは無視する
+func tmuxStyles(params string) []string {
+	var codes []int
+	for _, p := range strings.Split(params, ";") {
+		n, err := strconv.Atoi(p)
+		if err != nil && p != "" {
+			return nil
+		}
+		codes = append(codes, n) // 空のパラメータは 0（リセット）
+	}
+
+	var styles []string
+	for i := 0; i < len(codes); i++ {
+		code := codes[i]
+		switch {
+		case code == 0:
+			styles = append(styles, "default")
+		case tmuxAttributes[code] != "":
+			styles = append(styles, tmuxAttributes[code])
+		case code >= 30 && code <= 37:
+			styles = append(styles, "fg="+tmuxColorNames[code-30])
+		case code >= 90 && code <= 97:
+			styles = append(styles, "fg=bright"+tmuxColorNames[code-90])
+		case code == 39:
+			styles = append(styles, "fg=default")
+		case code >= 40 && code <= 47:
+			styles = append(styles, "bg="+tmuxColorNames[code-40])
+		case code >= 100 && code <= 107:
+			styles = append(styles, "bg=bright"+tmuxColorNames[code-100])
+		case code == 49:
+			styles = append(styles, "bg=default")
+		case (code == 38 || code == 48) && i+2 < len(codes) && codes[i+1] == 5:
+			styles = append(styles, fmt.Sprintf("%s=colour%d", tmuxColorTarget(code), codes[i+2]))
+			i += 2
+		case (code == 38 || code == 48) && i+4 < len(codes) && codes[i+1] == 2:
+			styles = append(styles, fmt.Sprintf("%s=#%02x%02x%02x", tmuxColorTarget(code), codes[i+2], codes[i+3], codes[i+4]))
+			i += 4
+		}
+	}
+	return styles
+}
+
+// tmuxColorTarget は拡張色の SGR コード（38 または 48）に対応する tmux の対象（fg / bg）を返す
+func tmuxColorTarget(code int) string {
+	if code == 48 {
+		return "bg"
+	}
+	return "fg"
+}
+
+// quantizeUsage は使用率を 1/steps 単位の最も近い段階に丸め、その段階数を返す
+// 0 未満は 0、100% 超は steps にクリップする
+func quantizeUsage(usage float64, steps int) int {
+	n := int(math.Round(usage / 100.0 * float64(steps)))
+	if n < 0 {
+		return 0
+	}
+	if n > steps {
+		return steps
+	}
+	return n
+}
+
+// overlayBandTicks は空白部分の色閾値に対応する位置に目盛り（|）を描画する
+// start は空白部分の開始位置で、塗りつぶし済みの位置には描画しない
+func overlayBandTicks(cells []string, start int, thresholds colorThresholds) {
+	width := len(cells)
+	for _, threshold := range []float64{thresholds.yellow, thresholds.orange, thresholds.red} {
+		pos := int(threshold / 100.0 * float64(width))
+		if pos >= start && pos < width {
+			cells[pos] = "|"
+		}
+	}
+}
+
+// asciiSegments は各要素から非ASCII文字を取り除き、表示する文字が残らない要素を省く
+func asciiSegments(parts []segment) []segment {
+	kept := make([]segment, 0, len(parts))
+	for _, part := range parts {
+		part.text = toASCII(part.text)
+		if strings.TrimSpace(stripANSI(part.text)) == "" {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	return kept
+}
+
+// toASCII は文字列から非ASCII文字を取り除く
+func toASCII(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r < 0x80 {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// isCacheValid はキャッシュが有効かどうかをチェック
+func (sl *StatusLine) isCacheValid(cache *CacheData) bool {
+	valid, _ := sl.cacheDecision(cache)
+	return valid
+}
+
+// cacheDecision はキャッシュが有効かどうかと、その判定理由を返す（--dry-run で表示する）
+func (sl *StatusLine) cacheDecision(cache *CacheData) (bool, string) {
+	if cache.CachedAt == 0 {
+		return false, "cache empty"
+	}
+	// キャッシュに有効なデータが含まれているか検証
+	if cache.ResetsAt == "" {
+		return false, "cache has no usage data"
+	}
+
+	// Rate Limit の Retry-After 期間中は期限切れでも有効
+	if sl.inRetryAfter(cache) {
+		return true, "rate limited"
+	}
+
+	cacheTime := time.Unix(cache.CachedAt, 0)
+	cacheAge := sl.now().Sub(cacheTime)
+
+	// 最小インターバル以内なら常に有効（API保護）
+	if cacheAge < sl.cfg.minFetchInterval() {
+		return true, "within minimum fetch interval"
+	}
+
+	// API が推奨する次回取得時刻までは有効（maxPollAfter で上限を設ける）
+	if cache.NextPollAfter > 0 {
+		nextPoll := time.Unix(cache.NextPollAfter, 0)
+		if limit := cacheTime.Add(maxPollAfter); nextPoll.After(limit) {
+			nextPoll = limit
+		}
+		if sl.now().Before(nextPoll) {
+			return true, "before next poll"
+		}
+	}
+
+	// 最大キャッシュ有効期限を超えていたら無効
+	if cacheAge >= sl.cfg.cacheTTL() {
+		return false, "cache expired"
+	}
+
+	// モデルが変わっていれば無効（新しいセッションの可能性）
+	if sl.cfg.RefreshOnModelChange && sl.model != "" && cache.LastModel != sl.model {
+		return false, "model changed"
+	}
+
+	// history.jsonl がキャッシュより新しければ無効
+	historyModTime, err := sl.getHistoryModTime()
+	if err == nil && historyModTime.After(cacheTime) {
+		return false, "history newer"
+	}
+
+	return true, "history older"
+}
+
+// dryRunCache はキャッシュを使うか API から取得するかの判定を stderr に出力し、
+// 取得もキャッシュの書き込みもせずに既存のキャッシュを返す（無い場合は空のデータ）
+func (sl *StatusLine) dryRunCache(cacheFile string) *CacheData {
+	cache, err := readCache(cacheFile)
+	if err != nil {
+		fmt.Fprintln(sl.stderr, "would fetch: cache missing")
+		return &CacheData{}
+	}
+	valid, reason := sl.cacheDecision(cache)
+	switch {
+	case sl.forceRefresh:
+		fmt.Fprintln(sl.stderr, "would fetch: refresh requested")
+	case valid:
+		age := sl.now().Sub(time.Unix(cache.CachedAt, 0)).Round(time.Second)
+		fmt.Fprintf(sl.stderr, "cache valid (age %s, %s)\n", age, reason)
+	default:
+		fmt.Fprintf(sl.stderr, "would fetch: %s\n", reason)
+	}
+	return cache
+}
+
+// warnStaleHistory は history.jsonl が hours 時間以上更新されていない場合にヒントを出力する
+// キャッシュの無効化に使うファイルの場所が間違っている可能性があるため（hours が0以下の場合は何もしない）
+// 表示ごとに別のプロセスで実行されるため、警告した時刻を状態ファイルに保存し、
+// history.jsonl がその後に更新されるまでは再び警告しない（dry-run では保存しない）
+func (sl *StatusLine) warnStaleHistory(stateFile string, hours int) {
+	if hours <= 0 {
+		return
+	}
+	modTime, err := sl.getHistoryModTime()
+	if err != nil {
+		return
+	}
+	age := sl.now().Sub(modTime)
+	if age < time.Duration(hours)*time.Hour {
+		return
+	}
+	state := readState(stateFile)
+	if state.HistoryWarnedAt > 0 && !time.Unix(state.HistoryWarnedAt, 0).Before(modTime) {
+		return
+	}
+	sl.warnf("history.jsonl has not been updated for %dh; the history path (~/.claude/history.jsonl) may be wrong", int(age.Hours()))
+	if !sl.dryRun {
+		state.HistoryWarnedAt = sl.now().Unix()
+		sl.persistState(stateFile, state)
+	}
+}
+
+// defaultStaleText は期限切れキャッシュで表示中であることを示すデフォルトの文字列
+const defaultStaleText = "(stale)"
+
+// staleTextWithAge は text にデータの経過時間を加えた文字列を返す
+// text が ")" で終わる場合は括弧の内側に入れる（例: "(stale)" → "(stale 7m)"）
+func staleTextWithAge(text string, age time.Duration) string {
+	ageText := formatRemaining(age, "<1m")
+	if strings.HasSuffix(text, ")") {
+		return fmt.Sprintf("%s %s)", strings.TrimSuffix(text, ")"), ageText)
+	}
+	return fmt.Sprintf("%s %s", text, ageText)
+}
+
+// fetchingText は初回の取得中に使用率の代わりに表示する文字列
+const fetchingText = "fetching…"
+
+// fetchInBackground は API からの取得をバックグラウンドで開始し、結果をキャッシュに保存する
+// 表示時の取得と同じく、取得ロックと Retry-After の確認を経る
+// 完了は sl.background で待つ
+func (sl *StatusLine) fetchInBackground(cacheFile string, endpoint string) {
+	sl.fetchGuardedInBackground(cacheFile, endpoint, func() (*CacheData, error) {
+		return sl.fetchFromAPI(cacheFile, endpoint)
+	})
+}
+
+// waitBackground はバックグラウンドの取得の完了を backgroundWait まで待つ
+// Keychain の確認ダイアログ待ちなどで終わらない場合も、ステータスラインが終了できるよう待つのをやめる
+func (sl *StatusLine) waitBackground() {
+	done := make(chan struct{})
+	go func() {
+		sl.background.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(sl.backgroundWait)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		sl.warnf("background fetch did not finish within %v; exiting without waiting", sl.backgroundWait)
+	}
+}
+
+// fileModTime はファイルの更新時刻を返す（存在しない場合はゼロ値）
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// fileExists はファイルが存在するかどうかを返す
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// inRetryAfter は Rate Limit の Retry-After 期間中かどうかを判定する
+func (sl *StatusLine) inRetryAfter(cache *CacheData) bool {
+	return cache.RetryAfter > 0 && sl.now().Before(time.Unix(cache.RetryAfter, 0))
 }
 
 // getCachedOrFetch はキャッシュデータを取得、またはAPIから取得
 func (sl *StatusLine) getCachedOrFetch(cacheFile string, endpoint string) (*CacheData, error) {
 	// キャッシュの読み込みを試行
+	start := sl.now()
+	readModTime := fileModTime(cacheFile)
 	cache, err := readCache(cacheFile)
-	if err == nil && sl.isCacheValid(cache) {
+	sl.recordTiming(phaseCacheRead, start)
+	if sl.offline {
+		return sl.offlineCache(cache, err), nil
+	}
+	if errors.Is(err, errCorruptCache) {
+		// 壊れたキャッシュは削除し、取得し直したデータで作り直す
+		sl.warnf("removing corrupt cache file %s: %v", cacheFile, err)
+		if removeErr := os.Remove(cacheFile); removeErr != nil && !os.IsNotExist(removeErr) {
+			sl.warnf("failed to remove corrupt cache file: %v", removeErr)
+		}
+	} else if err != nil {
+		sl.debug("cache unavailable", map[string]any{"cache_file": cacheFile, "error": err})
+	} else if !sl.forceRefresh {
+		valid, reason := sl.cacheDecision(cache)
+		if valid {
+			sl.debug("using cached usage", map[string]any{"cache_file": cacheFile, "cached_at": cache.CachedAt, "reason": reason})
+			return cache, nil
+		}
+		sl.debug("cache invalid", map[string]any{"cache_file": cacheFile, "cached_at": cache.CachedAt, "reason": reason})
+	}
+
+	newCache, fetchErr := sl.fetchGuarded(cacheFile, endpoint, cache, err, readModTime)
+	if fetchErr == nil {
+		return newCache, nil
+	}
+
+	// 取得に失敗してもディスク上の期限切れキャッシュがあれば最後の値で表示を継続
+	if cache != nil && cache.ResetsAt != "" {
+		var rateLimitErr *RateLimitError
+		if sl.forceRefresh && !errors.As(fetchErr, &rateLimitErr) {
+			sl.warnf("forced refresh failed, using cached data: %v", fetchErr)
+		}
+		cache.Stale = true
 		return cache, nil
 	}
 
-	// 期限切れキャッシュを保持（フォールバック用）
-	staleCache := cache
+	return nil, fmt.Errorf("failed to fetch from API: %w", fetchErr)
+}
+
+// fetchGuarded は Retry-After 期間の確認と取得ロックを経て API から取得し、キャッシュに保存する
+// cache・readErr・readModTime は呼び出し元が読み込んだキャッシュとその結果、読み込み前の更新時刻
+// 別のプロセスが書き込んだ有効なキャッシュがあれば取得せずにそれを返し、429 の場合は Retry-After をキャッシュに記録する
+func (sl *StatusLine) fetchGuarded(cacheFile string, endpoint string, cache *CacheData, readErr error, readModTime time.Time) (*CacheData, error) {
+	return sl.fetchGuardedWith(cacheFile, endpoint, cache, readErr, readModTime, func() (*CacheData, error) {
+		return sl.fetchFromAPI(cacheFile, endpoint)
+	})
+}
+
+// fetchGuardedInBackground は fetchGuarded と同じ確認を経て fetch をバックグラウンドで実行する
+// 開始時に有効なキャッシュがあれば（別のプロセスが取得済みなど）取得しない
+func (sl *StatusLine) fetchGuardedInBackground(cacheFile string, endpoint string, fetch func() (*CacheData, error)) {
+	sl.background.Add(1)
+	go func() {
+		defer sl.background.Done()
+		readModTime := fileModTime(cacheFile)
+		cache, err := readCache(cacheFile)
+		if err == nil && !sl.forceRefresh && sl.isCacheValid(cache) {
+			return
+		}
+		if _, err := sl.fetchGuardedWith(cacheFile, endpoint, cache, err, readModTime, fetch); err != nil {
+			sl.warnf("background fetch failed: %v", err)
+		}
+	}()
+}
+
+// fetchGuardedWith は fetchGuarded の本体で、API からの取得に fetch を使う
+func (sl *StatusLine) fetchGuardedWith(cacheFile string, endpoint string, cache *CacheData, readErr error, readModTime time.Time, fetch func() (*CacheData, error)) (*CacheData, error) {
+	// データが無くても Retry-After 期間中は API にアクセスしない
+	if readErr == nil && !sl.forceRefresh && sl.inRetryAfter(cache) {
+		return nil, &RateLimitError{RetryAfter: time.Unix(cache.RetryAfter, 0).Sub(sl.now())}
+	}
+
+	// 読み込み後に別のプロセスが新しいキャッシュを書き込んでいれば、取得せずにそれを使う
+	if !sl.forceRefresh && !fileModTime(cacheFile).Equal(readModTime) {
+		if fresh, err := readCache(cacheFile); err == nil && sl.isCacheValid(fresh) {
+			sl.debug("using cache written by another process", map[string]any{"cache_file": cacheFile, "cached_at": fresh.CachedAt})
+			return fresh, nil
+		}
+	}
+
+	// 複数のプロセスが同時に取得しないよう、ロックを取得した1プロセスだけが API にアクセスする
+	// 待っている間に別のプロセスが新しいキャッシュを書き込んでいれば、取得せずにそれを使う
+	release, waited := acquireFetchLock(cacheFile+".lock", sl.fetchLockStale())
+	defer release()
+	if waited && !sl.forceRefresh {
+		if fresh, err := readCache(cacheFile); err == nil && sl.isCacheValid(fresh) {
+			sl.debug("using cache written by the process holding the lock", map[string]any{"cache_file": cacheFile, "cached_at": fresh.CachedAt})
+			return fresh, nil
+		}
+	}
+	if fresh, ok := sl.debouncedCache(cacheFile); ok {
+		sl.debug("using cache fetched within debounce window", map[string]any{"cache_file": cacheFile, "cached_at": fresh.CachedAt})
+		return fresh, nil
+	}
+
+	sl.debug("fetching usage from API", map[string]any{"cache_file": cacheFile, "force_refresh": sl.forceRefresh})
 
 	// キャッシュが無効または存在しない場合、APIから取得
-	newCache, fetchErr := sl.fetchFromAPI(cacheFile, endpoint)
+	newCache, fetchErr := fetch()
 	if fetchErr == nil {
 		return newCache, nil
 	}
 
-	// Rate Limit エラー時: 期限切れキャッシュにフォールバック
+	// Rate Limit エラー時: Retry-After までの再リクエストを防ぐ（期限切れキャッシュがあればその値は残す）
 	var rateLimitErr *RateLimitError
-	if errors.As(fetchErr, &rateLimitErr) && staleCache != nil && staleCache.ResetsAt != "" {
-		// CachedAt を更新してバックオフ期間中の再リクエストを防ぐ
-		staleCache.CachedAt = time.Now().Unix()
-		if saveErr := saveCache(cacheFile, staleCache); saveErr != nil {
-			fmt.Fprintf(sl.stderr, "warning: failed to save cache: %v\n", saveErr)
+	if errors.As(fetchErr, &rateLimitErr) {
+		retryAfter := sl.now().Add(rateLimitErr.RetryAfter).Unix()
+		if cache != nil && cache.ResetsAt != "" {
+			cache.RetryAfter = retryAfter
+			sl.persistCache(cacheFile, cache)
+		} else {
+			sl.persistCache(cacheFile, &CacheData{RetryAfter: retryAfter})
+		}
+	}
+	return nil, fetchErr
+}
+
+// offlineCache はオフラインモードで表示するキャッシュを返す
+// 期限切れのキャッシュも使い（Stale として表示）、読み込めない場合は空のデータを返す
+func (sl *StatusLine) offlineCache(cache *CacheData, readErr error) *CacheData {
+	if readErr != nil {
+		sl.debug("offline, no cache available", map[string]any{"error": readErr})
+		return &CacheData{}
+	}
+	valid, reason := sl.cacheDecision(cache)
+	sl.debug("offline, using cached usage", map[string]any{"cached_at": cache.CachedAt, "reason": reason})
+	if !valid && cache.ResetsAt != "" {
+		cache.Stale = true
+	}
+	return cache
+}
+
+// debouncedCache は DebounceMillis 以内に書き込まれたキャッシュを返す
+// プロンプトの再描画などで直前の呼び出しが取得したばかりの場合は、--refresh でも取得し直さない
+func (sl *StatusLine) debouncedCache(cacheFile string) (*CacheData, bool) {
+	window := time.Duration(sl.cfg.DebounceMillis) * time.Millisecond
+	if window <= 0 {
+		return nil, false
+	}
+	modTime := fileModTime(cacheFile)
+	if age := sl.now().Sub(modTime); modTime.IsZero() || age < 0 || age >= window {
+		return nil, false
+	}
+	cache, err := readCache(cacheFile)
+	if err != nil || cache.ResetsAt == "" {
+		return nil, false
+	}
+	return cache, true
+}
+
+// maxFetchDuration はトークンの取得と、doWithRetry の再試行とバックオフを含めた API からの取得にかかる最長の時間を返す
+func (sl *StatusLine) maxFetchDuration() time.Duration {
+	attempts := max(sl.cfg.APIMaxAttempts, 1)
+	delay := time.Duration(sl.cfg.APIRetryBaseDelayMillis) * time.Millisecond
+	total := sl.keychainTimeout + apiTimeout
+	for attempt := 1; attempt < attempts && total < 24*time.Hour; attempt++ {
+		total += delay + apiTimeout
+		delay *= 2
+	}
+	return total
+}
+
+// fetchLockStale はロックファイルを異常終了したプロセスのものとみなすまでの時間を返す
+// 取得中のプロセスからロックを奪わないよう、取得の最長時間より長くする
+func (sl *StatusLine) fetchLockStale() time.Duration {
+	return sl.maxFetchDuration() + fetchLockMargin
+}
+
+// acquireFetchLock は O_CREATE|O_EXCL でロックファイルを作成し、解放する関数を返す
+// ロックファイルには PID と作成時刻を書き込み、解放時は内容が変わっていない（自分のロックである）場合のみ削除する
+// 別のプロセスがロック中の場合は最大 fetchLockWait まで待ち、waited を true にする
+// stale より古いロックファイルは削除して取り直す
+// 待ち時間を超えた場合やロックファイルを作成できない場合は、ロックなしで続行する（解放する関数は何もしない）
+func acquireFetchLock(lockFile string, stale time.Duration) (release func(), waited bool) {
+	os.MkdirAll(filepath.Dir(lockFile), 0755)
+	owner := fmt.Sprintf("%d %d", os.Getpid(), time.Now().UnixNano())
+	deadline := time.Now().Add(fetchLockWait)
+	for {
+		file, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = file.WriteString(owner)
+			file.Close()
+			if err != nil {
+				os.Remove(lockFile)
+				return func() {}, waited
+			}
+			return func() { removeLockIfOwned(lockFile, owner) }, waited
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return func() {}, waited
+		}
+		if modTime := fileModTime(lockFile); !modTime.IsZero() && time.Since(modTime) > stale {
+			// 確認の間に別のプロセスが取り直していなければ削除する
+			if holder, err := os.ReadFile(lockFile); err == nil {
+				removeLockIfOwned(lockFile, string(holder))
+			}
+			continue
 		}
-		return staleCache, nil
+		if time.Now().After(deadline) {
+			return func() {}, waited
+		}
+		waited = true
+		time.Sleep(50 * time.Millisecond)
 	}
+}
 
-	return nil, fmt.Errorf("failed to fetch from API: %w", fetchErr)
+// removeLockIfOwned はロックファイルの内容が owner の場合のみ削除する
+func removeLockIfOwned(lockFile, owner string) {
+	if holder, err := os.ReadFile(lockFile); err == nil && string(holder) == owner {
+		os.Remove(lockFile)
+	}
 }
 
 // readCache はファイルからキャッシュを読み込む
@@ -623,36 +3517,121 @@ func readCache(cacheFile string) (*CacheData, error) {
 
 	var cache CacheData
 	if err := json.NewDecoder(file).Decode(&cache); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %v", errCorruptCache, err)
 	}
 
 	return &cache, nil
 }
 
+// errCorruptCache はキャッシュファイルが JSON として読めない（書き込み途中で壊れたなど）ことを表す
+var errCorruptCache = errors.New("corrupt cache")
+
 // fetchFromAPI はAPIから使用状況データを取得してキャッシュを更新
 func (sl *StatusLine) fetchFromAPI(cacheFile string, endpoint string) (*CacheData, error) {
 	// アクセストークンを取得
-	token, err := sl.getAccessToken()
+	start := sl.now()
+	token, err := sl.lookupToken(cacheFile, endpoint)
+	sl.recordTiming(phaseToken, start)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get access token: %w", err)
 	}
+	return sl.fetchWithToken(cacheFile, endpoint, token)
+}
+
+// errTokenLookupSlow はトークンの取得が TokenLookupBudgetMillis を超えたことを表す
+var errTokenLookupSlow = errors.New("token lookup exceeded budget")
+
+// lookupToken はアクセストークンを取得する
+// TokenLookupBudgetMillis を超えた場合（Keychain の確認ダイアログ待ちなど）は errTokenLookupSlow を返し、
+// 取得はバックグラウンドで続けて、取得できたら次回の表示のために API から取得してキャッシュに保存する
+func (sl *StatusLine) lookupToken(cacheFile string, endpoint string) (string, error) {
+	budget := time.Duration(sl.cfg.TokenLookupBudgetMillis) * time.Millisecond
+	if budget <= 0 {
+		return sl.getAccessToken()
+	}
+
+	type result struct {
+		token string
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		token, err := sl.getAccessToken()
+		done <- result{token, err}
+	}()
+
+	timer := time.NewTimer(budget)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.token, r.err
+	case <-timer.C:
+	}
+
+	// トークンを取得できたら、表示時の取得と同じく取得ロックと Retry-After の確認を経て取得する
+	sl.background.Add(1)
+	go func() {
+		defer sl.background.Done()
+		r := <-done
+		if r.err != nil {
+			return
+		}
+		sl.fetchGuardedInBackground(cacheFile, endpoint, func() (*CacheData, error) {
+			return sl.fetchWithToken(cacheFile, endpoint, r.token)
+		})
+	}()
+	return "", errTokenLookupSlow
+}
+
+// fetchWithToken は取得済みのアクセストークンで API から使用状況を取得してキャッシュに保存する
+// エラーメッセージやログにトークンが含まれないよう、以降の出力ではトークンを伏せる
+func (sl *StatusLine) fetchWithToken(cacheFile string, endpoint string, token string) (*CacheData, error) {
+	if token != "" {
+		sl.token.Store(&token)
+	}
+	cache, err := sl.requestUsage(cacheFile, endpoint, token)
+	if err != nil && token != "" && strings.Contains(err.Error(), token) {
+		err = &redactedError{err: err, token: token}
+	}
+	return cache, err
+}
+
+// redact は s に含まれる token を "***" に置き換える（token が空の場合はそのまま返す）
+func redact(s, token string) string {
+	if token == "" {
+		return s
+	}
+	return strings.ReplaceAll(s, token, "***")
+}
 
+// redactedError はメッセージからトークンを伏せたエラー（errors.As などのため元のエラーは保持する）
+type redactedError struct {
+	err   error
+	token string
+}
+
+func (e *redactedError) Error() string { return redact(e.err.Error(), e.token) }
+func (e *redactedError) Unwrap() error { return e.err }
+
+// requestUsage は API から使用状況を取得してキャッシュに保存する
+func (sl *StatusLine) requestUsage(cacheFile string, endpoint string, token string) (*CacheData, error) {
 	// HTTPリクエストを作成
-	req, err := http.NewRequest("GET", endpoint, nil)
+	req, err := sl.newUsageRequest(endpoint, token)
 	if err != nil {
 		return nil, err
 	}
+	reqURL := req.URL.String()
 
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("anthropic-beta", apiBeta)
-
-	// リクエストを送信
-	resp, err := sl.httpClient.Do(req)
+	// リクエストを送信（トークンはログに残さない）
+	sl.debug("requesting usage", map[string]any{"url": reqURL})
+	start := sl.now()
+	defer sl.recordTiming(phaseAPIFetch, start)
+	resp, err := sl.doWithRetry(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	sl.info("API responded", map[string]any{"url": reqURL, "status": resp.StatusCode, "elapsed": sl.now().Sub(start)})
 
 	if resp.StatusCode == http.StatusTooManyRequests {
 		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"))
@@ -660,12 +3639,17 @@ func (sl *StatusLine) fetchFromAPI(cacheFile string, endpoint string) (*CacheDat
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API request failed: status %d", resp.StatusCode)
+		return nil, fmt.Errorf("API request failed: %s", statusWithBody(resp, token))
 	}
 
 	// レスポンスをパース
-	var apiResp APIResponse
-	if err := json.NewDecoder(resp.Body).Decode(&apiResp); err != nil {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	sl.saveRawResponse(body)
+	apiResp, err := parseAPIResponse(body)
+	if err != nil {
 		return nil, err
 	}
 
@@ -680,41 +3664,228 @@ func (sl *StatusLine) fetchFromAPI(cacheFile string, endpoint string) (*CacheDat
 		Utilization:       apiResp.FiveHour.Utilization,
 		WeeklyUtilization: apiResp.SevenDay.Utilization,
 		WeeklyResetsAt:    apiResp.SevenDay.ResetsAt,
-		CachedAt:          time.Now().Unix(),
+		CachedAt:          sl.now().Unix(),
+		LastModel:         sl.model,
+		Windows:           apiResp.Windows,
+		Account:           firstNonEmpty(apiResp.Account.EmailAddress, apiResp.Account.OrganizationName),
+	}
+	if account := sl.credentialsAccount.Load(); cache.Account == "" && account != nil {
+		cache.Account = *account
+	}
+	if apiResp.PollAfterSeconds > 0 {
+		cache.NextPollAfter = cache.CachedAt + apiResp.PollAfterSeconds
+	}
+
+	// 前回キャッシュから履歴を引き継ぐ
+	var samples []float64
+	prev, prevErr := readCache(cacheFile)
+	if prevErr == nil {
+		samples = prev.Samples
+		if prev.ResetsAt != "" {
+			prevUtilization := prev.Utilization
+			cache.PrevUtilization = &prevUtilization
+			cache.PrevCachedAt = prev.CachedAt
+		}
 	}
+	cache.Samples = appendSample(samples, cache.Utilization, sl.cfg.CacheMaxSamples)
 
 	// キャッシュファイルに保存
 	// エラーが発生しても警告を出力してプログラムは継続する
-	if err := saveCache(cacheFile, cache); err != nil {
-		fmt.Fprintf(sl.stderr, "warning: failed to save cache: %v\n", err)
+	sl.persistCache(cacheFile, cache)
+
+	// 同じリセット期間内での不自然な急変は不正なレスポンスの可能性があるため、
+	// 今回の描画では前回の値を使う（キャッシュには新しい値を保存済み）
+	if prevErr == nil && sl.implausibleJump(prev, cache) {
+		sl.warnf("implausible usage jump %.1f%% -> %.1f%%, keeping previous value",
+			prev.Utilization, cache.Utilization)
+		held := *cache
+		held.Utilization = prev.Utilization
+		return &held, nil
 	}
 
 	return cache, nil
 }
 
-// getAccessToken は認証情報を取得する
+// maxErrorBodyBytes はエラーメッセージに含めるレスポンスボディの上限（バイト）
+const maxErrorBodyBytes = 512
+
+// statusWithBody は失敗したレスポンスのステータスコードとボディの先頭を1行にまとめて返す
+// ボディは maxErrorBodyBytes までしか読まず、空白を詰めてトークンを伏せる
+func statusWithBody(resp *http.Response, token string) string {
+	status := fmt.Sprintf("status %d", resp.StatusCode)
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes+1))
+	truncated := len(data) > maxErrorBodyBytes
+	if truncated {
+		data = data[:maxErrorBodyBytes]
+	}
+	body := strings.Join(strings.Fields(strings.ToValidUTF8(string(data), "")), " ")
+	if body == "" {
+		return status
+	}
+	if truncated {
+		body += "…"
+	}
+	return fmt.Sprintf("%s: %s", status, redact(body, token))
+}
+
+// newUsageRequest は使用状況を取得する API リクエストを作成する
+func (sl *StatusLine) newUsageRequest(endpoint string, token string) (*http.Request, error) {
+	reqURL, err := buildRequestURL(endpoint, sl.cfg.APIQuery)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if sl.apiKeyAuth.Load() {
+		req.Header.Set("x-api-key", token)
+		req.Header.Set("anthropic-version", apiVersion)
+		return req, nil
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("anthropic-beta", apiBeta)
+	return req, nil
+}
+
+// doWithRetry は接続エラーと 5xx レスポンスの場合に指数バックオフで再試行しながらリクエストを送信する
+// 4xx（認証エラーや Rate Limit）は再試行しても回復しないため、そのまま返す
+func (sl *StatusLine) doWithRetry(req *http.Request) (*http.Response, error) {
+	attempts := sl.cfg.APIMaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := time.Duration(sl.cfg.APIRetryBaseDelayMillis) * time.Millisecond
+
+	for attempt := 1; ; attempt++ {
+		resp, err := sl.httpClient.Do(req)
+		retryable := err != nil || resp.StatusCode >= http.StatusInternalServerError
+		if !retryable || attempt >= attempts {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		sl.sleep(delay)
+		delay *= 2
+	}
+}
+
+// 主要な使用枠（Config.PrimaryWindow）
+const (
+	windowFiveHour = "five_hour"
+	windowSevenDay = "seven_day"
+)
+
+// primaryWindow は単一の指標を使う機能が基準にする使用枠とその表示名を返す
+func (c *Config) primaryWindow(cache *CacheData) (UsageWindow, string) {
+	if c.PrimaryWindow == windowSevenDay {
+		label := c.WeekLabel
+		if label == "" {
+			label = defaultWeekLabel
+		}
+		return UsageWindow{ResetsAt: cache.WeeklyResetsAt, Utilization: cache.WeeklyUtilization}, label
+	}
+	return UsageWindow{ResetsAt: cache.ResetsAt, Utilization: cache.Utilization}, "5h"
+}
+
+// implausibleJump は前回から今回の5時間使用率の変化が SanityDeltaCap を超えたかを判定する
+// リセット時刻が変わった場合（新しい期間）は急変とみなさない
+func (sl *StatusLine) implausibleJump(prev, cache *CacheData) bool {
+	if sl.cfg.SanityDeltaCap <= 0 || prev.ResetsAt == "" || prev.ResetsAt != cache.ResetsAt {
+		return false
+	}
+	return math.Abs(cache.Utilization-prev.Utilization) > sl.cfg.SanityDeltaCap
+}
+
+// buildRequestURL はエンドポイントにクエリパラメータを付与したURLを返す
+// 既存のクエリパラメータは保持し、値は URL エンコードされる
+func buildRequestURL(endpoint string, query map[string]string) (string, error) {
+	if len(query) == 0 {
+		return endpoint, nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	for key, value := range query {
+		q.Set(key, value)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// apiKeyEnv は OAuth の認証情報が無い場合に使う API キーの環境変数
+const apiKeyEnv = "ANTHROPIC_API_KEY"
+
+// defaultAccessToken は認証情報を取得する
+// Keychain（macOS）、認証情報ファイルの順に OAuth トークンを探し、どちらからも取得できない場合は
+// 最後に ANTHROPIC_API_KEY を API キーとして使う
+func (sl *StatusLine) defaultAccessToken() (string, error) {
+	token, err := sl.oauthAccessToken()
+	if err == nil {
+		sl.apiKeyAuth.Store(false)
+		return token, nil
+	}
+	if key := os.Getenv(apiKeyEnv); key != "" {
+		sl.debug("using API key from environment", map[string]any{"env": apiKeyEnv, "oauth_error": err})
+		sl.apiKeyAuth.Store(true)
+		return key, nil
+	}
+	return "", err
+}
+
+// oauthAccessToken は OAuth の認証情報からアクセストークンを取得する
 // macOSの場合はKeychainから、それ以外はファイルから取得
-func getAccessToken() (string, error) {
+func (sl *StatusLine) oauthAccessToken() (string, error) {
+	// プロファイル指定時は Keychain（Claude Code がログイン中のアカウント）を使わず、
+	// credentials_path またはプロファイルのディレクトリの .credentials.json から取得する
+	if dir := profileDir(sl.profile); dir != getConfigDir() {
+		credFile := sl.cfg.CredentialsPath
+		if credFile == "" {
+			credFile = filepath.Join(dir, ".credentials.json")
+		}
+		creds, err := readCredentials(credFile)
+		if err != nil {
+			return "", err
+		}
+		sl.recordAccount(creds.account())
+		return creds.accessToken()
+	}
+
 	// macOSの場合、Keychainから取得を試みる
-	token, err := getAccessTokenFromKeychain()
+	token, err := sl.getAccessTokenFromKeychain()
 	if err == nil && token != "" {
 		return token, nil
 	}
 
 	// Keychainからの取得に失敗した場合、ファイルから取得を試みる
-	return getAccessTokenFromFile()
-}
-
-// getAccessTokenFromKeychain はmacOSのKeychainから認証情報を取得
-func getAccessTokenFromKeychain() (string, error) {
-	sl := NewStatusLine()
-	return sl.getAccessTokenFromKeychain()
+	credFile, err := credentialsFilePath(sl.cfg.CredentialsPath)
+	if err != nil {
+		return "", err
+	}
+	creds, err := readCredentials(credFile)
+	if err != nil {
+		return "", err
+	}
+	sl.recordAccount(creds.account())
+	return creds.accessToken()
 }
 
 // getAccessTokenFromKeychain はmacOSのKeychainから認証情報を取得（StatusLineメソッド版）
+// 確認ダイアログが放置された場合などに終わらないよう、keychainTimeout を超えたら security コマンドを終了させる
 func (sl *StatusLine) getAccessTokenFromKeychain() (string, error) {
-	cmd := sl.execCommand("security", "find-generic-password", "-s", "Claude Code-credentials", "-w")
+	ctx, cancel := context.WithTimeout(context.Background(), sl.keychainTimeout)
+	defer cancel()
+	cmd := sl.execCommand(ctx, "security", "find-generic-password", "-s", "Claude Code-credentials", "-w")
 	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("keychain lookup timed out after %v", sl.keychainTimeout)
+	}
 	if err != nil {
 		return "", err
 	}
@@ -723,63 +3894,150 @@ func (sl *StatusLine) getAccessTokenFromKeychain() (string, error) {
 	if err := json.Unmarshal(output, &creds); err != nil {
 		return "", err
 	}
+	sl.recordAccount(creds.account())
+	return creds.accessToken()
+}
 
-	if creds.ClaudeAiOauth.AccessToken == "" {
-		return "", fmt.Errorf("access token is empty")
+// recordAccount は認証情報に含まれていたアカウントを記録する（API レスポンスに無い場合に表示する）
+func (sl *StatusLine) recordAccount(account string) {
+	if account != "" {
+		sl.credentialsAccount.Store(&account)
 	}
-
-	return creds.ClaudeAiOauth.AccessToken, nil
 }
 
-// getAccessTokenFromFile はファイルから認証情報を取得
-func getAccessTokenFromFile() (string, error) {
+// credentialsFilePath は認証情報ファイルのパスを返す
+// override が指定されていればそれを使い、CLAUDE_CONFIG_DIR が設定されていればその配下、
+// それ以外は ~/.claude/.credentials.json
+func credentialsFilePath(override string) (string, error) {
+	if override != "" {
+		return override, nil
+	}
+	if configDir := os.Getenv("CLAUDE_CONFIG_DIR"); configDir != "" {
+		return filepath.Join(configDir, ".credentials.json"), nil
+	}
+
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		return "", err
 	}
-
-	credFile := filepath.Join(homeDir, ".claude", ".credentials.json")
-	return getAccessTokenFromFileWithPath(credFile)
+	return filepath.Join(homeDir, ".claude", ".credentials.json"), nil
 }
 
 // getAccessTokenFromFileWithPath は指定されたパスから認証情報を取得（テスト用）
 func getAccessTokenFromFileWithPath(credFile string) (string, error) {
-	file, err := os.Open(credFile)
+	creds, err := readCredentials(credFile)
 	if err != nil {
 		return "", err
 	}
+	return creds.accessToken()
+}
+
+// readCredentials は認証情報ファイルを読み込む
+func readCredentials(credFile string) (*Credentials, error) {
+	file, err := os.Open(credFile)
+	if err != nil {
+		return nil, err
+	}
 	defer file.Close()
 
 	var creds Credentials
 	if err := json.NewDecoder(file).Decode(&creds); err != nil {
-		return "", err
+		return nil, err
 	}
+	return &creds, nil
+}
 
-	if creds.ClaudeAiOauth.AccessToken == "" {
-		return "", fmt.Errorf("access token is empty")
+// persistCache はキャッシュを保存し、失敗した場合は警告を出力する
+// 読み取り専用のファイルシステムや書き込み権限の無いディレクトリでは
+// 最初の失敗以降このプロセスでの保存を諦め、警告を繰り返さない
+func (sl *StatusLine) persistCache(cacheFile string, cache *CacheData) {
+	if sl.cacheReadOnly.Load() {
+		return
+	}
+	err := saveCache(cacheFile, compactCache(cache, sl.cfg.CacheMaxSamples))
+	if err == nil {
+		return
+	}
+	if errors.Is(err, syscall.EROFS) || errors.Is(err, os.ErrPermission) {
+		if sl.cacheReadOnly.Swap(true) {
+			return
+		}
+		sl.warnf("cache is not writable, skipping further saves: %v", err)
+		return
+	}
+	sl.warnf("failed to save cache: %v", err)
+}
+
+// compactCache は保存する履歴を古いものから捨てて maxSamples 件までに切り詰める
+// 現在の使用率などの項目はそのまま残す。maxSamples が0以下の場合は切り詰めない
+func compactCache(cache *CacheData, maxSamples int) *CacheData {
+	if maxSamples <= 0 || len(cache.Samples) <= maxSamples {
+		return cache
+	}
+	compacted := *cache
+	compacted.Samples = cache.Samples[len(cache.Samples)-maxSamples:]
+	return &compacted
+}
+
+// StateData は表示の間で引き継ぐ状態
+// 取得のたびに書き換えられ、壊れた場合は作り直されるキャッシュとは別のファイルに保存する
+type StateData struct {
+	HistoryWarnedAt int64 `json:"history_warned_at,omitempty"` // history.jsonl が古いことを最後に警告した時刻（Unix時刻）
+	AboveNotify     bool  `json:"above_notify,omitempty"`      // 前回描画時に通知閾値以上だったか
+}
+
+// stateFilePath はキャッシュファイルに対応する状態ファイルのパスを返す
+func stateFilePath(cacheFile string) string {
+	return cacheFile + ".state"
+}
+
+// readState は状態ファイルを読み込む（存在しない、または読めない場合は空の状態）
+func readState(stateFile string) *StateData {
+	state := &StateData{}
+	if data, err := os.ReadFile(stateFile); err == nil {
+		if err := json.Unmarshal(data, state); err != nil {
+			return &StateData{}
+		}
 	}
+	return state
+}
 
-	return creds.ClaudeAiOauth.AccessToken, nil
+// persistState は状態ファイルを保存する（失敗しても表示には影響しないためデバッグログのみ）
+func (sl *StatusLine) persistState(stateFile string, state *StateData) {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(stateFile, append(data, '\n'))
+	}
+	if err != nil {
+		sl.debug("failed to save state", map[string]any{"state_file": stateFile, "error": err})
+	}
 }
 
 // saveCache はキャッシュデータをファイルに保存
 func saveCache(cacheFile string, cache *CacheData) error {
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(cacheFile, append(data, '\n'))
+}
+
+// writeFileAtomic は一時ファイルに書き込んでからリネームすることでアトミックにファイルを更新する
+func writeFileAtomic(path string, data []byte) error {
 	// ディレクトリが存在することを確認
-	dir := filepath.Dir(cacheFile)
+	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return err
 	}
 
 	// 最初に一時ファイルに書き込む
-	tmpFile := cacheFile + ".tmp"
+	tmpFile := path + ".tmp"
 	file, err := os.Create(tmpFile)
 	if err != nil {
 		return err
 	}
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(cache); err != nil {
+	if _, err := file.Write(data); err != nil {
 		file.Close()
 		os.Remove(tmpFile)
 		return err
@@ -791,7 +4049,7 @@ func saveCache(cacheFile string, cache *CacheData) error {
 	}
 
 	// アトミックなリネーム
-	return os.Rename(tmpFile, cacheFile)
+	return os.Rename(tmpFile, path)
 }
 
 // getHistoryModTime は history.jsonl の更新時刻を取得
@@ -825,42 +4083,305 @@ func roundToNearestMinute(t time.Time) time.Time {
 	return truncated
 }
 
+// リセット時刻の分への丸め方
+const (
+	resetRoundingNearest = "nearest" // 最も近い分（30秒以上は切り上げ）
+	resetRoundingUp      = "up"      // 端数があれば次の分に切り上げ
+	resetRoundingDown    = "down"    // 端数を切り捨て
+	resetRoundingNone    = "none"    // 丸めない（秒単位の表示で使う。設定値としては受け付けない）
+)
+
+// リセット時刻の精度
+const (
+	resetPrecisionMinute = "minute" // 分単位に丸めて表示
+	resetPrecisionSecond = "second" // 丸めずに秒まで表示
+)
+
+// 秒単位で表示する場合のデフォルトの表示形式
+const (
+	secondResetTimeLayout       = "15:04:05"
+	secondWeeklyResetTimeLayout = "01/02(Mon) 15:04:05"
+)
+
+// resetTimeFormat は5時間・週間のリセット時刻の表示形式と丸め方を返す
+// ResetPrecision が "second" の場合は丸めず、デフォルトの表示形式には秒を加える（独自の表示形式はそのまま）
+func (c *Config) resetTimeFormat() (layout, weeklyLayout, rounding string) {
+	layout, weeklyLayout, rounding = c.ResetTimeLayout, c.WeeklyResetTimeLayout, c.ResetRounding
+	if c.ResetPrecision != resetPrecisionSecond {
+		return layout, weeklyLayout, rounding
+	}
+	if layout == defaultResetTimeLayout {
+		layout = secondResetTimeLayout
+	}
+	if weeklyLayout == defaultWeeklyResetTimeLayout {
+		weeklyLayout = secondWeeklyResetTimeLayout
+	}
+	return layout, weeklyLayout, resetRoundingNone
+}
+
+// roundMinute は時刻を mode に従って分単位に丸める（不明な mode は nearest）
+func roundMinute(t time.Time, mode string) time.Time {
+	truncated := t.Truncate(time.Minute)
+	switch mode {
+	case resetRoundingUp:
+		if t.After(truncated) {
+			return truncated.Add(time.Minute)
+		}
+		return truncated
+	case resetRoundingDown:
+		return truncated
+	case resetRoundingNone:
+		return t
+	}
+	return roundToNearestMinute(t)
+}
+
+// parseResetTime はリセット時刻をパースする
+// ISO8601（RFC3339）形式と数値文字列（エポック秒）の両方に対応
+func parseResetTime(resetsAt string) (time.Time, error) {
+	if epoch, err := strconv.ParseInt(resetsAt, 10, 64); err == nil {
+		return time.Unix(epoch, 0), nil
+	}
+	return time.Parse(time.RFC3339, resetsAt)
+}
+
+// リセット時刻のデフォルトの表示形式（Go の時刻レイアウト）
+const (
+	defaultResetTimeLayout       = "15:04"
+	defaultWeeklyResetTimeLayout = "01/02(Mon) 15:04"
+)
+
 // formatResetTime はリセット時刻をHH:MM形式にフォーマット
 func formatResetTime(resetsAt string) string {
+	return formatResetTimeLayout(resetsAt, defaultResetTimeLayout)
+}
+
+// formatResetTimeWithDate はリセット時刻をMM/DD(Day) HH:MM形式にフォーマット
+func formatResetTimeWithDate(resetsAt string) string {
+	return formatResetTimeLayout(resetsAt, defaultWeeklyResetTimeLayout)
+}
+
+// formatResetTimeLayout はリセット時刻を指定された Go の時刻レイアウトでフォーマット
+func formatResetTimeLayout(resetsAt string, layout string) string {
+	return formatResetTimeIn(resetsAt, layout, time.Local, resetRoundingNearest)
+}
+
+// formatResetTimeIn はリセット時刻を rounding に従って分に丸め、指定されたタイムゾーンと時刻レイアウトでフォーマット
+func formatResetTimeIn(resetsAt string, layout string, loc *time.Location, rounding string) string {
 	if resetsAt == "" {
 		return ""
 	}
 
-	// ISO8601時刻をパース
-	t, err := time.Parse(time.RFC3339, resetsAt)
+	t, err := parseResetTime(resetsAt)
 	if err != nil {
 		return ""
 	}
 
-	// 分単位で切り上げ
-	t = roundToNearestMinute(t)
+	// 分単位に丸める
+	t = roundMinute(t, rounding)
 
-	// ローカル時刻に変換してフォーマット
-	localTime := t.Local()
-	return localTime.Format("15:04")
+	// 表示するタイムゾーンに変換してフォーマット
+	return t.In(loc).Format(layout)
 }
 
-// formatResetTimeWithDate はリセット時刻をMM/DD(Day) HH:MM形式にフォーマット
-func formatResetTimeWithDate(resetsAt string) string {
-	if resetsAt == "" {
-		return ""
+// endpoint は使用状況を取得する API エンドポイントを返す
+func (c *Config) endpoint() string {
+	if c.APIEndpoint == "" {
+		return apiEndpoint
+	}
+	return c.APIEndpoint
+}
+
+// validEndpoint は API エンドポイントが https の絶対 URL かどうかを判定する
+// アクセストークンを平文で送らないよう、http はループバックのホスト（テスト用のサーバーなど）のみ許可する
+func validEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		return isLoopbackHost(u.Hostname())
+	default:
+		return false
+	}
+}
+
+// isLoopbackHost はホストが localhost またはループバックアドレスかどうかを判定する
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
 	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// validProxyURL はプロキシが http(s) の絶対 URL かどうかを判定する
+// （https の API へのリクエストはプロキシ経由でも TLS で暗号化される）
+func validProxyURL(proxyURL string) bool {
+	u, err := url.Parse(proxyURL)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
 
-	// ISO8601時刻をパース
-	t, err := time.Parse(time.RFC3339, resetsAt)
+// location はリセット時刻を表示するタイムゾーンを返す
+// Timezone が空または読み込めない場合はローカル時刻
+func (c *Config) location() *time.Location {
+	if c.Timezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(c.Timezone)
 	if err != nil {
-		return ""
+		return time.Local
+	}
+	return loc
+}
+
+// validTimeLayout は時刻レイアウトが時刻の要素を含むかどうかを判定する
+// 要素を含まないレイアウトはどの時刻でも同じ文字列になるため無効とみなす
+func validTimeLayout(layout string) bool {
+	if layout == "" {
+		return false
+	}
+	a := time.Date(2001, 2, 3, 4, 5, 0, 0, time.UTC).Format(layout)
+	b := time.Date(2012, 11, 13, 14, 25, 0, 0, time.UTC).Format(layout)
+	return a != b
+}
+
+// リセットの表示形式
+const (
+	resetDisplayClock    = "clock"    // リセット時刻（例: "10:30"）
+	resetDisplayRelative = "relative" // 残り時間（例: "42m"）
+	resetDisplayBoth     = "both"     // 時刻と残り時間（例: "10:30 (in 42m)"）
+)
+
+// formatReset はフォーマット済みのリセット時刻 clock を ResetDisplay に従って残り時間と組み合わせる
+// リセット時刻が不明な場合は空文字を返す
+func (sl *StatusLine) formatReset(resetsAt, clock string, cfg *Config) string {
+	display := cfg.ResetDisplay
+	if cfg.ResetAsCountdown {
+		display = resetDisplayRelative
+	}
+	if clock == "" || display == resetDisplayClock {
+		return clock
+	}
+	t, err := parseResetTime(resetsAt)
+	if err != nil {
+		return clock
+	}
+	d := t.Sub(sl.now())
+	remaining := formatRemaining(d, cfg.ResetNowText)
+	switch display {
+	case resetDisplayRelative:
+		return remaining
+	case resetDisplayBoth:
+		if d <= 0 {
+			return fmt.Sprintf("%s (%s)", clock, remaining)
+		}
+		return fmt.Sprintf("%s (in %s)", clock, remaining)
+	}
+	return clock
+}
+
+// burnRateText は前回取得時からの5時間使用率の増加ペースが続いた場合に、リセット前に 100% に達するかを予測する
+// 達する場合は "~over in 1h20m"、達しない場合は "~ok" を返す
+// 前回の値や取得間隔、リセット時刻が不明な場合は ok が false
+func (sl *StatusLine) burnRateText(cache *CacheData, nowText string) (string, bool) {
+	if cache.PrevUtilization == nil || cache.PrevCachedAt == 0 || cache.CachedAt <= cache.PrevCachedAt {
+		return "", false
+	}
+	resetsAt, err := parseResetTime(cache.ResetsAt)
+	if err != nil {
+		return "", false
+	}
+
+	// 1秒あたりの使用率の増加量（減っている、または変化がない場合は使い切らない）
+	rate := (cache.Utilization - *cache.PrevUtilization) / float64(cache.CachedAt-cache.PrevCachedAt)
+	if rate <= 0 {
+		return "~ok", true
+	}
+	full := time.Unix(cache.CachedAt, 0).Add(time.Duration((100 - cache.Utilization) / rate * float64(time.Second)))
+	if !full.Before(resetsAt) {
+		return "~ok", true
+	}
+	return "~over in " + formatRemaining(full.Sub(sl.now()), nowText), true
+}
+
+// soonestReset は5時間・週間のうち、まだ来ていないリセットのうち最も近いものの枠の名前と残り時間を返す
+// どちらのリセット時刻も不明または過去の場合は ok が false
+func (sl *StatusLine) soonestReset(cache *CacheData, labels segmentLabels) (name string, remaining time.Duration, ok bool) {
+	for _, window := range []struct{ name, resetsAt string }{
+		{"5h", cache.ResetsAt},
+		{labels.week, cache.WeeklyResetsAt},
+	} {
+		t, err := parseResetTime(window.resetsAt)
+		if err != nil {
+			continue
+		}
+		d := t.Sub(sl.now())
+		if d > 0 && (!ok || d < remaining) {
+			name, remaining, ok = window.name, d, true
+		}
+	}
+	return name, remaining, ok
+}
+
+// resetSegmentText はリセットの要素のテキストを返す
+// ResetAsCountdown の場合は "resets in 2h14m" とし、リセット済みの場合は "resets: now" とする
+// labels に key の見出しがある場合は "resets: " や "resets in " の代わりにそれを前置する
+func resetSegmentText(key, label, value string, cfg *Config) string {
+	if value == "" {
+		value = "N/A"
+	}
+	if custom, ok := cfg.Labels[key]; ok {
+		return custom + value
+	}
+	if value == "N/A" {
+		return label + ": N/A"
+	}
+	if cfg.ResetAsCountdown && value != cfg.ResetNowText {
+		return fmt.Sprintf("%s in %s", label, value)
+	}
+	return fmt.Sprintf("%s: %s", label, value)
+}
+
+// weekResetTooFar は週間リセットが hours 時間より先かどうかを判定する
+// hours が0以下、またはリセット時刻が不明な場合は false
+func (sl *StatusLine) weekResetTooFar(resetsAt string, hours int) bool {
+	if hours <= 0 {
+		return false
+	}
+	t, err := parseResetTime(resetsAt)
+	if err != nil {
+		return false
+	}
+	return t.Sub(sl.now()) > time.Duration(hours)*time.Hour
+}
+
+// formatRemaining はリセットまでの残り時間を "2h14m" / "15m" / "<1m" 形式にフォーマット
+// 残り時間が0以下の場合は nowText を返す（負の値は表示しない）
+// 24時間以上の場合は "6d3h" のように日単位で表示
+func formatRemaining(d time.Duration, nowText string) string {
+	if d <= 0 {
+		return nowText
+	}
+	if d < time.Minute {
+		return "<1m"
 	}
 
 	// 分単位で切り上げ
-	t = roundToNearestMinute(t)
+	minutes := int64((d + time.Minute - 1) / time.Minute)
+	days := minutes / (24 * 60)
+	hours := minutes % (24 * 60) / 60
+	mins := minutes % 60
 
-	// ローカル時刻に変換してフォーマット（MM/DD(Day) HH:MM）
-	localTime := t.Local()
-	return localTime.Format("01/02(Mon) 15:04")
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd%dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh%dm", hours, mins)
+	default:
+		return fmt.Sprintf("%dm", mins)
+	}
 }
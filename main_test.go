@@ -2,17 +2,26 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 func TestFormatTokens(t *testing.T) {
@@ -26,7 +35,7 @@ func TestFormatTokens(t *testing.T) {
 		{"exactly 1000", 1000, "1.0k"},
 		{"1500 tokens", 1500, "1.5k"},
 		{"large number", 150000, "150.0k"},
-		{"very large", 1000000, "1000.0k"},
+		{"very large", 1000000, "1.0M"},
 	}
 
 	for _, tt := range tests {
@@ -39,6 +48,76 @@ func TestFormatTokens(t *testing.T) {
 	}
 }
 
+func TestFormatTokensWithUnit(t *testing.T) {
+	tests := []struct {
+		unit     string
+		tokens   int64
+		expected string
+	}{
+		{tokenUnitAuto, 999, "999"},
+		{tokenUnitAuto, 1000, "1.0k"},
+		{tokenUnitAuto, 999949, "999.9k"},
+		{tokenUnitAuto, 999999, "1.0M"},
+		{tokenUnitAuto, 1000000, "1.0M"},
+		{tokenUnitAuto, 1234567, "1.2M"},
+		{tokenUnitK, 999, "999"},
+		{tokenUnitK, 1000, "1.0k"},
+		{tokenUnitK, 999999, "1000.0k"},
+		{tokenUnitK, 1000000, "1000.0k"},
+		{tokenUnitRaw, 999, "999"},
+		{tokenUnitRaw, 1000, "1000"},
+		{tokenUnitRaw, 999999, "999999"},
+		{tokenUnitRaw, 1000000, "1000000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d", tt.unit, tt.tokens), func(t *testing.T) {
+			if result := formatTokensWithUnit(tt.tokens, tt.unit, ""); result != tt.expected {
+				t.Errorf("formatTokensWithUnit(%d, %q) = %s, expected %s", tt.tokens, tt.unit, result, tt.expected)
+			}
+		})
+	}
+
+	t.Run("separators", func(t *testing.T) {
+		tests := []struct {
+			tokens    int64
+			separator string
+			expected  string
+		}{
+			{7, ",", "7"},
+			{999, ",", "999"},
+			{1000, ",", "1,000"},
+			{12000, "_", "12_000"},
+			{100000, ",", "100,000"},
+			{1234567, ",", "1,234,567"},
+			{1234567, "_", "1_234_567"},
+			{1234567890, ",", "1,234,567,890"},
+			{1234567, "", "1234567"},
+		}
+		for _, tt := range tests {
+			if result := formatTokensWithUnit(tt.tokens, tokenUnitRaw, tt.separator); result != tt.expected {
+				t.Errorf("formatTokensWithUnit(%d, raw, %q) = %s, expected %s", tt.tokens, tt.separator, result, tt.expected)
+			}
+		}
+		if result := formatTokensWithUnit(1234567, tokenUnitAuto, ","); result != "1.2M" {
+			t.Errorf("separator should only apply to raw output, got %s", result)
+		}
+		cfg := defaultConfig()
+		cfg.TokenSeparator = "."
+		if warnings := cfg.validate(); len(warnings) != 1 || cfg.TokenSeparator != "" {
+			t.Errorf("validate() = %v, TokenSeparator = %q", warnings, cfg.TokenSeparator)
+		}
+	})
+
+	t.Run("unknown unit falls back to auto", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.TokenUnit = "G"
+		if warnings := cfg.validate(); len(warnings) != 1 || cfg.TokenUnit != tokenUnitAuto {
+			t.Errorf("validate() = %v, TokenUnit = %q", warnings, cfg.TokenUnit)
+		}
+	})
+}
+
 func TestIsCacheValid(t *testing.T) {
 	// history.jsonl の影響を排除するため、常にエラーを返すモック関数を使用
 	sl := NewStatusLine(
@@ -181,6 +260,192 @@ func TestIsCacheValidWithHistoryCheck(t *testing.T) {
 	})
 }
 
+func TestCacheIntervals(t *testing.T) {
+	now := time.Date(2026, 1, 6, 9, 0, 0, 0, time.UTC)
+	cfg := defaultConfig()
+	cfg.CacheTTLSeconds = 300
+	cfg.MinFetchIntervalSeconds = 60
+	if warnings := cfg.validate(); len(warnings) != 0 {
+		t.Fatalf("validate() = %v, expected no warnings", warnings)
+	}
+	// history.jsonl は常に今更新された扱いにし、最小間隔の境界を確認できるようにする
+	newHistory := NewStatusLine(
+		WithConfig(cfg),
+		WithNowFunc(func() time.Time { return now }),
+		WithHistoryModTimeFunc(func() (time.Time, error) { return now, nil }),
+	)
+	oldHistory := NewStatusLine(
+		WithConfig(cfg),
+		WithNowFunc(func() time.Time { return now }),
+		WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }),
+	)
+
+	tests := []struct {
+		name       string
+		sl         *StatusLine
+		age        time.Duration
+		wantValid  bool
+		wantReason string
+	}{
+		{"just under min interval", newHistory, 59 * time.Second, true, "within minimum fetch interval"},
+		{"at min interval", newHistory, 60 * time.Second, false, "history newer"},
+		{"beyond the default poll interval", oldHistory, 3 * time.Minute, true, "history older"},
+		{"just under ttl", oldHistory, 299 * time.Second, true, "history older"},
+		{"at ttl", oldHistory, 300 * time.Second, false, "cache expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := &CacheData{CachedAt: now.Add(-tt.age).Unix(), ResetsAt: "2026-01-06T10:00:00Z"}
+			valid, reason := tt.sl.cacheDecision(cache)
+			if valid != tt.wantValid || reason != tt.wantReason {
+				t.Errorf("cacheDecision() = (%v, %q), expected (%v, %q)", valid, reason, tt.wantValid, tt.wantReason)
+			}
+		})
+	}
+
+	t.Run("invalid values fall back to defaults", func(t *testing.T) {
+		for _, tc := range []struct{ ttl, min int }{{0, 45}, {120, -1}, {60, 60}, {60, 90}} {
+			cfg := defaultConfig()
+			cfg.CacheTTLSeconds = tc.ttl
+			cfg.MinFetchIntervalSeconds = tc.min
+			warnings := cfg.validate()
+			if len(warnings) != 1 || !strings.Contains(warnings[0], "cache intervals") {
+				t.Errorf("validate(ttl=%d, min=%d) = %v, expected a cache intervals warning", tc.ttl, tc.min, warnings)
+			}
+			if cfg.cacheTTL() != pollInterval || cfg.minFetchInterval() != minFetchInterval {
+				t.Errorf("intervals = (%v, %v), expected defaults", cfg.cacheTTL(), cfg.minFetchInterval())
+			}
+		}
+	})
+
+	t.Run("prefetch respects min interval", func(t *testing.T) {
+		configHome := t.TempDir()
+		t.Setenv("XDG_CONFIG_HOME", configHome)
+		if err := os.MkdirAll(filepath.Join(configHome, appName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		configJSON := `{"cache_ttl_seconds":300,"min_fetch_interval_seconds":60}`
+		if err := os.WriteFile(filepath.Join(configHome, appName, "config.json"), []byte(configJSON), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		if err := saveCache(cacheFile, &CacheData{CachedAt: now.Add(-50 * time.Second).Unix(), ResetsAt: "2026-01-06T10:00:00Z"}); err != nil {
+			t.Fatal(err)
+		}
+		sl := NewStatusLine(
+			WithStderr(io.Discard),
+			WithNowFunc(func() time.Time { return now }),
+			WithAccessTokenFunc(func() (string, error) {
+				t.Error("prefetch should not fetch within the configured min interval")
+				return "", errors.New("no token")
+			}),
+		)
+		if err := sl.prefetch(cacheFile); err != nil {
+			t.Fatalf("prefetch failed: %v", err)
+		}
+	})
+}
+
+func TestRoundMinute(t *testing.T) {
+	base := time.Date(2026, 1, 5, 10, 30, 0, 0, time.UTC)
+	down, up := base, base.Add(time.Minute)
+	tests := []struct {
+		mode     string
+		seconds  int
+		expected time.Time
+	}{
+		{resetRoundingNearest, 0, down},
+		{resetRoundingNearest, 29, down},
+		{resetRoundingNearest, 30, up},
+		{resetRoundingNearest, 31, up},
+		{resetRoundingUp, 0, down},
+		{resetRoundingUp, 29, up},
+		{resetRoundingUp, 30, up},
+		{resetRoundingUp, 31, up},
+		{resetRoundingDown, 0, down},
+		{resetRoundingDown, 29, down},
+		{resetRoundingDown, 30, down},
+		{resetRoundingDown, 31, down},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%ds", tt.mode, tt.seconds), func(t *testing.T) {
+			input := base.Add(time.Duration(tt.seconds) * time.Second)
+			if result := roundMinute(input, tt.mode); !result.Equal(tt.expected) {
+				t.Errorf("roundMinute(%v, %q) = %v, expected %v", input, tt.mode, result, tt.expected)
+			}
+		})
+	}
+
+	t.Run("formatted reset times", func(t *testing.T) {
+		resetsAt := "2026-01-05T10:30:29Z"
+		for mode, want := range map[string]string{resetRoundingNearest: "10:30", resetRoundingUp: "10:31", resetRoundingDown: "10:30"} {
+			if got := formatResetTimeIn(resetsAt, defaultResetTimeLayout, time.UTC, mode); got != want {
+				t.Errorf("formatResetTimeIn(%s, %q) = %s, expected %s", resetsAt, mode, got, want)
+			}
+		}
+		if got := formatResetTimeIn(resetsAt, defaultWeeklyResetTimeLayout, time.UTC, resetRoundingUp); got != "01/05(Mon) 10:31" {
+			t.Errorf("weekly reset with up rounding = %s, expected 01/05(Mon) 10:31", got)
+		}
+	})
+
+	t.Run("unknown mode falls back to nearest", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.ResetRounding = "ceil"
+		if warnings := cfg.validate(); len(warnings) != 1 || cfg.ResetRounding != resetRoundingNearest {
+			t.Errorf("validate() = %v, ResetRounding = %q", warnings, cfg.ResetRounding)
+		}
+	})
+}
+
+func TestResetPrecision(t *testing.T) {
+	render := func(t *testing.T, precision string) string {
+		t.Helper()
+		cfg := defaultConfig()
+		cfg.NoColor = true
+		cfg.Timezone = "UTC"
+		cfg.ResetPrecision = precision
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }))
+		// 10:30:45 と 01/09 10:30:15（UTC）
+		input := `{"model":{"display_name":"Opus"},"rate_limits":{"five_hour":{"used_percentage":10.0,"resets_at":1767609045},"seven_day":{"used_percentage":5.0,"resets_at":1767954615}}}`
+		if err := sl.runWithConfig(strings.NewReader(input), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		return stdout.String()
+	}
+
+	t.Run("second", func(t *testing.T) {
+		out := render(t, resetPrecisionSecond)
+		for _, want := range []string{"resets: 10:30:45", "resets: 01/09(Fri) 10:30:15"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("output should contain %q, got: %q", want, out)
+			}
+		}
+	})
+
+	t.Run("minute rounds as before", func(t *testing.T) {
+		out := render(t, resetPrecisionMinute)
+		for _, want := range []string{"resets: 10:31 |", "resets: 01/09(Fri) 10:30"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("output should contain %q, got: %q", want, out)
+			}
+		}
+		if strings.Contains(out, "10:30:45") {
+			t.Errorf("minute precision should not show seconds, got: %q", out)
+		}
+	})
+
+	t.Run("custom layouts are kept", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.ResetPrecision = resetPrecisionSecond
+		cfg.ResetTimeLayout = "3:04:05 PM"
+		layout, weeklyLayout, rounding := cfg.resetTimeFormat()
+		if layout != "3:04:05 PM" || weeklyLayout != secondWeeklyResetTimeLayout || rounding != resetRoundingNone {
+			t.Errorf("resetTimeFormat() = (%q, %q, %q)", layout, weeklyLayout, rounding)
+		}
+	})
+}
+
 func TestRoundToNearestMinute(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -286,6 +551,20 @@ func TestFormatResetTime(t *testing.T) {
 	}
 }
 
+func TestFormatResetTimeEpoch(t *testing.T) {
+	// 2026-01-05T10:30:00Z をエポック秒で表したもの
+	epoch := int64(1767609000)
+	resetsAt := strconv.FormatInt(epoch, 10)
+	local := time.Unix(epoch, 0).Local()
+
+	if got, want := formatResetTime(resetsAt), local.Format("15:04"); got != want {
+		t.Errorf("formatResetTime(%s) = %s, expected %s", resetsAt, got, want)
+	}
+	if got, want := formatResetTimeWithDate(resetsAt), local.Format("01/02(Mon) 15:04"); got != want {
+		t.Errorf("formatResetTimeWithDate(%s) = %s, expected %s", resetsAt, got, want)
+	}
+}
+
 func TestFormatResetTimeWithDate(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -652,6 +931,68 @@ func TestAPIResponseParsing(t *testing.T) {
 	})
 }
 
+func TestParseAPIResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantReset  string
+		wantUtil   float64
+		wantWeekly float64
+	}{
+		{
+			name:       "flat shape",
+			body:       `{"five_hour":{"resets_at":"2026-01-05T10:30:00Z","utilization":40.0},"seven_day":{"resets_at":"2026-01-09T10:30:00Z","utilization":10.0}}`,
+			wantReset:  "2026-01-05T10:30:00Z",
+			wantUtil:   40.0,
+			wantWeekly: 10.0,
+		},
+		{
+			name:       "data-wrapped shape",
+			body:       `{"data":{"five_hour":{"resets_at":"2026-01-05T10:30:00Z","utilization":41.0},"seven_day":{"resets_at":"2026-01-09T10:30:00Z","utilization":11.0}}}`,
+			wantReset:  "2026-01-05T10:30:00Z",
+			wantUtil:   41.0,
+			wantWeekly: 11.0,
+		},
+		{
+			name:       "epoch-seconds reset times",
+			body:       `{"five_hour":{"resets_at":1767609000,"utilization":43.0},"seven_day":{"resets_at":1767955800,"utilization":12.0}}`,
+			wantReset:  "2026-01-05T10:30:00Z",
+			wantUtil:   43.0,
+			wantWeekly: 12.0,
+		},
+		{
+			name:      "null data falls back to flat shape",
+			body:      `{"data":null,"five_hour":{"resets_at":"2026-01-05T10:30:00Z","utilization":42.0}}`,
+			wantReset: "2026-01-05T10:30:00Z",
+			wantUtil:  42.0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := parseAPIResponse([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("parseAPIResponse failed: %v", err)
+			}
+			if resp.FiveHour.ResetsAt != tt.wantReset {
+				t.Errorf("FiveHour.ResetsAt = %s, expected %s", resp.FiveHour.ResetsAt, tt.wantReset)
+			}
+			if resp.FiveHour.Utilization != tt.wantUtil {
+				t.Errorf("FiveHour.Utilization = %f, expected %f", resp.FiveHour.Utilization, tt.wantUtil)
+			}
+			if resp.SevenDay.Utilization != tt.wantWeekly {
+				t.Errorf("SevenDay.Utilization = %f, expected %f", resp.SevenDay.Utilization, tt.wantWeekly)
+			}
+		})
+	}
+
+	t.Run("invalid JSON", func(t *testing.T) {
+		if _, err := parseAPIResponse([]byte("invalid json")); err == nil {
+			t.Error("parseAPIResponse should fail on invalid JSON")
+		}
+	})
+}
+
 func TestCacheDataValidation(t *testing.T) {
 	// history.jsonl の影響を排除
 	sl := NewStatusLine(
@@ -1017,13 +1358,13 @@ func TestGetCachedOrFetch(t *testing.T) {
 			t.Errorf("WeeklyUtilization = %f, expected 25.0", cache.WeeklyUtilization)
 		}
 
-		// CachedAt が更新されていること（再リクエスト防止）
+		// Retry-After の時刻が記録されていること（再リクエスト防止）
 		updatedCache, err := readCache(cacheFile)
 		if err != nil {
 			t.Fatalf("failed to read updated cache: %v", err)
 		}
-		if updatedCache.CachedAt <= staleCache.CachedAt {
-			t.Error("CachedAt should be updated to prevent immediate re-request")
+		if d := updatedCache.RetryAfter - time.Now().Unix(); d < 28 || d > 31 {
+			t.Errorf("RetryAfter should be about 30s ahead, got %ds", d)
 		}
 	})
 
@@ -1126,7 +1467,7 @@ func TestGetHistoryModTime(t *testing.T) {
 func TestGetAccessTokenFromKeychain(t *testing.T) {
 	t.Run("successful keychain response", func(t *testing.T) {
 		sl := NewStatusLine(
-			WithExecCommand(func(name string, arg ...string) *exec.Cmd {
+			WithExecCommand(func(ctx context.Context, name string, arg ...string) *exec.Cmd {
 				// 正常なJSONを返すモックコマンド
 				creds := `{"claudeAiOauth":{"accessToken":"keychain-token"}}`
 				return exec.Command("echo", "-n", creds)
@@ -1144,7 +1485,7 @@ func TestGetAccessTokenFromKeychain(t *testing.T) {
 
 	t.Run("keychain command fails", func(t *testing.T) {
 		sl := NewStatusLine(
-			WithExecCommand(func(name string, arg ...string) *exec.Cmd {
+			WithExecCommand(func(ctx context.Context, name string, arg ...string) *exec.Cmd {
 				return exec.Command("false") // 常に失敗するコマンド
 			}),
 		)
@@ -1157,7 +1498,7 @@ func TestGetAccessTokenFromKeychain(t *testing.T) {
 
 	t.Run("invalid JSON from keychain", func(t *testing.T) {
 		sl := NewStatusLine(
-			WithExecCommand(func(name string, arg ...string) *exec.Cmd {
+			WithExecCommand(func(ctx context.Context, name string, arg ...string) *exec.Cmd {
 				return exec.Command("echo", "-n", "invalid json")
 			}),
 		)
@@ -1170,7 +1511,7 @@ func TestGetAccessTokenFromKeychain(t *testing.T) {
 
 	t.Run("empty access token from keychain", func(t *testing.T) {
 		sl := NewStatusLine(
-			WithExecCommand(func(name string, arg ...string) *exec.Cmd {
+			WithExecCommand(func(ctx context.Context, name string, arg ...string) *exec.Cmd {
 				creds := `{"claudeAiOauth":{"accessToken":""}}`
 				return exec.Command("echo", "-n", creds)
 			}),
@@ -1181,6 +1522,24 @@ func TestGetAccessTokenFromKeychain(t *testing.T) {
 			t.Error("should fail on empty access token")
 		}
 	})
+
+	t.Run("hung keychain command times out", func(t *testing.T) {
+		sl := NewStatusLine(
+			WithKeychainTimeout(100*time.Millisecond),
+			WithExecCommand(func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+				return exec.CommandContext(ctx, "sleep", "10")
+			}),
+		)
+
+		start := time.Now()
+		_, err := sl.getAccessTokenFromKeychain()
+		if err == nil || !strings.Contains(err.Error(), "timed out") {
+			t.Errorf("error = %v, expected a timeout", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("lookup took %v, expected it to stop at the timeout", elapsed)
+		}
+	})
 }
 
 func TestGetAccessTokenFromFile(t *testing.T) {
@@ -1433,6 +1792,44 @@ func TestFetchFromAPI(t *testing.T) {
 		}
 	})
 
+	t.Run("data-wrapped API response", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{
+				"data": {
+					"five_hour": {"resets_at": "2026-01-27T10:00:00Z", "utilization": 33.0},
+					"seven_day": {"resets_at": "2026-01-30T10:00:00Z", "utilization": 12.0}
+				}
+			}`))
+		}))
+		defer server.Close()
+
+		tmpDir := t.TempDir()
+		cacheFile := filepath.Join(tmpDir, "cache.json")
+
+		sl := NewStatusLine(
+			WithHTTPClient(server.Client()),
+			WithAccessTokenFunc(func() (string, error) {
+				return "test-token", nil
+			}),
+		)
+
+		cache, err := sl.fetchFromAPI(cacheFile, server.URL)
+		if err != nil {
+			t.Fatalf("fetchFromAPI failed: %v", err)
+		}
+
+		if cache.ResetsAt != "2026-01-27T10:00:00Z" {
+			t.Errorf("ResetsAt = %s, expected 2026-01-27T10:00:00Z", cache.ResetsAt)
+		}
+		if cache.Utilization != 33.0 {
+			t.Errorf("Utilization = %f, expected 33.0", cache.Utilization)
+		}
+		if cache.WeeklyUtilization != 12.0 {
+			t.Errorf("WeeklyUtilization = %f, expected 12.0", cache.WeeklyUtilization)
+		}
+	})
+
 	t.Run("429 with Retry-After header returns RateLimitError", func(t *testing.T) {
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Retry-After", "30")
@@ -1648,11 +2045,81 @@ func TestRunWithConfigUsageWarnings(t *testing.T) {
 			t.Fatalf("runWithConfig failed: %v", err)
 		}
 
-		if !strings.Contains(stderr.String(), "warning: unexpected weekly usage value") {
+		if !strings.Contains(stderr.String(), "warning: unexpected usage value: week=-3.0") {
 			t.Errorf("stderr should contain weekly warning, got: %s", stderr.String())
 		}
 	})
 
+	t.Run("coalesces warnings for both windows", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		cacheFile := filepath.Join(tmpDir, "cache.json")
+		saveCache(cacheFile, &CacheData{
+			ResetsAt:          "2026-01-27T10:00:00Z",
+			Utilization:       120.0,
+			WeeklyUtilization: 130.0,
+			CachedAt:          time.Now().Unix() - 10,
+		})
+
+		stderr := &bytes.Buffer{}
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(
+			WithStderr(stderr),
+			WithHistoryModTimeFunc(func() (time.Time, error) {
+				return time.Time{}, os.ErrNotExist
+			}),
+		)
+
+		cfg := defaultConfig()
+		err := sl.runWithConfig(makeInput(), stdout, cacheFile, cfg)
+		if err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+
+		if count := strings.Count(stderr.String(), "warning"); count != 1 {
+			t.Errorf("expected a single combined warning, got %d: %s", count, stderr.String())
+		}
+		if !strings.Contains(stderr.String(), "5h=120.0, week=130.0") {
+			t.Errorf("warning should list both windows, got: %s", stderr.String())
+		}
+		if !strings.Contains(stdout.String(), "[████████████████████]") {
+			t.Errorf("bar should be clamped to full, got: %s", stdout.String())
+		}
+	})
+
+	t.Run("ClampSilently suppresses warnings but still clamps", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		cacheFile := filepath.Join(tmpDir, "cache.json")
+		saveCache(cacheFile, &CacheData{
+			ResetsAt:          "2026-01-27T10:00:00Z",
+			Utilization:       120.0,
+			WeeklyUtilization: -10.0,
+			CachedAt:          time.Now().Unix() - 10,
+		})
+
+		stderr := &bytes.Buffer{}
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(
+			WithStderr(stderr),
+			WithHistoryModTimeFunc(func() (time.Time, error) {
+				return time.Time{}, os.ErrNotExist
+			}),
+		)
+
+		cfg := defaultConfig()
+		cfg.ClampSilently = true
+		err := sl.runWithConfig(makeInput(), stdout, cacheFile, cfg)
+		if err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+
+		if stderr.Len() > 0 {
+			t.Errorf("stderr should be empty with ClampSilently, got: %s", stderr.String())
+		}
+		if !strings.Contains(stdout.String(), "[████████████████████]") {
+			t.Errorf("bar should be clamped to full, got: %s", stdout.String())
+		}
+	})
+
 	t.Run("no warning for normal usage", func(t *testing.T) {
 		tmpDir := t.TempDir()
 		cacheFile := filepath.Join(tmpDir, "cache.json")
@@ -1955,6 +2422,25 @@ func TestLoadConfig(t *testing.T) {
 		}
 	})
 
+	t.Run("loads config with a UTF-8 BOM", func(t *testing.T) {
+		configPath := filepath.Join(t.TempDir(), "config.json")
+		configJSON := "\xef\xbb\xbf" + `{"show_model": false, "bar_width": 10}`
+		if err := os.WriteFile(configPath, []byte(configJSON), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, err := loadConfigFromPath(configPath)
+		if err != nil {
+			t.Fatalf("loadConfigFromPath failed: %v", err)
+		}
+		if cfg.ShowModel {
+			t.Error("ShowModel should be false")
+		}
+		if cfg.BarWidth != 10 {
+			t.Errorf("BarWidth should be 10, got %d", cfg.BarWidth)
+		}
+	})
+
 	t.Run("loads config from file", func(t *testing.T) {
 		tmpDir := t.TempDir()
 		configPath := filepath.Join(tmpDir, "config.json")
@@ -2041,6 +2527,7 @@ func TestColorizeUsageWithBarWidth(t *testing.T) {
 		{"width 5 at 50%", 50.0, 5, "[██▅  ]"},
 		{"width 15 at 0%", 0.0, 15, "[               ]"},
 		{"width 10 at 100%", 100.0, 10, "[██████████]"},
+		{"negative width uses default", 50.0, -3, "[██████████          ]"},
 	}
 
 	for _, tt := range tests {
@@ -2051,6 +2538,24 @@ func TestColorizeUsageWithBarWidth(t *testing.T) {
 			}
 		})
 	}
+
+	t.Run("width 0 is percentage only", func(t *testing.T) {
+		result := colorizeUsageWithWidth(50.0, 0)
+		if want := colorOrange + "50.0%" + colorReset; result != want {
+			t.Errorf("result = %q, expected %q", result, want)
+		}
+	})
+
+	t.Run("negative width warns and defaults", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.BarWidth = -3
+		if warnings := cfg.validate(); len(warnings) != 1 || !strings.Contains(warnings[0], "bar_width") {
+			t.Errorf("validate() = %v, expected a bar_width warning", warnings)
+		}
+		if cfg.BarWidth != barWidth {
+			t.Errorf("BarWidth = %d, expected %d", cfg.BarWidth, barWidth)
+		}
+	})
 }
 
 func TestGetConfigDir(t *testing.T) {
@@ -2745,3 +3250,6080 @@ func TestRunWithEffortThinkingStyleDisplay(t *testing.T) {
 		}
 	})
 }
+
+func TestRefreshOnModelChange(t *testing.T) {
+	tmpDir := t.TempDir()
+	cacheFile := filepath.Join(tmpDir, "cache.json")
+
+	fetchCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetchCount++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":40.0}}`))
+	}))
+	defer server.Close()
+
+	sl := NewStatusLine(
+		WithHTTPClient(server.Client()),
+		WithAccessTokenFunc(func() (string, error) {
+			return "test-token", nil
+		}),
+		WithHistoryModTimeFunc(func() (time.Time, error) {
+			return time.Time{}, os.ErrNotExist
+		}),
+	)
+	cfg := defaultConfig()
+	cfg.RefreshOnModelChange = true
+
+	// キャッシュを minFetchInterval より古くする
+	ageCache := func() {
+		t.Helper()
+		cache, err := readCache(cacheFile)
+		if err != nil {
+			t.Fatalf("failed to read cache: %v", err)
+		}
+		cache.CachedAt = time.Now().Unix() - 60
+		if err := saveCache(cacheFile, cache); err != nil {
+			t.Fatalf("failed to save cache: %v", err)
+		}
+	}
+
+	runModel := func(model string) {
+		t.Helper()
+		sl.model = model
+		sl.cfg = cfg
+		if _, err := sl.getCachedOrFetch(cacheFile, server.URL); err != nil {
+			t.Fatalf("getCachedOrFetch failed: %v", err)
+		}
+	}
+
+	runModel("Sonnet 4")
+	if fetchCount != 1 {
+		t.Fatalf("fetchCount = %d, expected 1 after first run", fetchCount)
+	}
+
+	cache, err := readCache(cacheFile)
+	if err != nil {
+		t.Fatalf("failed to read cache: %v", err)
+	}
+	if cache.LastModel != "Sonnet 4" {
+		t.Errorf("LastModel = %q, expected %q", cache.LastModel, "Sonnet 4")
+	}
+
+	// 同じモデルでは再取得しない
+	ageCache()
+	runModel("Sonnet 4")
+	if fetchCount != 1 {
+		t.Errorf("fetchCount = %d, expected 1 when model is unchanged", fetchCount)
+	}
+
+	// モデルが変わると再取得する
+	runModel("Opus 4")
+	if fetchCount != 2 {
+		t.Errorf("fetchCount = %d, expected 2 after model change", fetchCount)
+	}
+
+	// minFetchInterval 以内はモデルが変わっても再取得しない
+	runModel("Haiku 4")
+	if fetchCount != 2 {
+		t.Errorf("fetchCount = %d, expected 2 within minFetchInterval", fetchCount)
+	}
+
+	// 設定が無効ならモデル変更でも再取得しない
+	cfg.RefreshOnModelChange = false
+	ageCache()
+	runModel("Sonnet 4")
+	if fetchCount != 2 {
+		t.Errorf("fetchCount = %d, expected 2 when RefreshOnModelChange is disabled", fetchCount)
+	}
+}
+
+func TestFormatRemaining(t *testing.T) {
+	tests := []struct {
+		name     string
+		d        time.Duration
+		nowText  string
+		expected string
+	}{
+		{"just passed reset", -1 * time.Second, "now", "now"},
+		{"long past reset", -3 * time.Minute, "now", "now"},
+		{"exactly now", 0, "now", "now"},
+		{"custom now text", -10 * time.Second, "soon", "soon"},
+		{"sub-minute", 30 * time.Second, "now", "<1m"},
+		{"exactly one minute", time.Minute, "now", "1m"},
+		{"rounds up to the minute", 14*time.Minute + 1*time.Second, "now", "15m"},
+		{"multi-hour", 2*time.Hour + 13*time.Minute + 30*time.Second, "now", "2h14m"},
+		{"multi-day", 6*24*time.Hour + 3*time.Hour, "now", "6d3h"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := formatRemaining(tt.d, tt.nowText)
+			if result != tt.expected {
+				t.Errorf("formatRemaining(%v, %q) = %q, expected %q", tt.d, tt.nowText, result, tt.expected)
+			}
+			if strings.HasPrefix(result, "-") {
+				t.Errorf("formatRemaining(%v) should never be negative, got %q", tt.d, result)
+			}
+		})
+	}
+}
+
+func TestNotifyAboveThreshold(t *testing.T) {
+	noopHistoryMod := WithHistoryModTimeFunc(func() (time.Time, error) {
+		return time.Time{}, os.ErrNotExist
+	})
+
+	render := func(t *testing.T, cacheFile string, cfg *Config, usage float64) string {
+		t.Helper()
+		inputJSON := fmt.Sprintf(`{
+			"model": {"display_name": "Sonnet 4"},
+			"rate_limits": {"five_hour": {"used_percentage": %.1f, "resets_at": 1743580800}}
+		}`, usage)
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(noopHistoryMod)
+		if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, cacheFile, cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		return stdout.String()
+	}
+
+	t.Run("bell fires only on upward crossing", func(t *testing.T) {
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		cfg := defaultConfig()
+		cfg.NotifyAbove = 90
+
+		sequence := []struct {
+			usage    float64
+			wantBell bool
+		}{
+			{85, false}, // 閾値未満
+			{92, true},  // 上方向に通過
+			{95, false}, // 閾値以上のまま
+			{80, false}, // 下方向に通過
+			{91, true},  // 再度上方向に通過
+		}
+
+		bells := 0
+		for i, step := range sequence {
+			out := render(t, cacheFile, cfg, step.usage)
+			count := strings.Count(out, "\a")
+			bells += count
+			if step.wantBell && count != 1 {
+				t.Errorf("step %d (%.1f%%): expected exactly one bell, got %d", i, step.usage, count)
+			}
+			if !step.wantBell && count != 0 {
+				t.Errorf("step %d (%.1f%%): expected no bell, got %d", i, step.usage, count)
+			}
+			if step.wantBell && !strings.HasPrefix(out, "\a") {
+				t.Errorf("step %d: bell should precede the status line, got %q", i, out)
+			}
+		}
+		if bells != 2 {
+			t.Errorf("total bells = %d, expected 2", bells)
+		}
+	})
+
+	t.Run("osc9 notification", func(t *testing.T) {
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		cfg := defaultConfig()
+		cfg.NotifyAbove = 90
+		cfg.NotifyMethod = notifyMethodOSC9
+
+		out := render(t, cacheFile, cfg, 93)
+		if strings.Count(out, "\033]9;") != 1 {
+			t.Errorf("expected one OSC 9 sequence, got %q", out)
+		}
+
+		out = render(t, cacheFile, cfg, 94)
+		if strings.Contains(out, "\033]9;") {
+			t.Errorf("OSC 9 should not repeat while above threshold, got %q", out)
+		}
+	})
+
+	t.Run("state is kept in the state file", func(t *testing.T) {
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		cfg := defaultConfig()
+		cfg.NotifyAbove = 90
+
+		if out := render(t, cacheFile, cfg, 92); strings.Count(out, "\a") != 1 {
+			t.Fatalf("expected one bell, got %q", out)
+		}
+		if fileExists(cacheFile) {
+			t.Error("notify state should not be written to the cache file")
+		}
+		if !readState(stateFilePath(cacheFile)).AboveNotify {
+			t.Error("notify state should be saved in the state file")
+		}
+
+		// 取得でキャッシュが書き換えられても状態は失われない
+		if err := saveCache(cacheFile, &CacheData{ResetsAt: "2026-01-27T12:00:00Z", Utilization: 95.0, CachedAt: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if out := render(t, cacheFile, cfg, 95); strings.Contains(out, "\a") {
+			t.Errorf("bell should not repeat after the cache is rewritten, got %q", out)
+		}
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		out := render(t, cacheFile, defaultConfig(), 99)
+		if strings.Contains(out, "\a") {
+			t.Errorf("no notification expected when NotifyAbove is 0, got %q", out)
+		}
+	})
+}
+
+func TestWeekLabel(t *testing.T) {
+	noopHistoryMod := WithHistoryModTimeFunc(func() (time.Time, error) {
+		return time.Time{}, os.ErrNotExist
+	})
+	inputJSON := `{
+		"model": {"display_name": "Sonnet 4"},
+		"rate_limits": {
+			"five_hour": {"used_percentage": 10.0, "resets_at": 1743580800},
+			"seven_day": {"used_percentage": 20.0, "resets_at": 1744185600}
+		}
+	}`
+
+	tests := []struct {
+		name      string
+		weekLabel string
+		want      string
+	}{
+		{"default label", defaultWeekLabel, "week: "},
+		{"custom label", "7d", "7d: "},
+		{"empty label falls back to default", "", "week: "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.WeekLabel = tt.weekLabel
+			stdout := &bytes.Buffer{}
+			sl := NewStatusLine(noopHistoryMod)
+			if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+				t.Fatalf("runWithConfig failed: %v", err)
+			}
+			if !strings.Contains(stdout.String(), tt.want) {
+				t.Errorf("output should contain %q, got: %s", tt.want, stdout.String())
+			}
+		})
+	}
+}
+
+func TestColorizeUsageWithBandTicks(t *testing.T) {
+	tests := []struct {
+		name  string
+		usage float64
+		want  string
+	}{
+		{"empty bar shows all ticks", 0.0, "[     |    |    |    ]"},
+		{"ticks are not drawn over filled blocks", 30.0, "[██████    |    |    ]"},
+		{"ticks are not drawn over the shade", 50.5, "[██████████▁    |    ]"},
+		{"tick right after the filled part", 73.0, "[██████████████▅|    ]"},
+		{"full bar has no visible ticks", 100.0, "[████████████████████]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := colorizeUsageWithStyle(tt.usage, barStyle{width: 20, bandTicks: true})
+			if !strings.Contains(result, tt.want) {
+				t.Errorf("result should contain %q, got: %q", tt.want, result)
+			}
+		})
+	}
+
+	t.Run("no ticks when disabled", func(t *testing.T) {
+		result := colorizeUsageWithStyle(0.0, barStyle{width: 20})
+		if strings.Contains(result, "|") {
+			t.Errorf("result should not contain ticks, got: %q", result)
+		}
+	})
+}
+
+func TestConcurrentFetch(t *testing.T) {
+	newServer := func(count *int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(count, 1)
+			time.Sleep(100 * time.Millisecond)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":40.0}}`))
+		}))
+	}
+
+	fetchConcurrently := func(t *testing.T) int32 {
+		t.Helper()
+		var count int32
+		server := newServer(&count)
+		defer server.Close()
+
+		sl := NewStatusLine(
+			WithHTTPClient(server.Client()),
+			WithAccessTokenFunc(func() (string, error) {
+				return "test-token", nil
+			}),
+			WithHistoryModTimeFunc(func() (time.Time, error) {
+				return time.Time{}, os.ErrNotExist
+			}),
+		)
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				cache, err := sl.getCachedOrFetch(cacheFile, server.URL)
+				if err != nil {
+					t.Errorf("getCachedOrFetch failed: %v", err)
+					return
+				}
+				if cache.Utilization != 40.0 {
+					t.Errorf("Utilization = %f, expected 40.0", cache.Utilization)
+				}
+			}()
+		}
+		wg.Wait()
+		return atomic.LoadInt32(&count)
+	}
+
+	t.Run("concurrent calls are serialized by the fetch lock", func(t *testing.T) {
+		// 後から来た呼び出しはロックの解放を待ち、先の呼び出しが書き込んだキャッシュを使う
+		if count := fetchConcurrently(t); count != 1 {
+			t.Errorf("API called %d times, expected 1", count)
+		}
+	})
+
+	// 強制更新は有効なキャッシュでも取得し直すため、重複した呼び出しをまとめるのは debounce_millis だけ
+	refreshConcurrently := func(t *testing.T, debounceMillis int) int32 {
+		t.Helper()
+		var count int32
+		server := newServer(&count)
+		defer server.Close()
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// 別プロセスを想定し、呼び出しごとに StatusLine を作る
+				cfg := defaultConfig()
+				cfg.DebounceMillis = debounceMillis
+				sl := NewStatusLine(
+					WithConfig(cfg),
+					WithForceRefresh(true),
+					WithStderr(io.Discard),
+					WithHTTPClient(server.Client()),
+					WithAccessTokenFunc(func() (string, error) { return "test-token", nil }),
+					WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }),
+				)
+				if _, err := sl.getCachedOrFetch(cacheFile, server.URL); err != nil {
+					t.Errorf("getCachedOrFetch failed: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		return atomic.LoadInt32(&count)
+	}
+
+	t.Run("forced refreshes within the debounce window fetch once", func(t *testing.T) {
+		if count := refreshConcurrently(t, 2000); count != 1 {
+			t.Errorf("API called %d times, expected 1", count)
+		}
+	})
+
+	t.Run("forced refreshes fetch each time without debounce", func(t *testing.T) {
+		if count := refreshConcurrently(t, 0); count != 2 {
+			t.Errorf("API called %d times, expected 2", count)
+		}
+	})
+
+	t.Run("cache older than the debounce window is fetched again", func(t *testing.T) {
+		var count int32
+		server := newServer(&count)
+		defer server.Close()
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		if err := saveCache(cacheFile, &CacheData{ResetsAt: "2026-01-27T12:00:00Z", Utilization: 10.0, CachedAt: time.Now().Unix()}); err != nil {
+			t.Fatal(err)
+		}
+		old := time.Now().Add(-time.Second)
+		if err := os.Chtimes(cacheFile, old, old); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := defaultConfig()
+		cfg.DebounceMillis = 500
+		sl := NewStatusLine(
+			WithConfig(cfg),
+			WithForceRefresh(true),
+			WithStderr(io.Discard),
+			WithHTTPClient(server.Client()),
+			WithAccessTokenFunc(func() (string, error) { return "test-token", nil }),
+			WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }),
+		)
+		cache, err := sl.getCachedOrFetch(cacheFile, server.URL)
+		if err != nil {
+			t.Fatalf("getCachedOrFetch failed: %v", err)
+		}
+		if count != 1 || cache.Utilization != 40.0 {
+			t.Errorf("API called %d times with utilization %.1f, expected a fresh fetch", count, cache.Utilization)
+		}
+	})
+}
+
+func TestASCIIOnly(t *testing.T) {
+	t.Run("bar uses ASCII characters without shades", func(t *testing.T) {
+		result := colorizeUsageWithStyle(33.0, barStyle{width: 10, ascii: true})
+		if !strings.Contains(result, "[###-------]") {
+			t.Errorf("result should contain ASCII bar, got: %q", result)
+		}
+	})
+
+	t.Run("rendered line contains only ASCII bytes", func(t *testing.T) {
+		inputJSON := `{
+			"model": {"display_name": "Opus 4.8 ✨"},
+			"context_window": {"total_input_tokens": 1000, "total_output_tokens": 500, "used_percentage": 12.3},
+			"rate_limits": {
+				"five_hour": {"used_percentage": 42.5, "resets_at": 1743580800},
+				"seven_day": {"used_percentage": 15.7, "resets_at": 1744185600}
+			}
+		}`
+		cfg := defaultConfig()
+		cfg.ASCIIOnly = true
+		cfg.ShowBandTicks = true
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(WithHistoryModTimeFunc(func() (time.Time, error) {
+			return time.Time{}, os.ErrNotExist
+		}))
+		if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+
+		out := stdout.Bytes()
+		for i, b := range out {
+			if b >= 0x80 {
+				t.Fatalf("output contains non-ASCII byte 0x%x at %d: %q", b, i, out)
+			}
+		}
+		if !strings.Contains(stdout.String(), "Model: Opus 4.8") {
+			t.Errorf("output should keep the ASCII part of the model name, got: %s", stdout.String())
+		}
+	})
+
+	t.Run("health dot and sparkline have ASCII replacements", func(t *testing.T) {
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		if err := saveCache(cacheFile, &CacheData{
+			ResetsAt: "2099-01-01T00:00:00Z", Utilization: 60.0, CachedAt: time.Now().Unix(),
+			Samples: []float64{0, 30, 60},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		cfg := defaultConfig()
+		cfg.ASCIIOnly = true
+		cfg.NoColor = true
+		cfg.ShowHealthDot = true
+		cfg.ShowSparkline = true
+		cfg.ShowAppName = false
+		cfg.ShowTokens = false
+		cfg.ShowContextUsage = false
+		cfg.Show5hResets = false
+		cfg.ShowWeekUsage = false
+		cfg.ShowWeekResets = false
+		cfg.BarWidth = 0
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(
+			WithStderr(io.Discard),
+			WithHistoryModTimeFunc(func() (time.Time, error) { return time.Now(), nil }),
+		)
+		if err := sl.runWithConfig(strings.NewReader(`{"model": {"display_name": "Opus"}}`), stdout, cacheFile, cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		if got, want := stdout.String(), "* | Model: Opus | 5h: 60.0% | _-+\n"; got != want {
+			t.Errorf("output = %q, expected %q", got, want)
+		}
+	})
+
+	t.Run("segments left empty are dropped with their separators", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.ASCIIOnly = true
+		parts := asciiSegments([]segment{
+			{key: segApp, text: "🤖"},
+			{key: segModel, text: "Model: Opus"},
+			{key: segSparkline, text: colorGreen + "▁▂" + colorReset},
+			{key: seg5h, text: "5h: 10%"},
+		})
+		if got, want := joinSegments(parts, cfg), "Model: Opus | 5h: 10%"; got != want {
+			t.Errorf("joined line = %q, expected %q", got, want)
+		}
+	})
+}
+
+func TestAPIQuery(t *testing.T) {
+	t.Run("buildRequestURL encodes parameters", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			endpoint string
+			query    map[string]string
+			expected string
+		}{
+			{"no query", "https://example.com/usage", nil, "https://example.com/usage"},
+			{"simple parameter", "https://example.com/usage", map[string]string{"window": "all"}, "https://example.com/usage?window=all"},
+			{"special characters are escaped", "https://example.com/usage", map[string]string{"q": "a b&c=d/é"}, "https://example.com/usage?q=a+b%26c%3Dd%2F%C3%A9"},
+			{"keeps existing query", "https://example.com/usage?v=1", map[string]string{"window": "all"}, "https://example.com/usage?v=1&window=all"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				result, err := buildRequestURL(tt.endpoint, tt.query)
+				if err != nil {
+					t.Fatalf("buildRequestURL failed: %v", err)
+				}
+				if result != tt.expected {
+					t.Errorf("buildRequestURL() = %s, expected %s", result, tt.expected)
+				}
+			})
+		}
+	})
+
+	t.Run("fetchFromAPI sends configured query parameters", func(t *testing.T) {
+		var gotQuery string
+		var gotWindow, gotFilter string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotQuery = r.URL.RawQuery
+			gotWindow = r.URL.Query().Get("window")
+			gotFilter = r.URL.Query().Get("filter")
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":40.0}}`))
+		}))
+		defer server.Close()
+
+		cfg := defaultConfig()
+		cfg.APIQuery = map[string]string{"window": "all", "filter": "a&b c"}
+		sl := NewStatusLine(
+			WithHTTPClient(server.Client()),
+			WithAccessTokenFunc(func() (string, error) {
+				return "test-token", nil
+			}),
+			WithConfig(cfg),
+		)
+
+		if _, err := sl.fetchFromAPI(filepath.Join(t.TempDir(), "cache.json"), server.URL); err != nil {
+			t.Fatalf("fetchFromAPI failed: %v", err)
+		}
+		if gotWindow != "all" {
+			t.Errorf("window = %q, expected %q", gotWindow, "all")
+		}
+		if gotFilter != "a&b c" {
+			t.Errorf("filter = %q, expected %q", gotFilter, "a&b c")
+		}
+		if !strings.Contains(gotQuery, "filter=a%26b+c") {
+			t.Errorf("raw query should contain escaped filter, got: %s", gotQuery)
+		}
+	})
+}
+
+func TestQuantizeUsage(t *testing.T) {
+	tests := []struct {
+		name     string
+		usage    float64
+		steps    int
+		wantText string
+		wantBar  string
+	}{
+		{"quarters: 0%", 0.0, 4, "0/4 ", "[        ]"},
+		{"quarters: 10% rounds down", 10.0, 4, "0/4 ", "[        ]"},
+		{"quarters: 13% rounds up", 13.0, 4, "1/4 ", "[██      ]"},
+		{"quarters: 45%", 45.0, 4, "2/4 ", "[████    ]"},
+		{"quarters: 70%", 70.0, 4, "3/4 ", "[██████  ]"},
+		{"quarters: full", 95.0, 4, "4/4 ", "[████████]"},
+		{"quarters: over 100 clips", 120.0, 4, "4/4 ", "[████████]"},
+		{"quarters: negative clips", -5.0, 4, "0/4 ", "[        ]"},
+		{"eighths: 45%", 45.0, 8, "4/8 ", "[████    ]"},
+		{"eighths: 60%", 60.0, 8, "5/8 ", "[█████   ]"},
+		{"eighths: 90%", 90.0, 8, "7/8 ", "[███████ ]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := colorizeUsageWithStyle(tt.usage, barStyle{width: 8, quantize: tt.steps})
+			if !strings.Contains(result, tt.wantText+tt.wantBar) {
+				t.Errorf("result should contain %q, got: %q", tt.wantText+tt.wantBar, result)
+			}
+			if strings.Contains(result, "%") {
+				t.Errorf("quantized result should not contain percent, got: %q", result)
+			}
+		})
+	}
+
+	t.Run("color follows actual usage", func(t *testing.T) {
+		// 70% は 3/4 に丸められるが色は実際の使用率（オレンジ）に従う
+		result := colorizeUsageWithStyle(70.0, barStyle{width: 8, quantize: 4})
+		if !strings.HasPrefix(result, colorOrange) {
+			t.Errorf("result should be orange, got: %q", result)
+		}
+	})
+}
+
+func TestPollAfterHint(t *testing.T) {
+	noHistory := WithHistoryModTimeFunc(func() (time.Time, error) {
+		return time.Time{}, os.ErrNotExist
+	})
+
+	t.Run("fetchFromAPI stores the server hint", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":40.0},"poll_after_seconds":300}`))
+		}))
+		defer server.Close()
+
+		sl := NewStatusLine(
+			WithHTTPClient(server.Client()),
+			WithAccessTokenFunc(func() (string, error) {
+				return "test-token", nil
+			}),
+		)
+		cache, err := sl.fetchFromAPI(filepath.Join(t.TempDir(), "cache.json"), server.URL)
+		if err != nil {
+			t.Fatalf("fetchFromAPI failed: %v", err)
+		}
+		if cache.NextPollAfter != cache.CachedAt+300 {
+			t.Errorf("NextPollAfter = %d, expected CachedAt+300 (%d)", cache.NextPollAfter, cache.CachedAt+300)
+		}
+	})
+
+	t.Run("cache stays valid until the hinted time", func(t *testing.T) {
+		sl := NewStatusLine(noHistory)
+		now := time.Now().Unix()
+
+		tests := []struct {
+			name     string
+			cache    *CacheData
+			expected bool
+		}{
+			{
+				name:     "4 minutes old with 300s hint",
+				cache:    &CacheData{ResetsAt: "2026-01-27T12:00:00Z", CachedAt: now - 240, NextPollAfter: now - 240 + 300},
+				expected: true,
+			},
+			{
+				name:     "just over 5 minutes old with 300s hint",
+				cache:    &CacheData{ResetsAt: "2026-01-27T12:00:00Z", CachedAt: now - 310, NextPollAfter: now - 310 + 300},
+				expected: false,
+			},
+			{
+				name:     "4 minutes old without hint",
+				cache:    &CacheData{ResetsAt: "2026-01-27T12:00:00Z", CachedAt: now - 240},
+				expected: false,
+			},
+			{
+				name:     "hint is capped by maxPollAfter",
+				cache:    &CacheData{ResetsAt: "2026-01-27T12:00:00Z", CachedAt: now - 40*60, NextPollAfter: now + 3600},
+				expected: false,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if result := sl.isCacheValid(tt.cache); result != tt.expected {
+					t.Errorf("isCacheValid() = %v, expected %v", result, tt.expected)
+				}
+			})
+		}
+	})
+}
+
+func TestParseArgs(t *testing.T) {
+	t.Run("no arguments", func(t *testing.T) {
+		opts, err := parseArgs(nil, io.Discard)
+		if err != nil {
+			t.Fatalf("parseArgs failed: %v", err)
+		}
+		if opts.Timings {
+			t.Error("Timings should be false by default")
+		}
+	})
+
+	t.Run("--timings", func(t *testing.T) {
+		opts, err := parseArgs([]string{"--timings"}, io.Discard)
+		if err != nil {
+			t.Fatalf("parseArgs failed: %v", err)
+		}
+		if !opts.Timings {
+			t.Error("Timings should be true")
+		}
+	})
+
+	for _, arg := range []string{"--refresh", "-f"} {
+		t.Run(arg, func(t *testing.T) {
+			opts, err := parseArgs([]string{arg}, io.Discard)
+			if err != nil {
+				t.Fatalf("parseArgs failed: %v", err)
+			}
+			if !opts.Refresh {
+				t.Error("Refresh should be true")
+			}
+		})
+	}
+
+	t.Run("--prefetch", func(t *testing.T) {
+		opts, err := parseArgs([]string{"--prefetch"}, io.Discard)
+		if err != nil {
+			t.Fatalf("parseArgs failed: %v", err)
+		}
+		if !opts.Prefetch {
+			t.Error("Prefetch should be true")
+		}
+	})
+
+	t.Run("--show", func(t *testing.T) {
+		opts, err := parseArgs([]string{"--show", "tokens, 5h,week,"}, io.Discard)
+		if err != nil {
+			t.Fatalf("parseArgs failed: %v", err)
+		}
+		if fmt.Sprint(opts.Show) != "[tokens 5h week]" {
+			t.Errorf("Show = %v, expected [tokens 5h week]", opts.Show)
+		}
+	})
+
+	t.Run("--show with an unknown part", func(t *testing.T) {
+		if _, err := parseArgs([]string{"--show", "tokens,bogus"}, io.Discard); err == nil {
+			t.Error("parseArgs should reject unknown parts")
+		}
+	})
+
+	t.Run("--exit-status", func(t *testing.T) {
+		opts, err := parseArgs([]string{"--exit-status"}, io.Discard)
+		if err != nil {
+			t.Fatalf("parseArgs failed: %v", err)
+		}
+		if !opts.ExitStatus {
+			t.Error("ExitStatus should be true")
+		}
+	})
+
+	t.Run("--compact", func(t *testing.T) {
+		opts, err := parseArgs([]string{"--compact"}, io.Discard)
+		if err != nil {
+			t.Fatalf("parseArgs failed: %v", err)
+		}
+		if !opts.Compact {
+			t.Error("Compact should be true")
+		}
+	})
+
+	t.Run("--print-config", func(t *testing.T) {
+		opts, err := parseArgs([]string{"--print-config"}, io.Discard)
+		if err != nil {
+			t.Fatalf("parseArgs failed: %v", err)
+		}
+		if !opts.PrintConfig {
+			t.Error("PrintConfig should be true")
+		}
+	})
+
+	t.Run("-v", func(t *testing.T) {
+		for _, arg := range []string{"-v", "--verbose"} {
+			opts, err := parseArgs([]string{arg}, io.Discard)
+			if err != nil {
+				t.Fatalf("parseArgs failed: %v", err)
+			}
+			if !opts.Verbose {
+				t.Errorf("%s: Verbose should be true", arg)
+			}
+		}
+	})
+
+	t.Run("--profile", func(t *testing.T) {
+		t.Setenv(profileEnv, "home")
+		opts, err := parseArgs([]string{"--profile", "work"}, io.Discard)
+		if err != nil {
+			t.Fatalf("parseArgs failed: %v", err)
+		}
+		if opts.Profile != "work" {
+			t.Errorf("Profile = %q, expected work (flag overrides %s)", opts.Profile, profileEnv)
+		}
+
+		opts, err = parseArgs(nil, io.Discard)
+		if err != nil {
+			t.Fatalf("parseArgs failed: %v", err)
+		}
+		if opts.Profile != "home" {
+			t.Errorf("Profile = %q, expected home from %s", opts.Profile, profileEnv)
+		}
+
+		if _, err := parseArgs([]string{"--profile", "../work"}, io.Discard); err == nil {
+			t.Error("profile names with path separators should be rejected")
+		}
+	})
+
+	t.Run("--dry-run", func(t *testing.T) {
+		opts, err := parseArgs([]string{"--dry-run"}, io.Discard)
+		if err != nil {
+			t.Fatalf("parseArgs failed: %v", err)
+		}
+		if !opts.DryRun {
+			t.Error("DryRun should be true")
+		}
+	})
+
+	t.Run("--offline", func(t *testing.T) {
+		t.Setenv(offlineEnv, "")
+		opts, err := parseArgs([]string{"--offline"}, io.Discard)
+		if err != nil {
+			t.Fatalf("parseArgs failed: %v", err)
+		}
+		if !opts.Offline {
+			t.Error("Offline should be true")
+		}
+
+		t.Setenv(offlineEnv, "1")
+		opts, err = parseArgs(nil, io.Discard)
+		if err != nil {
+			t.Fatalf("parseArgs failed: %v", err)
+		}
+		if !opts.Offline {
+			t.Errorf("Offline should be true with %s=1", offlineEnv)
+		}
+	})
+
+	t.Run("--doctor", func(t *testing.T) {
+		opts, err := parseArgs([]string{"--doctor"}, io.Discard)
+		if err != nil {
+			t.Fatalf("parseArgs failed: %v", err)
+		}
+		if !opts.Doctor {
+			t.Error("Doctor should be true")
+		}
+	})
+
+	t.Run("--allow-empty-input", func(t *testing.T) {
+		opts, err := parseArgs([]string{"--allow-empty-input"}, io.Discard)
+		if err != nil {
+			t.Fatalf("parseArgs failed: %v", err)
+		}
+		if !opts.AllowEmpty {
+			t.Error("AllowEmpty should be true")
+		}
+	})
+
+	t.Run("--version", func(t *testing.T) {
+		opts, err := parseArgs([]string{"--version"}, io.Discard)
+		if err != nil {
+			t.Fatalf("parseArgs failed: %v", err)
+		}
+		if !opts.Version {
+			t.Error("Version should be true")
+		}
+	})
+
+	t.Run("unknown flag", func(t *testing.T) {
+		if _, err := parseArgs([]string{"--bogus"}, io.Discard); err == nil {
+			t.Error("parseArgs should fail on unknown flag")
+		}
+	})
+}
+
+func TestVersionInfo(t *testing.T) {
+	origVersion, origBuildDate, origCommit := version, buildDate, commit
+	defer func() { version, buildDate, commit = origVersion, origBuildDate, origCommit }()
+	version = "v1.2.3"
+	buildDate = "2026-01-27T10:00:00Z"
+
+	t.Run("without commit", func(t *testing.T) {
+		commit = ""
+		got := versionInfo()
+		for _, want := range []string{appName + " v1.2.3", "built:  2026-01-27T10:00:00Z", runtime.Version()} {
+			if !strings.Contains(got, want) {
+				t.Errorf("version info should contain %q, got: %q", want, got)
+			}
+		}
+		if strings.Contains(got, "commit:") {
+			t.Errorf("commit should be omitted when not set, got: %q", got)
+		}
+	})
+
+	t.Run("with commit", func(t *testing.T) {
+		commit = "abc1234"
+		if got := versionInfo(); !strings.Contains(got, "commit: abc1234") {
+			t.Errorf("version info should contain the commit, got: %q", got)
+		}
+	})
+
+	t.Run("-V", func(t *testing.T) {
+		opts, err := parseArgs([]string{"-V"}, io.Discard)
+		if err != nil {
+			t.Fatalf("parseArgs failed: %v", err)
+		}
+		if !opts.Version {
+			t.Error("Version should be true")
+		}
+	})
+}
+
+func TestTimings(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	saveCache(cacheFile, &CacheData{
+		ResetsAt:    "2026-01-27T10:00:00Z",
+		Utilization: 30.0,
+		CachedAt:    time.Now().Unix() - 10,
+	})
+
+	t.Run("prints all phases with parseable durations", func(t *testing.T) {
+		stderr := &bytes.Buffer{}
+		sl := NewStatusLine(
+			WithStderr(stderr),
+			WithTimings(true),
+			WithHistoryModTimeFunc(func() (time.Time, error) {
+				return time.Time{}, os.ErrNotExist
+			}),
+		)
+
+		stdin := strings.NewReader(`{"model":{"display_name":"Sonnet 4"}}`)
+		if err := sl.run(stdin, &bytes.Buffer{}, cacheFile); err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+
+		lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+		got := make(map[string]time.Duration)
+		for _, line := range lines {
+			fields := strings.Fields(line)
+			if len(fields) != 3 || fields[0] != "timing:" {
+				t.Fatalf("unexpected timing line: %q", line)
+			}
+			d, err := time.ParseDuration(fields[2])
+			if err != nil {
+				t.Fatalf("duration %q is not parseable: %v", fields[2], err)
+			}
+			got[fields[1]] = d
+		}
+		for _, phase := range timingPhases {
+			if _, ok := got[phase]; !ok {
+				t.Errorf("timings output should contain phase %q, got: %s", phase, stderr.String())
+			}
+		}
+	})
+
+	t.Run("prints nothing when disabled", func(t *testing.T) {
+		stderr := &bytes.Buffer{}
+		sl := NewStatusLine(
+			WithStderr(stderr),
+			WithHistoryModTimeFunc(func() (time.Time, error) {
+				return time.Time{}, os.ErrNotExist
+			}),
+		)
+
+		stdin := strings.NewReader(`{"model":{"display_name":"Sonnet 4"}}`)
+		if err := sl.run(stdin, &bytes.Buffer{}, cacheFile); err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+		if strings.Contains(stderr.String(), "timing:") {
+			t.Errorf("stderr should not contain timings, got: %s", stderr.String())
+		}
+	})
+}
+
+func TestMirrorFile(t *testing.T) {
+	noopHistoryMod := WithHistoryModTimeFunc(func() (time.Time, error) {
+		return time.Time{}, os.ErrNotExist
+	})
+	inputJSON := `{
+		"model": {"display_name": "Sonnet 4"},
+		"rate_limits": {"five_hour": {"used_percentage": 42.5, "resets_at": 1743580800}}
+	}`
+
+	t.Run("mirror file matches stdout", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		cfg := defaultConfig()
+		cfg.MirrorFile = filepath.Join(tmpDir, "out", "statusline.txt")
+
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(noopHistoryMod)
+		if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(tmpDir, "cache.json"), cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+
+		data, err := os.ReadFile(cfg.MirrorFile)
+		if err != nil {
+			t.Fatalf("failed to read mirror file: %v", err)
+		}
+		if string(data) != stdout.String() {
+			t.Errorf("mirror file = %q, expected %q", string(data), stdout.String())
+		}
+		if _, err := os.Stat(cfg.MirrorFile + ".tmp"); !os.IsNotExist(err) {
+			t.Error("temporary mirror file should not remain")
+		}
+	})
+
+	t.Run("write failure only warns", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		// 親パスがファイルのため書き込みに失敗する
+		blocker := filepath.Join(tmpDir, "blocker")
+		os.WriteFile(blocker, []byte("x"), 0644)
+		cfg := defaultConfig()
+		cfg.MirrorFile = filepath.Join(blocker, "statusline.txt")
+
+		stdout := &bytes.Buffer{}
+		stderr := &bytes.Buffer{}
+		sl := NewStatusLine(noopHistoryMod, WithStderr(stderr))
+		if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(tmpDir, "cache.json"), cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		if !strings.Contains(stderr.String(), "failed to write mirror file") {
+			t.Errorf("stderr should contain mirror warning, got: %s", stderr.String())
+		}
+		if !strings.Contains(stdout.String(), "42.5%") {
+			t.Errorf("stdout should still contain the status line, got: %s", stdout.String())
+		}
+	})
+}
+
+func TestHideWeekResetBeyondHours(t *testing.T) {
+	noopHistoryMod := WithHistoryModTimeFunc(func() (time.Time, error) {
+		return time.Time{}, os.ErrNotExist
+	})
+	now := time.Date(2026, 1, 5, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		resetIn    time.Duration
+		hideBeyond int
+		wantShown  bool
+	}{
+		{"6 days out is hidden under 48h threshold", 6 * 24 * time.Hour, 48, false},
+		{"12 hours out is shown under 48h threshold", 12 * time.Hour, 48, true},
+		{"0 always shows", 6 * 24 * time.Hour, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			weeklyReset := now.Add(tt.resetIn)
+			inputJSON := fmt.Sprintf(`{
+				"model": {"display_name": "Sonnet 4"},
+				"rate_limits": {
+					"five_hour": {"used_percentage": 10.0, "resets_at": %d},
+					"seven_day": {"used_percentage": 20.0, "resets_at": %d}
+				}
+			}`, now.Add(time.Hour).Unix(), weeklyReset.Unix())
+
+			cfg := defaultConfig()
+			cfg.HideWeekResetBeyondHours = tt.hideBeyond
+			stdout := &bytes.Buffer{}
+			sl := NewStatusLine(noopHistoryMod, WithNowFunc(func() time.Time { return now }))
+			if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+				t.Fatalf("runWithConfig failed: %v", err)
+			}
+
+			want := "resets: " + formatResetTimeWithDate(weeklyReset.UTC().Format(time.RFC3339))
+			if got := strings.Contains(stdout.String(), want); got != tt.wantShown {
+				t.Errorf("contains %q = %v, expected %v; output: %s", want, got, tt.wantShown, stdout.String())
+			}
+			// 5時間リセットは常に表示される
+			if !strings.Contains(stdout.String(), "resets: "+formatResetTime(now.Add(time.Hour).UTC().Format(time.RFC3339))) {
+				t.Errorf("5h reset should always be shown, got: %s", stdout.String())
+			}
+		})
+	}
+}
+
+func TestWindows(t *testing.T) {
+	noopHistoryMod := WithHistoryModTimeFunc(func() (time.Time, error) {
+		return time.Time{}, os.ErrNotExist
+	})
+	body := `{
+		"five_hour": {"resets_at": "2026-01-05T10:30:00Z", "utilization": 41.0},
+		"seven_day": {"resets_at": 1767954600, "utilization": 12.0},
+		"thirty_day": {"resets_at": "2026-02-01T00:00:00Z", "utilization": 73.0},
+		"poll_after_seconds": 60
+	}`
+
+	resp, err := parseAPIResponse([]byte(body))
+	if err != nil {
+		t.Fatalf("parseAPIResponse failed: %v", err)
+	}
+	if len(resp.Windows) != 3 {
+		t.Fatalf("expected 3 windows, got %d: %v", len(resp.Windows), resp.Windows)
+	}
+	if got := resp.Windows["seven_day"].ResetsAt; got != "2026-01-09T10:30:00Z" {
+		t.Errorf("seven_day ResetsAt = %s, expected 2026-01-09T10:30:00Z", got)
+	}
+
+	tmpDir := t.TempDir()
+	cacheFile := filepath.Join(tmpDir, "cache.json")
+	if err := saveCache(cacheFile, &CacheData{
+		ResetsAt:    resp.FiveHour.ResetsAt,
+		Utilization: resp.FiveHour.Utilization,
+		CachedAt:    time.Now().Unix(),
+		Windows:     resp.Windows,
+	}); err != nil {
+		t.Fatalf("saveCache failed: %v", err)
+	}
+
+	cfg := defaultConfig()
+	cfg.Windows = []string{"thirty_day", "seven_day", "ninety_day"}
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	sl := NewStatusLine(noopHistoryMod, WithStderr(stderr))
+	if err := sl.runWithConfig(strings.NewReader(`{"model": {"display_name": "Sonnet 4"}}`), stdout, cacheFile, cfg); err != nil {
+		t.Fatalf("runWithConfig failed: %v", err)
+	}
+
+	output := stdout.String()
+	thirty := strings.Index(output, "thirty_day: "+colorizeUsageWithWidth(73.0, cfg.BarWidth))
+	seven := strings.Index(output, "seven_day: "+colorizeUsageWithWidth(12.0, cfg.BarWidth))
+	if thirty < 0 || seven < 0 {
+		t.Fatalf("output should contain both listed windows, got: %s", output)
+	}
+	if thirty > seven {
+		t.Errorf("windows should be rendered in config order, got: %s", output)
+	}
+	if strings.Contains(output, "five_hour: ") {
+		t.Errorf("unlisted window should not be rendered, got: %s", output)
+	}
+	if !strings.Contains(stderr.String(), "warning: unknown usage window: ninety_day") {
+		t.Errorf("stderr should warn about the unknown window, got: %s", stderr.String())
+	}
+}
+
+// roundTripFunc は関数を http.RoundTripper として扱う
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestHealthDot(t *testing.T) {
+	noopHistoryMod := WithHistoryModTimeFunc(func() (time.Time, error) {
+		return time.Time{}, os.ErrNotExist
+	})
+	rateLimitedClient := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusTooManyRequests,
+			Header:     http.Header{"Retry-After": []string{"30"}},
+			Body:       io.NopCloser(strings.NewReader("")),
+			Request:    r,
+		}, nil
+	})}
+	inputJSON := `{"model": {"display_name": "Sonnet 4"}}`
+
+	tests := []struct {
+		name     string
+		cachedAt time.Duration // 0 の場合はキャッシュなし
+		opts     []StatusLineOption
+		want     string
+	}{
+		{
+			name:     "fresh cache is green",
+			cachedAt: 10 * time.Second,
+			want:     colorGreen + "●" + colorReset,
+		},
+		{
+			name:     "stale cache after rate limit is yellow",
+			cachedAt: 10 * time.Minute,
+			opts: []StatusLineOption{
+				WithHTTPClient(rateLimitedClient),
+				WithAccessTokenFunc(func() (string, error) { return "test-token", nil }),
+			},
+			want: colorYellow + "●" + colorReset,
+		},
+		{
+			name: "no token is red",
+			opts: []StatusLineOption{
+				WithAccessTokenFunc(func() (string, error) { return "", errors.New("no token") }),
+			},
+			want: colorRed + "●" + colorReset,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheFile := filepath.Join(t.TempDir(), "cache.json")
+			if tt.cachedAt > 0 {
+				if err := saveCache(cacheFile, &CacheData{
+					ResetsAt:    "2026-01-27T10:00:00Z",
+					Utilization: 30.0,
+					CachedAt:    time.Now().Add(-tt.cachedAt).Unix(),
+				}); err != nil {
+					t.Fatalf("saveCache failed: %v", err)
+				}
+			}
+
+			cfg := defaultConfig()
+			cfg.ShowHealthDot = true
+			stdout := &bytes.Buffer{}
+			sl := NewStatusLine(append([]StatusLineOption{noopHistoryMod, WithStderr(io.Discard)}, tt.opts...)...)
+			if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, cacheFile, cfg); err != nil {
+				t.Fatalf("runWithConfig failed: %v", err)
+			}
+			if !strings.HasPrefix(stdout.String(), tt.want) {
+				t.Errorf("output should start with %q, got: %q", tt.want, stdout.String())
+			}
+		})
+	}
+}
+
+func TestUsagePrecision(t *testing.T) {
+	noopHistoryMod := WithHistoryModTimeFunc(func() (time.Time, error) {
+		return time.Time{}, os.ErrNotExist
+	})
+	inputJSON := `{
+		"model": {"display_name": "Sonnet 4"},
+		"rate_limits": {
+			"five_hour": {"used_percentage": 42.345, "resets_at": 1743580800},
+			"seven_day": {"used_percentage": 17.6, "resets_at": 1744185600}
+		}
+	}`
+	intPtr := func(n int) *int { return &n }
+
+	tests := []struct {
+		name      string
+		global    *int
+		fiveHour  *int
+		weekly    *int
+		wantFive  string
+		wantWeekl string
+	}{
+		{"default precision", nil, nil, nil, "m42.3% [", "m17.6% ["},
+		{"global precision", intPtr(2), nil, nil, "m42.34% [", "m17.60% ["},
+		{"per-window overrides", nil, intPtr(2), intPtr(0), "m42.34% [", "m18% ["},
+		{"weekly override falls back to global for five-hour", intPtr(0), nil, intPtr(1), "m42% [", "m17.6% ["},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.UsagePrecision = tt.global
+			cfg.FiveHourPrecision = tt.fiveHour
+			cfg.WeeklyPrecision = tt.weekly
+			stdout := &bytes.Buffer{}
+			sl := NewStatusLine(noopHistoryMod)
+			if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+				t.Fatalf("runWithConfig failed: %v", err)
+			}
+
+			output := stdout.String()
+			fiveHour := output[strings.Index(output, "5h: "):]
+			week := output[strings.Index(output, "week: "):]
+			if !strings.Contains(fiveHour[:strings.Index(fiveHour, "|")], tt.wantFive) {
+				t.Errorf("5h bar should contain %q, got: %s", tt.wantFive, fiveHour)
+			}
+			if !strings.Contains(week[:strings.Index(week, "|")], tt.wantWeekl) {
+				t.Errorf("week bar should contain %q, got: %s", tt.wantWeekl, week)
+			}
+		})
+	}
+}
+
+func TestForceRefresh(t *testing.T) {
+	newServer := func(status int, hits *int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(hits, 1)
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":55.0}}`))
+		}))
+	}
+	newStatusLine := func(server *httptest.Server) *StatusLine {
+		return NewStatusLine(
+			WithForceRefresh(true),
+			WithHTTPClient(server.Client()),
+			WithStderr(io.Discard),
+			WithAccessTokenFunc(func() (string, error) {
+				return "test-token", nil
+			}),
+			WithHistoryModTimeFunc(func() (time.Time, error) {
+				return time.Time{}, os.ErrNotExist
+			}),
+		)
+	}
+	validCache := func(t *testing.T) string {
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		if err := saveCache(cacheFile, &CacheData{
+			ResetsAt:    "2026-01-27T10:00:00Z",
+			Utilization: 30.0,
+			CachedAt:    time.Now().Unix() - 5, // 最小取得間隔内
+		}); err != nil {
+			t.Fatalf("saveCache failed: %v", err)
+		}
+		return cacheFile
+	}
+
+	t.Run("bypasses a valid cache", func(t *testing.T) {
+		var hits int32
+		server := newServer(http.StatusOK, &hits)
+		defer server.Close()
+
+		cache, err := newStatusLine(server).getCachedOrFetch(validCache(t), server.URL)
+		if err != nil {
+			t.Fatalf("getCachedOrFetch failed: %v", err)
+		}
+		if atomic.LoadInt32(&hits) != 1 {
+			t.Errorf("API should be called once, got %d", hits)
+		}
+		if cache.Utilization != 55.0 {
+			t.Errorf("Utilization = %f, expected 55.0 (fresh data)", cache.Utilization)
+		}
+	})
+
+	t.Run("falls back to the disk cache on failure", func(t *testing.T) {
+		var hits int32
+		server := newServer(http.StatusInternalServerError, &hits)
+		defer server.Close()
+
+		cache, err := newStatusLine(server).getCachedOrFetch(validCache(t), server.URL)
+		if err != nil {
+			t.Fatalf("getCachedOrFetch should fall back to the cache, got: %v", err)
+		}
+		if cache.Utilization != 30.0 {
+			t.Errorf("Utilization = %f, expected 30.0 (from disk cache)", cache.Utilization)
+		}
+		if !cache.Stale {
+			t.Error("fallback cache should be marked stale")
+		}
+	})
+
+	t.Run("fails when no cache exists", func(t *testing.T) {
+		var hits int32
+		server := newServer(http.StatusInternalServerError, &hits)
+		defer server.Close()
+
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		if _, err := newStatusLine(server).getCachedOrFetch(cacheFile, server.URL); err == nil {
+			t.Error("getCachedOrFetch should fail without a cache to fall back to")
+		}
+	})
+}
+
+func TestSnapToFullAbove(t *testing.T) {
+	tests := []struct {
+		name      string
+		usage     float64
+		snapAbove float64
+		wantBar   string
+		wantLabel string
+	}{
+		{"snaps above threshold", 99.7, 99.5, "[" + strings.Repeat("█", 20) + "]", "99.7%"},
+		{"keeps shade below threshold", 99.4, 99.5, "[" + strings.Repeat("█", 19) + "▇]", "99.4%"},
+		{"disabled keeps shade", 99.7, 0, "[" + strings.Repeat("█", 19) + "▇]", "99.7%"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := colorizeUsageWithStyle(tt.usage, barStyle{width: 20, snapAbove: tt.snapAbove})
+			if !strings.Contains(result, tt.wantBar) {
+				t.Errorf("result should contain %q, got: %q", tt.wantBar, result)
+			}
+			if !strings.Contains(result, tt.wantLabel) {
+				t.Errorf("result should keep the precise label %q, got: %q", tt.wantLabel, result)
+			}
+		})
+	}
+}
+
+func TestNoColor(t *testing.T) {
+	for _, usage := range []float64{0.0, 42.5, 99.9, 100.0, 120.0, -5.0} {
+		t.Run(fmt.Sprintf("usage %.1f", usage), func(t *testing.T) {
+			colored := colorizeUsageWithStyle(usage, barStyle{width: 20})
+			plain := colorizeUsageWithStyle(usage, barStyle{width: 20, noColor: true})
+			if strings.Contains(plain, "\033") {
+				t.Errorf("output should not contain escape codes, got: %q", plain)
+			}
+			// エスケープコードを除けばカラー出力と同一
+			for _, code := range []string{colorGreen, colorYellow, colorOrange, colorRed, colorReset} {
+				colored = strings.ReplaceAll(colored, code, "")
+			}
+			if plain != colored {
+				t.Errorf("plain output = %q, expected %q", plain, colored)
+			}
+		})
+	}
+
+	t.Run("NO_COLOR environment variable", func(t *testing.T) {
+		t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+		t.Setenv("NO_COLOR", "1")
+
+		inputJSON := `{
+			"model": {"display_name": "Sonnet 4"},
+			"context_window": {"used_percentage": 130.0},
+			"rate_limits": {
+				"five_hour": {"used_percentage": 120.0, "resets_at": 1743580800},
+				"seven_day": {"used_percentage": -3.0, "resets_at": 1744185600}
+			}
+		}`
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(
+			WithStderr(io.Discard),
+			WithHistoryModTimeFunc(func() (time.Time, error) {
+				return time.Time{}, os.ErrNotExist
+			}),
+		)
+		if err := sl.run(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json")); err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+		if strings.Contains(stdout.String(), "\033") {
+			t.Errorf("output should not contain escape codes, got: %q", stdout.String())
+		}
+		if !strings.Contains(stdout.String(), "120.0% [") {
+			t.Errorf("output should still contain the usage, got: %q", stdout.String())
+		}
+	})
+}
+
+func TestGroupSeparator(t *testing.T) {
+	noopHistoryMod := WithHistoryModTimeFunc(func() (time.Time, error) {
+		return time.Time{}, os.ErrNotExist
+	})
+	inputJSON := `{
+		"model": {"display_name": "Sonnet 4"},
+		"cost": {"total_cost_usd": 0.5},
+		"rate_limits": {
+			"five_hour": {"used_percentage": 10.0, "resets_at": 1743580800},
+			"seven_day": {"used_percentage": 20.0, "resets_at": 1744185600}
+		}
+	}`
+
+	render := func(t *testing.T, cfg *Config) string {
+		t.Helper()
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(noopHistoryMod)
+		if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		return stdout.String()
+	}
+
+	t.Run("separator appears once at the boundary", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.ShowCost = true
+		cfg.GroupSeparator = " ‖ "
+		output := render(t, cfg)
+
+		if n := strings.Count(output, " ‖ "); n != 1 {
+			t.Fatalf("group separator should appear exactly once, got %d: %s", n, output)
+		}
+		before, after, _ := strings.Cut(output, " ‖ ")
+		if !strings.HasSuffix(before, "resets: "+formatResetTime(unixToISO8601(1743580800))) {
+			t.Errorf("group separator should follow the last five-hour part, got: %s", output)
+		}
+		if !strings.HasPrefix(after, "week: ") {
+			t.Errorf("group separator should precede the first weekly part, got: %s", output)
+		}
+	})
+
+	t.Run("boundary moves with hidden parts", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Show5hResets = false
+		cfg.GroupSeparator = " ‖ "
+		output := render(t, cfg)
+
+		if !strings.Contains(output, colorReset+" ‖ week: ") {
+			t.Errorf("group separator should follow the five-hour bar, got: %s", output)
+		}
+	})
+
+	t.Run("no separator without a weekly group", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.ShowWeekUsage = false
+		cfg.ShowWeekResets = false
+		cfg.GroupSeparator = " ‖ "
+		if output := render(t, cfg); strings.Contains(output, " ‖ ") {
+			t.Errorf("group separator should not appear, got: %s", output)
+		}
+	})
+
+	t.Run("burn rate belongs to the five-hour group", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.GroupSeparator = " ‖ "
+		parts := []segment{
+			{key: seg5h, text: "5h: 10%"},
+			{key: segBurnRate, text: "~ok"},
+			{key: segWeek, text: "week: 20%"},
+		}
+		if got, want := joinSegments(parts, cfg), "5h: 10% | ~ok ‖ week: 20%"; got != want {
+			t.Errorf("joinSegments = %q, expected %q", got, want)
+		}
+	})
+}
+
+func TestColorAutoDetection(t *testing.T) {
+	inputJSON := `{
+		"model": {"display_name": "Sonnet 4"},
+		"rate_limits": {"five_hour": {"used_percentage": 42.5, "resets_at": 1743580800}}
+	}`
+
+	tests := []struct {
+		name       string
+		terminal   bool
+		claudeCode string
+		forceColor bool
+		wantColor  bool
+	}{
+		{"pipe disables color", false, "", false, false},
+		{"terminal keeps color", true, "", false, true},
+		{"force_color keeps color in pipes", false, "", true, true},
+		{"running under Claude Code keeps color", false, "1", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configHome := t.TempDir()
+			t.Setenv("XDG_CONFIG_HOME", configHome)
+			t.Setenv("CLAUDECODE", tt.claudeCode)
+			t.Setenv("NO_COLOR", "")
+			cfg := defaultConfig()
+			cfg.ForceColor = tt.forceColor
+			if err := saveConfig(filepath.Join(configHome, appName, "config.json"), cfg); err != nil {
+				t.Fatalf("saveConfig failed: %v", err)
+			}
+
+			stdout := &bytes.Buffer{}
+			sl := NewStatusLine(
+				WithIsTerminalFunc(func(w io.Writer) bool { return tt.terminal }),
+				WithHistoryModTimeFunc(func() (time.Time, error) {
+					return time.Time{}, os.ErrNotExist
+				}),
+			)
+			if err := sl.run(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json")); err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+			if got := strings.Contains(stdout.String(), "\033["); got != tt.wantColor {
+				t.Errorf("contains color = %v, expected %v; output: %q", got, tt.wantColor, stdout.String())
+			}
+		})
+	}
+
+	t.Run("non-file writers are not terminals", func(t *testing.T) {
+		if isTerminal(&bytes.Buffer{}) {
+			t.Error("bytes.Buffer should not be a terminal")
+		}
+	})
+}
+
+func TestColorThresholds(t *testing.T) {
+	t.Run("custom thresholds", func(t *testing.T) {
+		style := barStyle{width: 20, thresholds: colorThresholds{40, 70, 90}}
+		tests := []struct {
+			usage float64
+			want  string
+		}{
+			{30.0, colorGreen},
+			{45.0, colorYellow},
+			{80.0, colorOrange},
+			{89.9, colorOrange},
+			{90.0, colorRed},
+		}
+		for _, tt := range tests {
+			if result := colorizeUsageWithStyle(tt.usage, style); !strings.HasPrefix(result, tt.want) {
+				t.Errorf("colorizeUsageWithStyle(%.1f) = %q, expected prefix %q", tt.usage, result, tt.want)
+			}
+		}
+	})
+
+	t.Run("band ticks follow custom thresholds", func(t *testing.T) {
+		style := barStyle{width: 20, bandTicks: true, thresholds: colorThresholds{40, 70, 90}}
+		want := "[        |     |   | ]"
+		if result := colorizeUsageWithStyle(0, style); !strings.Contains(result, want) {
+			t.Errorf("result should contain %q, got: %q", want, result)
+		}
+	})
+
+	t.Run("config thresholds are used when rendering", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.ThresholdYellow, cfg.ThresholdOrange, cfg.ThresholdRed = 40, 70, 90
+		if result := colorizeUsageWithStyle(30.0, cfg.barStyle()); !strings.HasPrefix(result, colorGreen) {
+			t.Errorf("30%% should be green with custom thresholds, got: %q", result)
+		}
+	})
+
+	tests := []struct {
+		name                string
+		yellow, orange, red float64
+		wantWarning         bool
+	}{
+		{"defaults are valid", usageThresholdYellow, usageThresholdOrange, usageThresholdRed, false},
+		{"custom valid", 40, 70, 90, false},
+		{"not increasing", 50, 40, 90, true},
+		{"equal values", 40, 40, 90, true},
+		{"above 100", 40, 70, 120, true},
+		{"negative", -10, 70, 90, true},
+	}
+	for _, tt := range tests {
+		t.Run("validate "+tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.ThresholdYellow, cfg.ThresholdOrange, cfg.ThresholdRed = tt.yellow, tt.orange, tt.red
+			warnings := cfg.validate()
+			if got := len(warnings) > 0; got != tt.wantWarning {
+				t.Fatalf("warning = %v, expected %v (%v)", got, tt.wantWarning, warnings)
+			}
+			if tt.wantWarning && (cfg.ThresholdYellow != usageThresholdYellow ||
+				cfg.ThresholdOrange != usageThresholdOrange || cfg.ThresholdRed != usageThresholdRed) {
+				t.Errorf("invalid thresholds should fall back to defaults, got %v/%v/%v",
+					cfg.ThresholdYellow, cfg.ThresholdOrange, cfg.ThresholdRed)
+			}
+		})
+	}
+
+	t.Run("run warns about invalid thresholds", func(t *testing.T) {
+		configHome := t.TempDir()
+		t.Setenv("XDG_CONFIG_HOME", configHome)
+		cfg := defaultConfig()
+		cfg.ThresholdYellow, cfg.ThresholdOrange, cfg.ThresholdRed = 80, 50, 90
+		if err := saveConfig(filepath.Join(configHome, appName, "config.json"), cfg); err != nil {
+			t.Fatalf("saveConfig failed: %v", err)
+		}
+
+		stderr := &bytes.Buffer{}
+		sl := NewStatusLine(
+			WithStderr(stderr),
+			WithHistoryModTimeFunc(func() (time.Time, error) {
+				return time.Time{}, os.ErrNotExist
+			}),
+		)
+		inputJSON := `{"model":{"display_name":"Sonnet 4"},"rate_limits":{"five_hour":{"used_percentage":10.0,"resets_at":1743580800}}}`
+		if err := sl.run(strings.NewReader(inputJSON), &bytes.Buffer{}, filepath.Join(t.TempDir(), "cache.json")); err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+		if !strings.Contains(stderr.String(), "warning: invalid color thresholds") {
+			t.Errorf("stderr should contain a threshold warning, got: %s", stderr.String())
+		}
+	})
+}
+
+func TestPrefetch(t *testing.T) {
+	newStatusLine := func(status int, hits *int32, stderr io.Writer) *StatusLine {
+		client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			atomic.AddInt32(hits, 1)
+			return &http.Response{
+				StatusCode: status,
+				Body:       io.NopCloser(strings.NewReader(`{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":64.0}}`)),
+				Request:    r,
+			}, nil
+		})}
+		return NewStatusLine(
+			WithHTTPClient(client),
+			WithStderr(stderr),
+			WithAccessTokenFunc(func() (string, error) {
+				return "test-token", nil
+			}),
+		)
+	}
+
+	t.Run("writes the cache without output", func(t *testing.T) {
+		t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		saveCache(cacheFile, &CacheData{
+			ResetsAt:    "2026-01-27T10:00:00Z",
+			Utilization: 30.0,
+			CachedAt:    time.Now().Unix() - 300,
+		})
+
+		var hits int32
+		stderr := &bytes.Buffer{}
+		if err := newStatusLine(http.StatusOK, &hits, stderr).prefetch(cacheFile); err != nil {
+			t.Fatalf("prefetch failed: %v", err)
+		}
+		if stderr.Len() != 0 {
+			t.Errorf("prefetch should print nothing, got: %s", stderr.String())
+		}
+
+		cache, err := readCache(cacheFile)
+		if err != nil {
+			t.Fatalf("failed to read cache: %v", err)
+		}
+		if cache.Utilization != 64.0 {
+			t.Errorf("Utilization = %f, expected 64.0", cache.Utilization)
+		}
+	})
+
+	t.Run("respects the minimum fetch interval", func(t *testing.T) {
+		t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		saveCache(cacheFile, &CacheData{
+			ResetsAt:    "2026-01-27T10:00:00Z",
+			Utilization: 30.0,
+			CachedAt:    time.Now().Unix() - 5,
+		})
+
+		var hits int32
+		if err := newStatusLine(http.StatusOK, &hits, io.Discard).prefetch(cacheFile); err != nil {
+			t.Fatalf("prefetch failed: %v", err)
+		}
+		if atomic.LoadInt32(&hits) != 0 {
+			t.Errorf("API should not be called within the minimum interval, got %d calls", hits)
+		}
+	})
+
+	t.Run("fails on API error", func(t *testing.T) {
+		t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+
+		var hits int32
+		if err := newStatusLine(http.StatusInternalServerError, &hits, io.Discard).prefetch(cacheFile); err == nil {
+			t.Error("prefetch should fail on API error")
+		}
+	})
+
+	t.Run("does nothing offline", func(t *testing.T) {
+		t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+
+		var hits int32
+		sl := newStatusLine(http.StatusOK, &hits, io.Discard)
+		WithOffline(true)(sl)
+		if err := sl.prefetch(cacheFile); err != nil {
+			t.Fatalf("prefetch failed: %v", err)
+		}
+		if atomic.LoadInt32(&hits) != 0 || fileExists(cacheFile) {
+			t.Errorf("offline prefetch should not fetch or write the cache, got %d calls", hits)
+		}
+	})
+
+	t.Run("records and respects Retry-After", func(t *testing.T) {
+		t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		saveCache(cacheFile, &CacheData{
+			ResetsAt:    "2026-01-27T10:00:00Z",
+			Utilization: 30.0,
+			CachedAt:    time.Now().Unix() - 300,
+		})
+
+		var hits int32
+		if err := newStatusLine(http.StatusTooManyRequests, &hits, io.Discard).prefetch(cacheFile); err == nil {
+			t.Error("prefetch should fail when rate limited")
+		}
+		cache, err := readCache(cacheFile)
+		if err != nil {
+			t.Fatalf("failed to read cache: %v", err)
+		}
+		if cache.RetryAfter <= time.Now().Unix() || cache.Utilization != 30.0 {
+			t.Errorf("cache = %+v, expected RetryAfter in the future and the previous usage kept", cache)
+		}
+
+		// Retry-After 期間中は API にアクセスしない
+		if err := newStatusLine(http.StatusOK, &hits, io.Discard).prefetch(cacheFile); err == nil {
+			t.Error("prefetch should report the pending Retry-After")
+		}
+		if atomic.LoadInt32(&hits) != 1 {
+			t.Errorf("API should not be called during Retry-After, got %d calls", hits)
+		}
+	})
+
+	t.Run("waits for the fetch lock", func(t *testing.T) {
+		t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		lockFile := cacheFile + ".lock"
+		if err := os.WriteFile(lockFile, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		// ロックを持つプロセスが取得を終えてキャッシュを書き込んだ状態にする
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			saveCache(cacheFile, &CacheData{ResetsAt: "2026-01-27T10:00:00Z", Utilization: 12.0, CachedAt: time.Now().Unix()})
+			os.Remove(lockFile)
+		}()
+
+		var hits int32
+		if err := newStatusLine(http.StatusOK, &hits, io.Discard).prefetch(cacheFile); err != nil {
+			t.Fatalf("prefetch failed: %v", err)
+		}
+		if atomic.LoadInt32(&hits) != 0 {
+			t.Errorf("API should not be called when the lock holder wrote the cache, got %d calls", hits)
+		}
+	})
+}
+
+func TestIdleLabel(t *testing.T) {
+	noopHistoryMod := WithHistoryModTimeFunc(func() (time.Time, error) {
+		return time.Time{}, os.ErrNotExist
+	})
+
+	tests := []struct {
+		name      string
+		usage     float64
+		tokens    int64
+		idleLabel string
+		wantIdle  bool
+	}{
+		{"idle session shows label", 0.0, 0, "idle", true},
+		{"non-zero usage shows normal line", 12.0, 0, "idle", false},
+		{"non-zero tokens shows normal line", 0.0, 1500, "idle", false},
+		{"empty label disables idle mode", 0.0, 0, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inputJSON := fmt.Sprintf(`{
+				"model": {"display_name": "Sonnet 4"},
+				"context_window": {"total_input_tokens": %d, "total_output_tokens": 0},
+				"rate_limits": {"five_hour": {"used_percentage": %f, "resets_at": 1743580800}}
+			}`, tt.tokens, tt.usage)
+
+			cfg := defaultConfig()
+			cfg.IdleLabel = tt.idleLabel
+			stdout := &bytes.Buffer{}
+			sl := NewStatusLine(noopHistoryMod)
+			if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+				t.Fatalf("runWithConfig failed: %v", err)
+			}
+
+			if tt.wantIdle {
+				if stdout.String() != tt.idleLabel+"\n" {
+					t.Errorf("output = %q, expected only %q", stdout.String(), tt.idleLabel)
+				}
+				return
+			}
+			if !strings.Contains(stdout.String(), "5h: ") {
+				t.Errorf("output should be the normal line, got: %q", stdout.String())
+			}
+		})
+	}
+}
+
+func TestBarChars(t *testing.T) {
+	tests := []struct {
+		name   string
+		usage  float64
+		filled string
+		empty  string
+		want   string
+	}{
+		{"custom chars without shading", 52.0, "#", "-", "[##########----------]"},
+		{"custom filled char disables shading", 57.0, "=", "", "[===========         ]"},
+		{"custom empty char keeps shading", 57.0, "", ".", "[███████████▃........]"},
+		{"full bar", 100.0, "#", "-", "[####################]"},
+		{"over 100 is clipped", 130.0, "#", "-", "[####################]"},
+		{"negative is clipped", -5.0, "#", "-", "[--------------------]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := colorizeUsageWithStyle(tt.usage, barStyle{width: 20, filledChar: tt.filled, emptyChar: tt.empty})
+			if !strings.Contains(result, tt.want) {
+				t.Errorf("result should contain %q, got: %q", tt.want, result)
+			}
+			bar := result[strings.Index(result, " [")+2 : strings.LastIndex(result, "]")]
+			if n := utf8.RuneCountInString(bar); n != 20 {
+				t.Errorf("bar should be 20 cells wide, got %d: %q", n, bar)
+			}
+		})
+	}
+
+	t.Run("config chars are used when rendering", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.BarFilledChar, cfg.BarEmptyChar = "#", "-"
+		if result := colorizeUsageWithStyle(25.0, cfg.barStyle()); !strings.Contains(result, "[#####---------------]") {
+			t.Errorf("unexpected bar: %q", result)
+		}
+	})
+
+	t.Run("multi-character values are truncated with a warning", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.BarFilledChar = "##"
+		warnings := cfg.validate()
+		if len(warnings) != 1 || !strings.Contains(warnings[0], "bar_filled_char") {
+			t.Errorf("expected a bar_filled_char warning, got: %v", warnings)
+		}
+		if cfg.BarFilledChar != "#" {
+			t.Errorf("BarFilledChar = %q, expected %q", cfg.BarFilledChar, "#")
+		}
+	})
+}
+
+func TestSparkline(t *testing.T) {
+	t.Run("renders known samples", func(t *testing.T) {
+		samples := []float64{0, 15, 30, 45, 60, 75, 90, 100}
+		if got, want := renderSparkline(samples, 8, false), "▁▂▃▅▆▇██"; got != want {
+			t.Errorf("renderSparkline = %q, expected %q", got, want)
+		}
+	})
+
+	t.Run("shows only the last width samples", func(t *testing.T) {
+		samples := []float64{100, 100, 0, 50, 10}
+		if got, want := renderSparkline(samples, 3, false), "▁▅▁"; got != want {
+			t.Errorf("renderSparkline = %q, expected %q", got, want)
+		}
+	})
+
+	t.Run("clips out-of-range samples", func(t *testing.T) {
+		if got, want := renderSparkline([]float64{-20, 150}, 10, false), "▁█"; got != want {
+			t.Errorf("renderSparkline = %q, expected %q", got, want)
+		}
+	})
+
+	t.Run("ring buffer keeps the newest samples", func(t *testing.T) {
+		var samples []float64
+		for _, usage := range []float64{1, 2, 3, 4, 5} {
+			samples = appendSample(samples, usage, 3)
+		}
+		if fmt.Sprint(samples) != "[3 4 5]" {
+			t.Errorf("samples = %v, expected [3 4 5]", samples)
+		}
+	})
+
+	t.Run("fetch appends to cached samples", func(t *testing.T) {
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		saveCache(cacheFile, &CacheData{
+			ResetsAt:    "2026-01-27T10:00:00Z",
+			Utilization: 20.0,
+			CachedAt:    time.Now().Unix() - 300,
+			Samples:     []float64{10.0, 20.0},
+		})
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":35.0}}`))
+		}))
+		defer server.Close()
+
+		sl := NewStatusLine(
+			WithHTTPClient(server.Client()),
+			WithAccessTokenFunc(func() (string, error) {
+				return "test-token", nil
+			}),
+		)
+		cache, err := sl.fetchFromAPI(cacheFile, server.URL)
+		if err != nil {
+			t.Fatalf("fetchFromAPI failed: %v", err)
+		}
+		if fmt.Sprint(cache.Samples) != "[10 20 35]" {
+			t.Errorf("samples = %v, expected [10 20 35]", cache.Samples)
+		}
+	})
+
+	t.Run("rendered after the five-hour bar", func(t *testing.T) {
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		saveCache(cacheFile, &CacheData{
+			ResetsAt:    "2026-01-27T10:00:00Z",
+			Utilization: 60.0,
+			CachedAt:    time.Now().Unix() - 10,
+			Samples:     []float64{0, 30, 60},
+		})
+
+		cfg := defaultConfig()
+		cfg.ShowSparkline = true
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(WithHistoryModTimeFunc(func() (time.Time, error) {
+			return time.Time{}, os.ErrNotExist
+		}))
+		if err := sl.runWithConfig(strings.NewReader(`{"model":{"display_name":"Sonnet 4"}}`), stdout, cacheFile, cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		if !strings.Contains(stdout.String(), colorReset+" | ▁▃▆ | resets: ") {
+			t.Errorf("output should contain the sparkline after the 5h bar, got: %s", stdout.String())
+		}
+	})
+
+	t.Run("sample count is applied when rendering", func(t *testing.T) {
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		saveCache(cacheFile, &CacheData{
+			ResetsAt:    "2026-01-27T10:00:00Z",
+			Utilization: 60.0,
+			CachedAt:    time.Now().Unix() - 10,
+			Samples:     []float64{0, 30, 60},
+		})
+
+		cfg := defaultConfig()
+		cfg.ShowSparkline = true
+		cfg.SparklineSamples = 2
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(WithHistoryModTimeFunc(func() (time.Time, error) {
+			return time.Time{}, os.ErrNotExist
+		}))
+		if err := sl.runWithConfig(strings.NewReader(`{"model":{"display_name":"Sonnet 4"}}`), stdout, cacheFile, cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		if !strings.Contains(stdout.String(), colorReset+" | ▃▆ | resets: ") {
+			t.Errorf("sparkline should show the last 2 samples, got: %s", stdout.String())
+		}
+		if saved, err := readCache(cacheFile); err != nil || len(saved.Samples) != 3 {
+			t.Errorf("cached samples should not be trimmed by rendering, got %+v (err %v)", saved, err)
+		}
+	})
+}
+
+func TestJSONOutput(t *testing.T) {
+	noopHistoryMod := WithHistoryModTimeFunc(func() (time.Time, error) {
+		return time.Time{}, os.ErrNotExist
+	})
+	render := func(t *testing.T, inputJSON string, configure ...func(*Config)) (string, map[string]json.RawMessage) {
+		t.Helper()
+		cfg := defaultConfig()
+		cfg.OutputFormat = outputFormatJSON
+		for _, fn := range configure {
+			fn(cfg)
+		}
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(noopHistoryMod)
+		if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(stdout.Bytes(), &fields); err != nil {
+			t.Fatalf("output is not valid JSON: %v: %s", err, stdout.String())
+		}
+		return stdout.String(), fields
+	}
+
+	t.Run("round-trips into a struct", func(t *testing.T) {
+		output, _ := render(t, `{
+			"model": {"display_name": "Sonnet 4"},
+			"context_window": {"total_input_tokens": 1200, "total_output_tokens": 300},
+			"rate_limits": {
+				"five_hour": {"used_percentage": 42.5, "resets_at": 1767609000},
+				"seven_day": {"used_percentage": 17.0, "resets_at": 1767954600}
+			}
+		}`)
+
+		var got StatusJSON
+		if err := json.Unmarshal([]byte(output), &got); err != nil {
+			t.Fatalf("failed to decode output: %v", err)
+		}
+		want := StatusJSON{
+			Model:       "Sonnet 4",
+			TotalTokens: 1500,
+			FiveHour: &WindowJSON{
+				Utilization:  42.5,
+				ResetsAt:     "2026-01-05T10:30:00Z",
+				ResetsAtText: formatResetTime("2026-01-05T10:30:00Z"),
+			},
+			Weekly: &WindowJSON{
+				Utilization:  17.0,
+				ResetsAt:     "2026-01-09T10:30:00Z",
+				ResetsAtText: formatResetTimeWithDate("2026-01-09T10:30:00Z"),
+			},
+		}
+		if got.Model != want.Model || got.TotalTokens != want.TotalTokens ||
+			*got.FiveHour != *want.FiveHour || *got.Weekly != *want.Weekly {
+			t.Errorf("output = %+v / %+v / %+v, expected %+v / %+v / %+v",
+				got, got.FiveHour, got.Weekly, want, want.FiveHour, want.Weekly)
+		}
+		if strings.Contains(output, "\033") || strings.Contains(output, " | ") {
+			t.Errorf("JSON output should not contain text formatting, got: %s", output)
+		}
+	})
+
+	t.Run("reset text follows the reset format settings", func(t *testing.T) {
+		output, _ := render(t, `{
+			"model": {"display_name": "Sonnet 4"},
+			"rate_limits": {
+				"five_hour": {"used_percentage": 42.5, "resets_at": 1767609030},
+				"seven_day": {"used_percentage": 17.0, "resets_at": 1767954630}
+			}
+		}`, func(cfg *Config) {
+			cfg.Timezone = "Asia/Tokyo"
+			cfg.ResetPrecision = resetPrecisionSecond
+		})
+
+		var got StatusJSON
+		if err := json.Unmarshal([]byte(output), &got); err != nil {
+			t.Fatalf("failed to decode output: %v", err)
+		}
+		if got.FiveHour.ResetsAtText != "19:30:30" {
+			t.Errorf("five_hour.resets_at_text = %q, expected %q", got.FiveHour.ResetsAtText, "19:30:30")
+		}
+		if got.Weekly.ResetsAtText != "01/09(Fri) 19:30:30" {
+			t.Errorf("weekly.resets_at_text = %q, expected %q", got.Weekly.ResetsAtText, "01/09(Fri) 19:30:30")
+		}
+	})
+
+	t.Run("absent weekly data is omitted", func(t *testing.T) {
+		_, fields := render(t, `{
+			"model": {"display_name": "Sonnet 4"},
+			"rate_limits": {"five_hour": {"used_percentage": 10.0, "resets_at": 1767609000}}
+		}`)
+		if _, ok := fields["weekly"]; ok {
+			t.Errorf("weekly should be omitted, got: %s", fields["weekly"])
+		}
+	})
+
+	t.Run("present zero weekly is serialized as 0", func(t *testing.T) {
+		_, fields := render(t, `{
+			"model": {"display_name": "Sonnet 4"},
+			"rate_limits": {
+				"five_hour": {"used_percentage": 10.0, "resets_at": 1767609000},
+				"seven_day": {"used_percentage": 0.0, "resets_at": 1767954600}
+			}
+		}`)
+		var weekly map[string]json.RawMessage
+		if err := json.Unmarshal(fields["weekly"], &weekly); err != nil {
+			t.Fatalf("weekly should be an object, got: %s", fields["weekly"])
+		}
+		if string(weekly["utilization"]) != "0" {
+			t.Errorf("weekly utilization = %s, expected 0", weekly["utilization"])
+		}
+	})
+
+	t.Run("--output overrides the config", func(t *testing.T) {
+		t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+		opts, err := parseArgs([]string{"--output", "json"}, io.Discard)
+		if err != nil {
+			t.Fatalf("parseArgs failed: %v", err)
+		}
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(append(opts.statusLineOptions(), noopHistoryMod)...)
+		input := `{"model":{"display_name":"Sonnet 4"},"rate_limits":{"five_hour":{"used_percentage":10.0,"resets_at":1767609000}}}`
+		if err := sl.run(strings.NewReader(input), stdout, filepath.Join(t.TempDir(), "cache.json")); err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+		if !json.Valid(stdout.Bytes()) {
+			t.Errorf("output should be JSON, got: %s", stdout.String())
+		}
+	})
+
+	t.Run("invalid --output value", func(t *testing.T) {
+		if _, err := parseArgs([]string{"--output", "yaml"}, io.Discard); err == nil {
+			t.Error("parseArgs should reject an unknown output format")
+		}
+	})
+}
+
+func TestReadOnlyCache(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+
+	readOnlyDir := filepath.Join(t.TempDir(), "readonly")
+	if err := os.Mkdir(readOnlyDir, 0555); err != nil {
+		t.Fatalf("failed to create readonly dir: %v", err)
+	}
+	defer os.Chmod(readOnlyDir, 0755)
+	cacheFile := filepath.Join(readOnlyDir, "cache.json")
+
+	var hits int32
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&hits, 1)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":64.0}}`)),
+			Request:    r,
+		}, nil
+	})}
+	stderr := &bytes.Buffer{}
+	sl := NewStatusLine(
+		WithHTTPClient(client),
+		WithStderr(stderr),
+		WithAccessTokenFunc(func() (string, error) {
+			return "test-token", nil
+		}),
+		WithHistoryModTimeFunc(func() (time.Time, error) {
+			return time.Time{}, os.ErrNotExist
+		}),
+	)
+
+	for i := 0; i < 2; i++ {
+		stdout := &bytes.Buffer{}
+		if err := sl.runWithConfig(strings.NewReader(`{"model":{"display_name":"Sonnet 4"}}`), stdout, cacheFile, defaultConfig()); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		if !strings.Contains(stdout.String(), "64.0%") {
+			t.Errorf("run %d should still render fetched data, got: %s", i+1, stdout.String())
+		}
+	}
+
+	if atomic.LoadInt32(&hits) != 2 {
+		t.Errorf("expected 2 fetches, got %d", hits)
+	}
+	if n := strings.Count(stderr.String(), "warning:"); n != 1 {
+		t.Errorf("expected exactly one warning, got %d: %s", n, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "cache is not writable") {
+		t.Errorf("warning should mention the unwritable cache, got: %s", stderr.String())
+	}
+}
+
+func TestSeparator(t *testing.T) {
+	noopHistoryMod := WithHistoryModTimeFunc(func() (time.Time, error) {
+		return time.Time{}, os.ErrNotExist
+	})
+	inputJSON := `{
+		"model": {"display_name": "Sonnet 4"},
+		"rate_limits": {
+			"five_hour": {"used_percentage": 10.0, "resets_at": 1743580800},
+			"seven_day": {"used_percentage": 20.0, "resets_at": 1744185600}
+		}
+	}`
+
+	for _, sep := range []string{" · ", "\t"} {
+		t.Run(fmt.Sprintf("separator %q", sep), func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.NoColor = true
+			cfg.Separator = sep
+			stdout := &bytes.Buffer{}
+			sl := NewStatusLine(noopHistoryMod)
+			if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+				t.Fatalf("runWithConfig failed: %v", err)
+			}
+
+			line := strings.TrimSuffix(stdout.String(), "\n")
+			if strings.Contains(line, defaultSeparator) {
+				t.Errorf("default separator should not appear, got: %q", line)
+			}
+			parts := strings.Split(line, sep)
+			want := []string{"go-statusline", "Model: Sonnet 4", "Total Tokens: 0", "ctx: ", "5h: ", "resets: ", "week: ", "resets: "}
+			if len(parts) != len(want) {
+				t.Fatalf("expected %d parts, got %d: %q", len(want), len(parts), parts)
+			}
+			for i, part := range parts {
+				if part == "" || !strings.HasPrefix(part, want[i]) {
+					t.Errorf("part %d = %q, expected prefix %q", i, part, want[i])
+				}
+			}
+		})
+	}
+
+	t.Run("empty separator falls back with a warning", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Separator = ""
+		warnings := cfg.validate()
+		if len(warnings) != 1 || !strings.Contains(warnings[0], "separator") {
+			t.Errorf("expected a separator warning, got: %v", warnings)
+		}
+		if cfg.Separator != defaultSeparator {
+			t.Errorf("Separator = %q, expected %q", cfg.Separator, defaultSeparator)
+		}
+	})
+}
+
+func TestCredentialsDiscovery(t *testing.T) {
+	writeCredentials := func(t *testing.T, path, token string) {
+		t.Helper()
+		os.MkdirAll(filepath.Dir(path), 0755)
+		data := fmt.Sprintf(`{"claudeAiOauth":{"accessToken":%q}}`, token)
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatalf("failed to write credentials: %v", err)
+		}
+	}
+	failingKeychain := WithExecCommand(func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+		return exec.Command("false")
+	})
+
+	t.Run("CLAUDE_CONFIG_DIR", func(t *testing.T) {
+		configDir := t.TempDir()
+		t.Setenv("CLAUDE_CONFIG_DIR", configDir)
+		writeCredentials(t, filepath.Join(configDir, ".credentials.json"), "env-token")
+
+		token, err := NewStatusLine(failingKeychain).getAccessToken()
+		if err != nil {
+			t.Fatalf("getAccessToken failed: %v", err)
+		}
+		if token != "env-token" {
+			t.Errorf("token = %s, expected env-token", token)
+		}
+	})
+
+	t.Run("credentials_path overrides CLAUDE_CONFIG_DIR", func(t *testing.T) {
+		configDir := t.TempDir()
+		t.Setenv("CLAUDE_CONFIG_DIR", configDir)
+		writeCredentials(t, filepath.Join(configDir, ".credentials.json"), "env-token")
+		customPath := filepath.Join(t.TempDir(), "custom", "creds.json")
+		writeCredentials(t, customPath, "custom-token")
+
+		cfg := defaultConfig()
+		cfg.CredentialsPath = customPath
+		token, err := NewStatusLine(failingKeychain, WithConfig(cfg)).getAccessToken()
+		if err != nil {
+			t.Fatalf("getAccessToken failed: %v", err)
+		}
+		if token != "custom-token" {
+			t.Errorf("token = %s, expected custom-token", token)
+		}
+	})
+
+	t.Run("default path", func(t *testing.T) {
+		home := t.TempDir()
+		t.Setenv("HOME", home)
+		t.Setenv("CLAUDE_CONFIG_DIR", "")
+
+		path, err := credentialsFilePath("")
+		if err != nil {
+			t.Fatalf("credentialsFilePath failed: %v", err)
+		}
+		if want := filepath.Join(home, ".claude", ".credentials.json"); path != want {
+			t.Errorf("path = %s, expected %s", path, want)
+		}
+	})
+}
+
+func TestSanityDeltaCap(t *testing.T) {
+	tests := []struct {
+		name      string
+		prevUsage float64
+		prevReset string
+		newUsage  float64
+		wantUsage float64
+		wantWarn  bool
+	}{
+		{"implausible jump is held", 0.0, "2026-01-27T12:00:00Z", 95.0, 0.0, true},
+		{"normal change is applied", 40.0, "2026-01-27T12:00:00Z", 48.0, 48.0, false},
+		{"new reset period is applied", 95.0, "2026-01-27T07:00:00Z", 2.0, 2.0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheFile := filepath.Join(t.TempDir(), "cache.json")
+			saveCache(cacheFile, &CacheData{
+				ResetsAt:    tt.prevReset,
+				Utilization: tt.prevUsage,
+				CachedAt:    time.Now().Unix() - 300,
+			})
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":%f}}`, tt.newUsage)
+			}))
+			defer server.Close()
+
+			cfg := defaultConfig()
+			cfg.SanityDeltaCap = 50
+			stderr := &bytes.Buffer{}
+			sl := NewStatusLine(
+				WithConfig(cfg),
+				WithStderr(stderr),
+				WithHTTPClient(server.Client()),
+				WithAccessTokenFunc(func() (string, error) {
+					return "test-token", nil
+				}),
+			)
+
+			cache, err := sl.fetchFromAPI(cacheFile, server.URL)
+			if err != nil {
+				t.Fatalf("fetchFromAPI failed: %v", err)
+			}
+			if cache.Utilization != tt.wantUsage {
+				t.Errorf("rendered Utilization = %f, expected %f", cache.Utilization, tt.wantUsage)
+			}
+			if got := strings.Contains(stderr.String(), "implausible usage jump"); got != tt.wantWarn {
+				t.Errorf("warning = %v, expected %v; stderr: %s", got, tt.wantWarn, stderr.String())
+			}
+
+			// キャッシュには常に新しい値が保存される
+			saved, err := readCache(cacheFile)
+			if err != nil {
+				t.Fatalf("failed to read cache: %v", err)
+			}
+			if saved.Utilization != tt.newUsage {
+				t.Errorf("saved Utilization = %f, expected %f", saved.Utilization, tt.newUsage)
+			}
+		})
+	}
+}
+
+func TestShowList(t *testing.T) {
+	configHome := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", configHome)
+
+	// 設定ファイルではトークン数を非表示、コストを表示にしておく
+	cfg := defaultConfig()
+	cfg.ShowTokens = false
+	cfg.ShowCost = true
+	configPath := filepath.Join(configHome, appName, "config.json")
+	if err := saveConfig(configPath, cfg); err != nil {
+		t.Fatalf("saveConfig failed: %v", err)
+	}
+
+	inputJSON := `{
+		"model": {"display_name": "Sonnet 4"},
+		"cost": {"total_cost_usd": 0.5},
+		"context_window": {"total_input_tokens": 1200, "total_output_tokens": 300},
+		"rate_limits": {
+			"five_hour": {"used_percentage": 10.0, "resets_at": 1743580800},
+			"seven_day": {"used_percentage": 20.0, "resets_at": 1744185600}
+		}
+	}`
+	stdout := &bytes.Buffer{}
+	sl := NewStatusLine(
+		WithShowList([]string{"tokens", "5h", "week"}),
+		WithIsTerminalFunc(func(io.Writer) bool { return false }),
+		WithHistoryModTimeFunc(func() (time.Time, error) {
+			return time.Time{}, os.ErrNotExist
+		}),
+	)
+	if err := sl.run(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json")); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	parts := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), defaultSeparator)
+	want := []string{"Total Tokens: 1.5k", "5h: ", "week: "}
+	if len(parts) != len(want) {
+		t.Fatalf("expected %d parts, got %d: %q", len(want), len(parts), parts)
+	}
+	for i, part := range parts {
+		if !strings.HasPrefix(part, want[i]) {
+			t.Errorf("part %d = %q, expected prefix %q", i, part, want[i])
+		}
+	}
+
+	// 設定ファイルは変更されない
+	saved, err := loadConfigFromPath(configPath)
+	if err != nil {
+		t.Fatalf("loadConfigFromPath failed: %v", err)
+	}
+	if saved.ShowTokens || !saved.ShowCost || !saved.ShowAppName {
+		t.Error("--show should not persist to the config file")
+	}
+
+	t.Run("effort without model", func(t *testing.T) {
+		inputJSON := `{"model": {"display_name": "Opus 4.8"}, "effort": {"level": "high"}}`
+		render := func(t *testing.T, keys ...string) string {
+			t.Helper()
+			stdout := &bytes.Buffer{}
+			sl := NewStatusLine(
+				WithShowList(keys),
+				WithIsTerminalFunc(func(io.Writer) bool { return false }),
+				WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }),
+			)
+			if err := sl.run(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json")); err != nil {
+				t.Fatalf("run failed: %v", err)
+			}
+			return strings.TrimSuffix(stdout.String(), "\n")
+		}
+
+		if got := render(t, "effort"); got != "effort: high" {
+			t.Errorf("--show effort = %q, expected %q", got, "effort: high")
+		}
+		if got := render(t, "model", "effort"); got != "Model: Opus 4.8 - high" {
+			t.Errorf("--show model,effort = %q, expected %q", got, "Model: Opus 4.8 - high")
+		}
+	})
+}
+
+// errWriter は常に指定したエラーを返す io.Writer
+type errWriter struct {
+	err error
+}
+
+func (w errWriter) Write(p []byte) (int, error) {
+	return 0, w.err
+}
+
+func TestBrokenPipe(t *testing.T) {
+	noopHistoryMod := WithHistoryModTimeFunc(func() (time.Time, error) {
+		return time.Time{}, os.ErrNotExist
+	})
+	inputJSON := `{"model":{"display_name":"Sonnet 4"},"rate_limits":{"five_hour":{"used_percentage":10.0,"resets_at":1743580800}}}`
+
+	t.Run("closed pipe is not fatal", func(t *testing.T) {
+		r, w := io.Pipe()
+		r.Close()
+
+		sl := NewStatusLine(noopHistoryMod)
+		if err := sl.runWithConfig(strings.NewReader(inputJSON), w, filepath.Join(t.TempDir(), "cache.json"), defaultConfig()); err != nil {
+			t.Errorf("runWithConfig should ignore a closed pipe, got: %v", err)
+		}
+	})
+
+	t.Run("EPIPE is not fatal", func(t *testing.T) {
+		sl := NewStatusLine(noopHistoryMod)
+		stdout := errWriter{&os.PathError{Op: "write", Path: "/dev/stdout", Err: syscall.EPIPE}}
+		if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json"), defaultConfig()); err != nil {
+			t.Errorf("runWithConfig should ignore EPIPE, got: %v", err)
+		}
+	})
+
+	t.Run("other write errors are returned", func(t *testing.T) {
+		sl := NewStatusLine(noopHistoryMod)
+		stdout := errWriter{errors.New("disk full")}
+		if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json"), defaultConfig()); err == nil {
+			t.Error("runWithConfig should return other write errors")
+		}
+	})
+}
+
+func TestFetchRetry(t *testing.T) {
+	newStatusLine := func(client *http.Client, sleeps *[]time.Duration) *StatusLine {
+		return NewStatusLine(
+			WithHTTPClient(client),
+			WithStderr(io.Discard),
+			WithSleepFunc(func(d time.Duration) { *sleeps = append(*sleeps, d) }),
+			WithAccessTokenFunc(func() (string, error) {
+				return "test-token", nil
+			}),
+		)
+	}
+
+	t.Run("retries 5xx with exponential backoff", func(t *testing.T) {
+		var attempts int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&attempts, 1) <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":33.0}}`))
+		}))
+		defer server.Close()
+
+		var sleeps []time.Duration
+		cache, err := newStatusLine(server.Client(), &sleeps).fetchFromAPI(filepath.Join(t.TempDir(), "cache.json"), server.URL)
+		if err != nil {
+			t.Fatalf("fetchFromAPI failed: %v", err)
+		}
+		if cache.Utilization != 33.0 {
+			t.Errorf("Utilization = %f, expected 33.0", cache.Utilization)
+		}
+		if n := atomic.LoadInt32(&attempts); n != 3 {
+			t.Errorf("expected 3 attempts, got %d", n)
+		}
+		if fmt.Sprint(sleeps) != "[200ms 400ms]" {
+			t.Errorf("sleeps = %v, expected [200ms 400ms]", sleeps)
+		}
+	})
+
+	t.Run("gives up after the configured attempts", func(t *testing.T) {
+		var attempts int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&attempts, 1)
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer server.Close()
+
+		var sleeps []time.Duration
+		sl := newStatusLine(server.Client(), &sleeps)
+		sl.cfg.APIMaxAttempts = 2
+		sl.cfg.APIRetryBaseDelayMillis = 50
+		if _, err := sl.fetchFromAPI(filepath.Join(t.TempDir(), "cache.json"), server.URL); err == nil {
+			t.Error("fetchFromAPI should fail after all attempts")
+		}
+		if n := atomic.LoadInt32(&attempts); n != 2 {
+			t.Errorf("expected 2 attempts, got %d", n)
+		}
+		if fmt.Sprint(sleeps) != "[50ms]" {
+			t.Errorf("sleeps = %v, expected [50ms]", sleeps)
+		}
+	})
+
+	t.Run("retries connection errors", func(t *testing.T) {
+		var attempts int32
+		client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			if atomic.AddInt32(&attempts, 1) == 1 {
+				return nil, errors.New("connection reset by peer")
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(`{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":12.0}}`)),
+				Request:    r,
+			}, nil
+		})}
+
+		var sleeps []time.Duration
+		if _, err := newStatusLine(client, &sleeps).fetchFromAPI(filepath.Join(t.TempDir(), "cache.json"), "https://example.invalid/usage"); err != nil {
+			t.Fatalf("fetchFromAPI failed: %v", err)
+		}
+		if n := atomic.LoadInt32(&attempts); n != 2 {
+			t.Errorf("expected 2 attempts, got %d", n)
+		}
+	})
+
+	for _, status := range []int{http.StatusUnauthorized, http.StatusTooManyRequests} {
+		t.Run(fmt.Sprintf("does not retry %d", status), func(t *testing.T) {
+			var attempts int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&attempts, 1)
+				w.WriteHeader(status)
+			}))
+			defer server.Close()
+
+			var sleeps []time.Duration
+			if _, err := newStatusLine(server.Client(), &sleeps).fetchFromAPI(filepath.Join(t.TempDir(), "cache.json"), server.URL); err == nil {
+				t.Error("fetchFromAPI should fail")
+			}
+			if n := atomic.LoadInt32(&attempts); n != 1 {
+				t.Errorf("expected 1 attempt, got %d", n)
+			}
+			if len(sleeps) != 0 {
+				t.Errorf("should not sleep, got %v", sleeps)
+			}
+		})
+	}
+}
+
+func TestPrimaryWindow(t *testing.T) {
+	noopHistoryMod := WithHistoryModTimeFunc(func() (time.Time, error) {
+		return time.Time{}, os.ErrNotExist
+	})
+	render := func(t *testing.T, cacheFile string, cfg *Config, fiveHour, weekly float64) string {
+		t.Helper()
+		inputJSON := fmt.Sprintf(`{
+			"model": {"display_name": "Sonnet 4"},
+			"rate_limits": {
+				"five_hour": {"used_percentage": %.1f, "resets_at": 1743580800},
+				"seven_day": {"used_percentage": %.1f, "resets_at": 1744185600}
+			}
+		}`, fiveHour, weekly)
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(noopHistoryMod)
+		if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, cacheFile, cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		return stdout.String()
+	}
+
+	t.Run("notification follows the weekly window", func(t *testing.T) {
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		cfg := defaultConfig()
+		cfg.PrimaryWindow = windowSevenDay
+		cfg.NotifyAbove = 80
+		cfg.NotifyMethod = notifyMethodOSC9
+
+		// 5時間使用率が閾値を超えても週間が閾値未満なら通知しない
+		if out := render(t, cacheFile, cfg, 95, 40); strings.Contains(out, "\033]9;") {
+			t.Errorf("should not notify on five-hour usage, got %q", out)
+		}
+		out := render(t, cacheFile, cfg, 10, 85)
+		if !strings.Contains(out, "\033]9;go-statusline: week usage 85.0%\a") {
+			t.Errorf("should notify on weekly usage, got %q", out)
+		}
+	})
+
+	t.Run("idle follows the weekly window", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.PrimaryWindow = windowSevenDay
+		cfg.IdleLabel = "idle"
+
+		if out := render(t, filepath.Join(t.TempDir(), "cache.json"), cfg, 12, 0); out != "idle\n" {
+			t.Errorf("weekly 0%% should be idle, got %q", out)
+		}
+		if out := render(t, filepath.Join(t.TempDir(), "cache.json"), cfg, 0, 30); out == "idle\n" {
+			t.Error("weekly usage should not be idle")
+		}
+	})
+
+	t.Run("unknown value falls back to five_hour", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.PrimaryWindow = "thirty_day"
+		if warnings := cfg.validate(); len(warnings) != 1 || cfg.PrimaryWindow != "" {
+			t.Errorf("expected a warning and the default, got %v / %q", warnings, cfg.PrimaryWindow)
+		}
+	})
+}
+
+func TestRetryAfter(t *testing.T) {
+	newServer := func(hits *atomic.Int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}))
+	}
+	newSL := func(server *httptest.Server, now time.Time) *StatusLine {
+		return NewStatusLine(
+			WithHTTPClient(server.Client()),
+			WithAccessTokenFunc(func() (string, error) { return "test-token", nil }),
+			WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }),
+			WithNowFunc(func() time.Time { return now }),
+		)
+	}
+	now := time.Date(2026, 1, 27, 9, 0, 0, 0, time.UTC)
+
+	t.Run("reuses stale cache within window", func(t *testing.T) {
+		var hits atomic.Int32
+		server := newServer(&hits)
+		defer server.Close()
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		if err := saveCache(cacheFile, &CacheData{
+			ResetsAt:    "2026-01-27T10:00:00Z",
+			Utilization: 70.0,
+			CachedAt:    now.Add(-10 * time.Minute).Unix(),
+		}); err != nil {
+			t.Fatalf("failed to save cache: %v", err)
+		}
+
+		sl := newSL(server, now)
+		if _, err := sl.getCachedOrFetch(cacheFile, server.URL); err != nil {
+			t.Fatalf("first call: %v", err)
+		}
+		sl = newSL(server, now.Add(119*time.Second))
+		cache, err := sl.getCachedOrFetch(cacheFile, server.URL)
+		if err != nil {
+			t.Fatalf("second call: %v", err)
+		}
+		if cache.Utilization != 70.0 {
+			t.Errorf("Utilization = %v, want 70", cache.Utilization)
+		}
+		if got := hits.Load(); got != 1 {
+			t.Errorf("API hits = %d, want 1", got)
+		}
+
+		// 期間経過後は再取得する
+		sl = newSL(server, now.Add(121*time.Second))
+		sl.getCachedOrFetch(cacheFile, server.URL)
+		if got := hits.Load(); got != 2 {
+			t.Errorf("API hits after window = %d, want 2", got)
+		}
+	})
+
+	t.Run("no request within window without cache", func(t *testing.T) {
+		var hits atomic.Int32
+		server := newServer(&hits)
+		defer server.Close()
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+
+		sl := newSL(server, now)
+		if _, err := sl.getCachedOrFetch(cacheFile, server.URL); err == nil {
+			t.Fatal("first call should fail without cache")
+		}
+		sl = newSL(server, now.Add(time.Minute))
+		if _, err := sl.getCachedOrFetch(cacheFile, server.URL); err == nil {
+			t.Fatal("second call should fail without cache")
+		}
+		if got := hits.Load(); got != 1 {
+			t.Errorf("API hits = %d, want 1", got)
+		}
+	})
+}
+
+func TestStaleFallback(t *testing.T) {
+	failingClient := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusInternalServerError,
+			Body:       io.NopCloser(strings.NewReader("")),
+			Request:    r,
+		}, nil
+	})}
+	inputJSON := `{"model": {"display_name": "Sonnet 4"}}`
+
+	t.Run("shows last known values", func(t *testing.T) {
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		if err := saveCache(cacheFile, &CacheData{
+			ResetsAt:          "2026-01-27T10:00:00Z",
+			Utilization:       42.0,
+			WeeklyUtilization: 12.0,
+			WeeklyResetsAt:    "2026-01-30T10:00:00Z",
+			CachedAt:          time.Now().Add(-10 * time.Minute).Unix(),
+		}); err != nil {
+			t.Fatalf("saveCache failed: %v", err)
+		}
+
+		cfg := defaultConfig()
+		cfg.NoColor = true
+		cfg.APIMaxAttempts = 1
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(
+			WithConfig(cfg),
+			WithStderr(io.Discard),
+			WithHTTPClient(failingClient),
+			WithAccessTokenFunc(func() (string, error) { return "test-token", nil }),
+			WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }),
+		)
+		if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, cacheFile, cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		out := stdout.String()
+		if !strings.Contains(out, "42.0%") {
+			t.Errorf("output should contain %q, got: %q", "42.0%", out)
+		}
+		if strings.Contains(out, "5h: 0.0%") {
+			t.Errorf("output should not fall back to 0%%, got: %q", out)
+		}
+	})
+}
+
+func TestCacheMaxSamples(t *testing.T) {
+	samples := make([]float64, 500)
+	for i := range samples {
+		samples[i] = float64(i % 100)
+	}
+	cache := &CacheData{
+		ResetsAt:    "2026-01-27T10:00:00Z",
+		Utilization: 42.0,
+		CachedAt:    time.Now().Unix(),
+		Samples:     samples,
+	}
+
+	cfg := defaultConfig()
+	cfg.CacheMaxSamples = 50
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	NewStatusLine(WithConfig(cfg)).persistCache(cacheFile, cache)
+
+	saved, err := readCache(cacheFile)
+	if err != nil {
+		t.Fatalf("failed to read cache: %v", err)
+	}
+	if len(saved.Samples) != 50 {
+		t.Fatalf("len(Samples) = %d, expected 50", len(saved.Samples))
+	}
+	// 新しい履歴が残ること
+	if saved.Samples[49] != samples[499] || saved.Samples[0] != samples[450] {
+		t.Errorf("Samples should keep the newest entries, got first=%v last=%v", saved.Samples[0], saved.Samples[49])
+	}
+	if saved.Utilization != 42.0 || saved.ResetsAt != cache.ResetsAt {
+		t.Errorf("current fields should be preserved, got %+v", saved)
+	}
+	// 表示用のデータは切り詰めない
+	if len(cache.Samples) != 500 {
+		t.Errorf("in-memory Samples should be untouched, got %d", len(cache.Samples))
+	}
+
+	t.Run("fetch keeps history up to the configured cap", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":99.0}}`))
+		}))
+		defer server.Close()
+
+		for _, maxSamples := range []int{defaultCacheMaxSamples, 30} {
+			cacheFile := filepath.Join(t.TempDir(), "cache.json")
+			if err := saveCache(cacheFile, &CacheData{ResetsAt: "2026-01-27T10:00:00Z", CachedAt: time.Now().Unix() - 300, Samples: samples}); err != nil {
+				t.Fatal(err)
+			}
+			cfg := defaultConfig()
+			cfg.CacheMaxSamples = maxSamples
+			sl := NewStatusLine(
+				WithConfig(cfg),
+				WithHTTPClient(server.Client()),
+				WithAccessTokenFunc(func() (string, error) { return "test-token", nil }),
+			)
+			if _, err := sl.fetchFromAPI(cacheFile, server.URL); err != nil {
+				t.Fatalf("fetchFromAPI failed: %v", err)
+			}
+			saved, err := readCache(cacheFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// sparkline_samples（デフォルト20）ではなく cache_max_samples で切り詰める
+			if len(saved.Samples) != maxSamples || saved.Samples[maxSamples-1] != 99.0 {
+				t.Errorf("cache_max_samples=%d: persisted %d samples ending with %v", maxSamples, len(saved.Samples), saved.Samples[len(saved.Samples)-1])
+			}
+		}
+	})
+}
+
+func TestContextLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		model     string
+		overrides map[string]int64
+		want      int64
+	}{
+		{"known model", "Sonnet 4 (1M context)", nil, 1000000},
+		{"unknown model falls back to default", "Mystery 1", nil, defaultContextLimit},
+		{"override wins", "Sonnet 4", map[string]int64{"Sonnet 4": 500000}, 500000},
+		{"non-positive override is ignored", "Sonnet 4", map[string]int64{"Sonnet 4": 0}, 200000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contextLimit(tt.model, tt.overrides); got != tt.want {
+				t.Errorf("contextLimit(%q) = %d, expected %d", tt.model, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShowContextPct(t *testing.T) {
+	tests := []struct {
+		name      string
+		model     string
+		tokens    int64
+		wantPct   string
+		wantColor string
+	}{
+		{"known model", "Sonnet 4 (1M context)", 100000, "10.0%", colorGreen},
+		{"unknown model", "Mystery 1", 40000, "20.0%", colorGreen},
+		{"yellow", "Sonnet 4", 60000, "30.0%", colorYellow},
+		{"orange", "Sonnet 4", 120000, "60.0%", colorOrange},
+		{"red", "Sonnet 4", 180000, "90.0%", colorRed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inputJSON := fmt.Sprintf(`{
+				"model": {"display_name": %q},
+				"context_window": {"total_input_tokens": %d, "total_output_tokens": 0},
+				"rate_limits": {"five_hour": {"used_percentage": 10, "resets_at": 1743580800}}
+			}`, tt.model, tt.tokens)
+			cfg := defaultConfig()
+			if err := cfg.applyShowList([]string{segContextPct}); err != nil {
+				t.Fatalf("applyShowList failed: %v", err)
+			}
+			stdout := &bytes.Buffer{}
+			sl := NewStatusLine(WithStderr(io.Discard))
+			if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+				t.Fatalf("runWithConfig failed: %v", err)
+			}
+			want := "limit: " + tt.wantColor + tt.wantPct
+			if !strings.HasPrefix(stdout.String(), want) {
+				t.Errorf("output should start with %q, got: %q", want, stdout.String())
+			}
+		})
+	}
+}
+
+func TestCompact(t *testing.T) {
+	inputJSON := `{
+		"model": {"display_name": "Sonnet 4"},
+		"context_window": {"total_input_tokens": 1000, "total_output_tokens": 500},
+		"rate_limits": {
+			"five_hour": {"used_percentage": 50, "resets_at": 1743580800},
+			"seven_day": {"used_percentage": 20, "resets_at": 1744185600}
+		}
+	}`
+	render := func(t *testing.T, cfg *Config) string {
+		t.Helper()
+		cfg.NoColor = true
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(WithStderr(io.Discard))
+		if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		return stdout.String()
+	}
+
+	t.Run("short labels", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Compact = true
+		out := render(t, cfg)
+		for _, want := range []string{"M: Sonnet 4", "T: 1.5k", "5h: 50.0% [█████     ]", "w: 20.0%", "r: "} {
+			if !strings.Contains(out, want) {
+				t.Errorf("output should contain %q, got: %q", want, out)
+			}
+		}
+		for _, long := range []string{"Model:", "Total Tokens:", "week:", "resets:"} {
+			if strings.Contains(out, long) {
+				t.Errorf("output should not contain %q, got: %q", long, out)
+			}
+		}
+	})
+
+	t.Run("respects show toggles", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Compact = true
+		cfg.ShowModel = false
+		cfg.ShowWeekResets = false
+		out := render(t, cfg)
+		if strings.Contains(out, "M: ") {
+			t.Errorf("model should be hidden, got: %q", out)
+		}
+		if strings.Count(out, "r: ") != 1 {
+			t.Errorf("only the 5h reset should be shown, got: %q", out)
+		}
+	})
+
+	t.Run("explicit bar width is kept", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Compact = true
+		cfg.BarWidth = 4
+		if out := render(t, cfg); !strings.Contains(out, "50.0% [██  ]") {
+			t.Errorf("bar width should stay 4, got: %q", out)
+		}
+	})
+}
+
+func TestWarnStaleHistoryHours(t *testing.T) {
+	now := time.Date(2026, 1, 27, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		modTime  time.Time
+		wantHint bool
+	}{
+		{"old history", now.Add(-72 * time.Hour), true},
+		{"recent history", now.Add(-10 * time.Minute), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			historyFile := filepath.Join(t.TempDir(), "history.jsonl")
+			if err := os.WriteFile(historyFile, []byte("{}\n"), 0644); err != nil {
+				t.Fatalf("failed to write history: %v", err)
+			}
+			if err := os.Chtimes(historyFile, tt.modTime, tt.modTime); err != nil {
+				t.Fatalf("failed to set mod time: %v", err)
+			}
+
+			stderr := &bytes.Buffer{}
+			newStatusLine := func() *StatusLine {
+				return NewStatusLine(
+					WithStderr(stderr),
+					WithNowFunc(func() time.Time { return now }),
+					WithHistoryModTimeFunc(func() (time.Time, error) {
+						return getHistoryModTimeWithPath(historyFile)
+					}),
+				)
+			}
+			// 表示ごとに別のプロセスで実行されてもヒントは1回だけ
+			stateFile := stateFilePath(filepath.Join(t.TempDir(), "cache.json"))
+			newStatusLine().warnStaleHistory(stateFile, 24)
+			newStatusLine().warnStaleHistory(stateFile, 24)
+
+			wantCount := 0
+			if tt.wantHint {
+				wantCount = 1
+			}
+			if got := strings.Count(stderr.String(), "history path"); got != wantCount {
+				t.Errorf("hint count = %d, expected %d; stderr: %q", got, wantCount, stderr.String())
+			}
+		})
+	}
+
+	t.Run("warns again after history is updated and goes stale", func(t *testing.T) {
+		modTime := now.Add(-72 * time.Hour)
+		stderr := &bytes.Buffer{}
+		newStatusLine := func(now time.Time) *StatusLine {
+			return NewStatusLine(
+				WithStderr(stderr),
+				WithNowFunc(func() time.Time { return now }),
+				WithHistoryModTimeFunc(func() (time.Time, error) { return modTime, nil }),
+			)
+		}
+		stateFile := stateFilePath(filepath.Join(t.TempDir(), "cache.json"))
+		newStatusLine(now).warnStaleHistory(stateFile, 24)
+
+		modTime = now.Add(time.Hour)
+		later := now.Add(48 * time.Hour)
+		newStatusLine(later).warnStaleHistory(stateFile, 24)
+		if got := strings.Count(stderr.String(), "history path"); got != 2 {
+			t.Errorf("hint count = %d, expected 2; stderr: %q", got, stderr.String())
+		}
+	})
+}
+
+func TestResetDisplay(t *testing.T) {
+	now := time.Date(2026, 1, 27, 9, 48, 0, 0, time.UTC)
+	resetsAt := now.Add(42 * time.Minute)
+	clock := resetsAt.Local().Format("15:04")
+
+	tests := []struct {
+		display string
+		want    string
+	}{
+		{resetDisplayClock, "resets: " + clock + " "},
+		{resetDisplayRelative, "resets: 42m "},
+		{resetDisplayBoth, "resets: " + clock + " (in 42m) "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.display, func(t *testing.T) {
+			inputJSON := fmt.Sprintf(`{
+				"model": {"display_name": "Sonnet 4"},
+				"rate_limits": {"five_hour": {"used_percentage": 10, "resets_at": %d}}
+			}`, resetsAt.Unix())
+			cfg := defaultConfig()
+			cfg.ResetDisplay = tt.display
+			stdout := &bytes.Buffer{}
+			sl := NewStatusLine(WithStderr(io.Discard), WithNowFunc(func() time.Time { return now }))
+			if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+				t.Fatalf("runWithConfig failed: %v", err)
+			}
+			if !strings.Contains(stdout.String(), tt.want) {
+				t.Errorf("output should contain %q, got: %q", tt.want, stdout.String())
+			}
+		})
+	}
+
+	t.Run("both after reset", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.ResetDisplay = resetDisplayBoth
+		sl := NewStatusLine(WithNowFunc(func() time.Time { return resetsAt.Add(time.Minute) }))
+		if got, want := sl.formatReset(resetsAt.Format(time.RFC3339), clock, cfg), clock+" (now)"; got != want {
+			t.Errorf("formatReset = %q, expected %q", got, want)
+		}
+	})
+
+	t.Run("unknown value falls back to clock", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.ResetDisplay = "bogus"
+		if warnings := cfg.validate(); len(warnings) != 1 || cfg.ResetDisplay != resetDisplayClock {
+			t.Errorf("validate() = %v, ResetDisplay = %q", warnings, cfg.ResetDisplay)
+		}
+	})
+}
+
+func TestShowBar(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ShowBar = false
+
+	got := colorizeUsageWithStyle(45.0, cfg.barStyle())
+	if want := colorYellow + "45.0%" + colorReset; got != want {
+		t.Errorf("colorizeUsageWithStyle = %q, expected %q", got, want)
+	}
+	// ANSI コードにも "[" が含まれるため " [" と "]" で判定する
+	if strings.Contains(got, " [") || strings.Contains(got, "]") {
+		t.Errorf("bar should be omitted, got: %q", got)
+	}
+
+	cfg.NoColor = true
+	if got := colorizeUsageWithStyle(80.0, cfg.barStyle()); got != "80.0%" {
+		t.Errorf("colorizeUsageWithStyle without color = %q, expected %q", got, "80.0%")
+	}
+
+	t.Run("rendered line", func(t *testing.T) {
+		inputJSON := `{
+			"model": {"display_name": "Sonnet 4"},
+			"rate_limits": {
+				"five_hour": {"used_percentage": 90, "resets_at": 1743580800},
+				"seven_day": {"used_percentage": 10, "resets_at": 1744185600}
+			}
+		}`
+		cfg := defaultConfig()
+		cfg.ShowBar = false
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(WithStderr(io.Discard))
+		if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		out := stdout.String()
+		if strings.Contains(out, " [") || strings.Contains(out, "]") {
+			t.Errorf("bars should be omitted, got: %q", out)
+		}
+		for _, want := range []string{"5h: " + colorRed + "90.0%" + colorReset, "week: " + colorGreen + "10.0%" + colorReset} {
+			if !strings.Contains(out, want) {
+				t.Errorf("output should contain %q, got: %q", want, out)
+			}
+		}
+	})
+}
+
+func TestResetAsCountdown(t *testing.T) {
+	now := time.Date(2026, 1, 27, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		until time.Duration
+		want  string
+	}{
+		{"sub-minute", 30 * time.Second, "resets in <1m"},
+		{"multi-hour", 2*time.Hour + 13*time.Minute + 10*time.Second, "resets in 2h14m"},
+		{"past reset", -5 * time.Minute, "resets: now"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inputJSON := fmt.Sprintf(`{
+				"model": {"display_name": "Sonnet 4"},
+				"rate_limits": {"five_hour": {"used_percentage": 10, "resets_at": %d}}
+			}`, now.Add(tt.until).Unix())
+			cfg := defaultConfig()
+			cfg.ResetAsCountdown = true
+			cfg.ShowWeekResets = false
+			stdout := &bytes.Buffer{}
+			sl := NewStatusLine(WithStderr(io.Discard), WithNowFunc(func() time.Time { return now }))
+			if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+				t.Fatalf("runWithConfig failed: %v", err)
+			}
+			if !strings.Contains(stdout.String(), tt.want) {
+				t.Errorf("output should contain %q, got: %q", tt.want, stdout.String())
+			}
+		})
+	}
+}
+
+func TestSaveRawResponsePath(t *testing.T) {
+	body := `{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":33.0},"extra":"kept as is"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+
+	newSL := func(cfg *Config, stderr io.Writer) *StatusLine {
+		return NewStatusLine(
+			WithConfig(cfg),
+			WithStderr(stderr),
+			WithHTTPClient(server.Client()),
+			WithAccessTokenFunc(func() (string, error) { return "secret-token", nil }),
+		)
+	}
+
+	t.Run("writes the raw body", func(t *testing.T) {
+		dir := t.TempDir()
+		cfg := defaultConfig()
+		cfg.SaveRawResponsePath = filepath.Join(dir, "raw.json")
+		if _, err := newSL(cfg, io.Discard).fetchFromAPI(filepath.Join(dir, "cache.json"), server.URL); err != nil {
+			t.Fatalf("fetchFromAPI failed: %v", err)
+		}
+		raw, err := os.ReadFile(cfg.SaveRawResponsePath)
+		if err != nil {
+			t.Fatalf("failed to read raw response: %v", err)
+		}
+		if string(raw) != body {
+			t.Errorf("raw response = %q, expected %q", raw, body)
+		}
+		if strings.Contains(string(raw), "secret-token") {
+			t.Error("raw response should not contain the token")
+		}
+	})
+
+	t.Run("write failure is tolerated", func(t *testing.T) {
+		dir := t.TempDir()
+		blocker := filepath.Join(dir, "file")
+		if err := os.WriteFile(blocker, nil, 0644); err != nil {
+			t.Fatalf("failed to create file: %v", err)
+		}
+		cfg := defaultConfig()
+		cfg.SaveRawResponsePath = filepath.Join(blocker, "raw.json")
+		stderr := &bytes.Buffer{}
+		cache, err := newSL(cfg, stderr).fetchFromAPI(filepath.Join(dir, "cache.json"), server.URL)
+		if err != nil {
+			t.Fatalf("fetchFromAPI should succeed, got: %v", err)
+		}
+		if cache.Utilization != 33.0 {
+			t.Errorf("Utilization = %f, expected 33.0", cache.Utilization)
+		}
+		if !strings.Contains(stderr.String(), "failed to save raw response") {
+			t.Errorf("expected a warning, got: %q", stderr.String())
+		}
+	})
+}
+
+func TestAsyncFirstRender(t *testing.T) {
+	var hits atomic.Int32
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		hits.Add(1)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":37.0}}`)),
+			Request:    r,
+		}, nil
+	})}
+	inputJSON := `{"model": {"display_name": "Sonnet 4"}}`
+
+	cfg := defaultConfig()
+	cfg.AsyncFirstRender = true
+	cfg.NoColor = true
+	cfg.ShowHealthDot = true
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	newSL := func() *StatusLine {
+		return NewStatusLine(
+			WithStderr(io.Discard),
+			WithHTTPClient(client),
+			WithAccessTokenFunc(func() (string, error) { return "test-token", nil }),
+			WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }),
+		)
+	}
+
+	stdout := &bytes.Buffer{}
+	if err := newSL().runWithConfig(strings.NewReader(inputJSON), stdout, cacheFile, cfg); err != nil {
+		t.Fatalf("runWithConfig failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "5h: fetching…") {
+		t.Errorf("first render should show the placeholder, got: %q", stdout.String())
+	}
+	if strings.Contains(stdout.String(), "◐") {
+		t.Errorf("health dot should not report a running fetch as stale, got: %q", stdout.String())
+	}
+
+	// 終了前にバックグラウンドの取得が完了しキャッシュに保存されていること
+	cache, err := readCache(cacheFile)
+	if err != nil {
+		t.Fatalf("cache should be populated: %v", err)
+	}
+	if cache.Utilization != 37.0 {
+		t.Errorf("cached Utilization = %f, expected 37.0", cache.Utilization)
+	}
+
+	// 次回はキャッシュの値を表示する
+	stdout.Reset()
+	if err := newSL().runWithConfig(strings.NewReader(inputJSON), stdout, cacheFile, cfg); err != nil {
+		t.Fatalf("runWithConfig failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "5h: 37.0%") {
+		t.Errorf("second render should use the cache, got: %q", stdout.String())
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("API hits = %d, expected 1", got)
+	}
+
+	t.Run("background fetch waits for the fetch lock", func(t *testing.T) {
+		hits.Store(0)
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		lockFile := cacheFile + ".lock"
+		if err := os.WriteFile(lockFile, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		// ロックを持つ別のプロセスが取得を終えてキャッシュを書き込む
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			saveCache(cacheFile, &CacheData{ResetsAt: "2026-01-27T12:00:00Z", Utilization: 64.0, CachedAt: time.Now().Unix()})
+			os.Remove(lockFile)
+		}()
+
+		if err := newSL().runWithConfig(strings.NewReader(inputJSON), io.Discard, cacheFile, cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		if got := hits.Load(); got != 0 {
+			t.Errorf("API hits = %d, expected the cache written by the lock holder to be used", got)
+		}
+		if cache, err := readCache(cacheFile); err != nil || cache.Utilization != 64.0 {
+			t.Errorf("cache should be left as written by the lock holder, got %+v (err %v)", cache, err)
+		}
+	})
+}
+
+func TestResetTimeLayout(t *testing.T) {
+	fiveHour := time.Date(2026, 1, 27, 15, 30, 0, 0, time.UTC)
+	weekly := time.Date(2026, 1, 30, 9, 0, 0, 0, time.UTC)
+	inputJSON := fmt.Sprintf(`{
+		"model": {"display_name": "Sonnet 4"},
+		"rate_limits": {
+			"five_hour": {"used_percentage": 10, "resets_at": %d},
+			"seven_day": {"used_percentage": 20, "resets_at": %d}
+		}
+	}`, fiveHour.Unix(), weekly.Unix())
+
+	t.Run("custom layouts", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.ResetTimeLayout = "3:04 PM"
+		cfg.WeeklyResetTimeLayout = "Jan 2 15:04"
+		if warnings := cfg.validate(); len(warnings) != 0 {
+			t.Fatalf("validate() = %v, expected no warnings", warnings)
+		}
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(WithStderr(io.Discard))
+		if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		for _, want := range []string{
+			"resets: " + fiveHour.Local().Format("3:04 PM"),
+			"resets: " + weekly.Local().Format("Jan 2 15:04"),
+		} {
+			if !strings.Contains(stdout.String(), want) {
+				t.Errorf("output should contain %q, got: %q", want, stdout.String())
+			}
+		}
+	})
+
+	t.Run("invalid layouts fall back", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.ResetTimeLayout = ""
+		cfg.WeeklyResetTimeLayout = "soon"
+		if warnings := cfg.validate(); len(warnings) != 2 {
+			t.Errorf("validate() = %v, expected 2 warnings", warnings)
+		}
+		if cfg.ResetTimeLayout != defaultResetTimeLayout || cfg.WeeklyResetTimeLayout != defaultWeeklyResetTimeLayout {
+			t.Errorf("layouts = %q, %q, expected defaults", cfg.ResetTimeLayout, cfg.WeeklyResetTimeLayout)
+		}
+	})
+}
+
+func TestTimezone(t *testing.T) {
+	// 10:30 UTC は Asia/Tokyo（UTC+9、夏時間なし）で 19:30
+	resetsAt := time.Date(2026, 1, 27, 10, 30, 0, 0, time.UTC)
+	inputJSON := fmt.Sprintf(`{
+		"model": {"display_name": "Sonnet 4"},
+		"rate_limits": {
+			"five_hour": {"used_percentage": 10, "resets_at": %d},
+			"seven_day": {"used_percentage": 20, "resets_at": %d}
+		}
+	}`, resetsAt.Unix(), resetsAt.Add(72*time.Hour).Unix())
+
+	t.Run("fixed zone", func(t *testing.T) {
+		if _, err := time.LoadLocation("Asia/Tokyo"); err != nil {
+			t.Skipf("tzdata not available: %v", err)
+		}
+		cfg := defaultConfig()
+		cfg.Timezone = "Asia/Tokyo"
+		if warnings := cfg.validate(); len(warnings) != 0 {
+			t.Fatalf("validate() = %v, expected no warnings", warnings)
+		}
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(WithStderr(io.Discard))
+		if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		for _, want := range []string{"resets: 19:30", "resets: 01/30(Fri) 19:30"} {
+			if !strings.Contains(stdout.String(), want) {
+				t.Errorf("output should contain %q, got: %q", want, stdout.String())
+			}
+		}
+	})
+
+	t.Run("unknown zone falls back to local time", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Timezone = "Mars/Olympus_Mons"
+		if warnings := cfg.validate(); len(warnings) != 1 {
+			t.Errorf("validate() = %v, expected 1 warning", warnings)
+		}
+		if cfg.location() != time.Local {
+			t.Errorf("location() = %v, expected local time", cfg.location())
+		}
+	})
+}
+
+func TestAggregateProfiles(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	now := time.Now()
+	resetsAt := now.Add(2 * time.Hour).UTC().Format(time.RFC3339)
+	for name, usage := range map[string]float64{"personal": 40.0, "work": 72.0} {
+		if err := saveCache(profileCacheFilePath(name), &CacheData{
+			ResetsAt:    resetsAt,
+			Utilization: usage,
+			CachedAt:    now.Unix(),
+		}); err != nil {
+			t.Fatalf("saveCache failed: %v", err)
+		}
+	}
+	profiles := []string{"personal", "work", "missing"}
+	aggregate := func(profiles []string, mode string) (float64, string, bool) {
+		return aggregateUsage(profiles, mode, now, pollInterval)
+	}
+
+	t.Run("max", func(t *testing.T) {
+		usage, top, ok := aggregate(profiles, aggregateMax)
+		if !ok || usage != 72.0 || top != "work" {
+			t.Errorf("aggregateUsage = (%v, %q, %v), expected (72, \"work\", true)", usage, top, ok)
+		}
+	})
+
+	t.Run("sum", func(t *testing.T) {
+		usage, top, ok := aggregate(profiles, aggregateSum)
+		if !ok || usage != 112.0 || top != "work" {
+			t.Errorf("aggregateUsage = (%v, %q, %v), expected (112, \"work\", true)", usage, top, ok)
+		}
+	})
+
+	t.Run("no caches", func(t *testing.T) {
+		if _, _, ok := aggregate([]string{"missing"}, aggregateMax); ok {
+			t.Error("aggregateUsage should report no data")
+		}
+	})
+
+	t.Run("reset and stale caches", func(t *testing.T) {
+		// リセット時刻を過ぎた枠は使用率 0、取得から時間が経ったキャッシュは使わない
+		if err := saveCache(profileCacheFilePath("reset"), &CacheData{
+			ResetsAt:    now.Add(-3 * time.Hour).UTC().Format(time.RFC3339),
+			Utilization: 95.0,
+			CachedAt:    now.Unix(),
+		}); err != nil {
+			t.Fatalf("saveCache failed: %v", err)
+		}
+		if err := saveCache(profileCacheFilePath("stale"), &CacheData{
+			ResetsAt:    resetsAt,
+			Utilization: 90.0,
+			CachedAt:    now.Add(-time.Hour).Unix(),
+		}); err != nil {
+			t.Fatalf("saveCache failed: %v", err)
+		}
+
+		usage, top, ok := aggregate([]string{"personal", "reset", "stale"}, aggregateMax)
+		if !ok || usage != 40.0 || top != "personal" {
+			t.Errorf("aggregateUsage = (%v, %q, %v), expected (40, \"personal\", true)", usage, top, ok)
+		}
+		usage, top, ok = aggregate([]string{"reset"}, aggregateMax)
+		if !ok || usage != 0 || top != "reset" {
+			t.Errorf("aggregateUsage = (%v, %q, %v), expected (0, \"reset\", true)", usage, top, ok)
+		}
+		if _, _, ok := aggregate([]string{"stale"}, aggregateMax); ok {
+			t.Error("aggregateUsage should ignore a stale cache")
+		}
+	})
+
+	t.Run("invalid profile names", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.AggregateProfiles = []string{"work", "../etc", "a/b", "..", "personal"}
+		warnings := cfg.validate()
+		if len(warnings) != 3 {
+			t.Errorf("validate() = %v, expected 3 warnings", warnings)
+		}
+		if strings.Join(cfg.AggregateProfiles, ",") != "work,personal" {
+			t.Errorf("AggregateProfiles = %v, expected [work personal]", cfg.AggregateProfiles)
+		}
+	})
+
+	t.Run("rendered segment", func(t *testing.T) {
+		inputJSON := `{
+			"model": {"display_name": "Sonnet 4"},
+			"rate_limits": {"five_hour": {"used_percentage": 10, "resets_at": 1743580800}}
+		}`
+		cfg := defaultConfig()
+		cfg.NoColor = true
+		cfg.AggregateProfiles = profiles
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(WithStderr(io.Discard))
+		if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		if !strings.Contains(stdout.String(), "all: 72.0% [") || !strings.HasSuffix(stdout.String(), "] (work)\n") {
+			t.Errorf("output should end with the aggregate, got: %q", stdout.String())
+		}
+	})
+}
+
+func TestLogFile(t *testing.T) {
+	readEntries := func(t *testing.T, path string) []logEntry {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read log file: %v", err)
+		}
+		var entries []logEntry
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var entry logEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("invalid JSON log line %q: %v", line, err)
+			}
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	t.Run("warning is logged", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.LogFile = filepath.Join(t.TempDir(), "statusline.log")
+		stderr := &bytes.Buffer{}
+		sl := NewStatusLine(WithConfig(cfg), WithStderr(stderr))
+		sl.warnf("failed to save cache: %v", errors.New("disk full"))
+
+		if !strings.Contains(stderr.String(), "warning: failed to save cache: disk full") {
+			t.Errorf("warning should still go to stderr, got: %q", stderr.String())
+		}
+		entries := readEntries(t, cfg.LogFile)
+		if len(entries) != 1 {
+			t.Fatalf("expected 1 log entry, got %d", len(entries))
+		}
+		if entries[0].Level != logLevelWarn || entries[0].Message != "failed to save cache: disk full" {
+			t.Errorf("unexpected log entry: %+v", entries[0])
+		}
+		if _, err := time.Parse(time.RFC3339, entries[0].Time); err != nil {
+			t.Errorf("time should be RFC3339, got %q", entries[0].Time)
+		}
+	})
+
+	t.Run("debug is filtered by level", func(t *testing.T) {
+		for _, level := range []string{logLevelWarn, logLevelDebug} {
+			cfg := defaultConfig()
+			cfg.LogFile = filepath.Join(t.TempDir(), "statusline.log")
+			cfg.LogLevel = level
+			sl := NewStatusLine(WithConfig(cfg), WithStderr(io.Discard))
+			sl.debug("using cached usage", map[string]any{"cache_file": "cache.json"})
+			sl.warnf("something happened")
+
+			entries := readEntries(t, cfg.LogFile)
+			want := 1
+			if level == logLevelDebug {
+				want = 2
+			}
+			if len(entries) != want {
+				t.Fatalf("log_level %s: expected %d entries, got %d", level, want, len(entries))
+			}
+			if level == logLevelDebug && (entries[0].Level != logLevelDebug || entries[0].Fields["cache_file"] != "cache.json") {
+				t.Errorf("unexpected debug entry: %+v", entries[0])
+			}
+		}
+	})
+}
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		name          string
+		primaryWindow string
+		fiveHour      float64
+		weekly        float64
+		want          int
+	}{
+		{"green", "", 10, 5, 0},
+		{"yellow", "", 30, 5, 10},
+		{"orange", "", 10, 60, 20},
+		{"red", "", 80, 60, 30},
+		{"red weekly with green five-hour", "", 10, 80, 30},
+		{"explicit five_hour", windowFiveHour, 10, 80, 0},
+		{"explicit seven_day", windowSevenDay, 10, 80, 30},
+		{"five-hour ignored with seven_day", windowSevenDay, 80, 30, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inputJSON := fmt.Sprintf(`{
+				"model": {"display_name": "Sonnet 4"},
+				"rate_limits": {
+					"five_hour": {"used_percentage": %f, "resets_at": 1743580800},
+					"seven_day": {"used_percentage": %f, "resets_at": 1744185600}
+				}
+			}`, tt.fiveHour, tt.weekly)
+			cfg := defaultConfig()
+			cfg.PrimaryWindow = tt.primaryWindow
+			sl := NewStatusLine(WithStderr(io.Discard))
+			if err := sl.runWithConfig(strings.NewReader(inputJSON), io.Discard, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+				t.Fatalf("runWithConfig failed: %v", err)
+			}
+			if got := exitCodeFor(sl.severity); got != tt.want {
+				t.Errorf("exit code = %d, expected %d", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("API failed, defaulting to 0%", func(t *testing.T) {
+		sl := NewStatusLine(
+			WithStderr(io.Discard),
+			WithAccessTokenFunc(func() (string, error) { return "", errors.New("no token") }),
+			WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }),
+		)
+		// 前回の表示の段階が残らないこと
+		sl.severity = severityRed
+		inputJSON := `{"model": {"display_name": "Sonnet 4"}}`
+		if err := sl.runWithConfig(strings.NewReader(inputJSON), io.Discard, filepath.Join(t.TempDir(), "cache.json"), defaultConfig()); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		if got := exitCodeFor(sl.severity); got != 0 {
+			t.Errorf("exit code = %d, expected 0", got)
+		}
+	})
+}
+
+// timedWriter は最初に書き込まれた時刻を記録する
+type timedWriter struct {
+	bytes.Buffer
+	firstWrite time.Time
+}
+
+func (w *timedWriter) Write(p []byte) (int, error) {
+	if w.firstWrite.IsZero() {
+		w.firstWrite = time.Now()
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestTokenLookupBudget(t *testing.T) {
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":55.0}}`)),
+			Request:    r,
+		}, nil
+	})}
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	if err := saveCache(cacheFile, &CacheData{
+		ResetsAt:    "2026-01-27T12:00:00Z",
+		Utilization: 42.0,
+		CachedAt:    time.Now().Add(-10 * time.Minute).Unix(),
+	}); err != nil {
+		t.Fatalf("saveCache failed: %v", err)
+	}
+
+	cfg := defaultConfig()
+	cfg.NoColor = true
+	cfg.TokenLookupBudgetMillis = 50
+	sl := NewStatusLine(
+		WithStderr(io.Discard),
+		WithHTTPClient(client),
+		WithAccessTokenFunc(func() (string, error) {
+			time.Sleep(300 * time.Millisecond)
+			return "test-token", nil
+		}),
+		WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }),
+	)
+
+	stdout := &timedWriter{}
+	start := time.Now()
+	if err := sl.runWithConfig(strings.NewReader(`{"model": {"display_name": "Sonnet 4"}}`), stdout, cacheFile, cfg); err != nil {
+		t.Fatalf("runWithConfig failed: %v", err)
+	}
+	if elapsed := stdout.firstWrite.Sub(start); elapsed > 250*time.Millisecond {
+		t.Errorf("render took %v, expected it within the token lookup budget", elapsed)
+	}
+	if !strings.Contains(stdout.String(), "5h: 42.0%") {
+		t.Errorf("render should use the cached data, got: %q", stdout.String())
+	}
+
+	// バックグラウンドで取得が完了し、次回用にキャッシュが更新されていること
+	cache, err := readCache(cacheFile)
+	if err != nil {
+		t.Fatalf("failed to read cache: %v", err)
+	}
+	if cache.Utilization != 55.0 {
+		t.Errorf("cached Utilization = %f, expected 55.0", cache.Utilization)
+	}
+
+	t.Run("background fetch respects a Retry-After recorded meanwhile", func(t *testing.T) {
+		var hits atomic.Int32
+		client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			hits.Add(1)
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(`{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":55.0}}`)),
+				Request:    r,
+			}, nil
+		})}
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		stale := &CacheData{ResetsAt: "2026-01-27T12:00:00Z", Utilization: 42.0, CachedAt: time.Now().Add(-10 * time.Minute).Unix()}
+		if err := saveCache(cacheFile, stale); err != nil {
+			t.Fatal(err)
+		}
+		sl := NewStatusLine(
+			WithStderr(io.Discard),
+			WithHTTPClient(client),
+			WithAccessTokenFunc(func() (string, error) {
+				// トークンを待つ間に、別のプロセスが 429 を受けて Retry-After を記録する
+				time.Sleep(150 * time.Millisecond)
+				stale.RetryAfter = time.Now().Add(time.Hour).Unix()
+				saveCache(cacheFile, stale)
+				time.Sleep(150 * time.Millisecond)
+				return "test-token", nil
+			}),
+			WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }),
+		)
+		if err := sl.runWithConfig(strings.NewReader(`{"model": {"display_name": "Sonnet 4"}}`), io.Discard, cacheFile, cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		if got := hits.Load(); got != 0 {
+			t.Errorf("API hits = %d, expected the background fetch to respect Retry-After", got)
+		}
+	})
+
+	t.Run("background wait has a deadline", func(t *testing.T) {
+		block := make(chan struct{})
+		defer close(block)
+		stderr := &bytes.Buffer{}
+		sl := NewStatusLine(
+			WithStderr(stderr),
+			WithHTTPClient(client),
+			WithBackgroundWait(100*time.Millisecond),
+			WithAccessTokenFunc(func() (string, error) {
+				<-block
+				return "", errors.New("no token")
+			}),
+			WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }),
+		)
+		staleFile := filepath.Join(t.TempDir(), "cache.json")
+		if err := saveCache(staleFile, &CacheData{ResetsAt: "2026-01-27T12:00:00Z", CachedAt: time.Now().Add(-10 * time.Minute).Unix()}); err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		if err := sl.runWithConfig(strings.NewReader(`{"model": {"display_name": "Sonnet 4"}}`), io.Discard, staleFile, cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("run took %v, expected it to stop waiting for the background fetch", elapsed)
+		}
+		if !strings.Contains(stderr.String(), "background fetch did not finish") {
+			t.Errorf("stderr should explain why the fetch was abandoned, got: %q", stderr.String())
+		}
+	})
+}
+
+func TestColorValidation(t *testing.T) {
+	const blue = "\033[38;5;33m"
+
+	t.Run("valid escape is accepted", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.ColorGreen = blue
+		if warnings := cfg.validate(); len(warnings) != 0 {
+			t.Fatalf("validate() = %v, expected no warnings", warnings)
+		}
+		if got := colorizeUsageWithStyle(10.0, cfg.barStyle()); !strings.HasPrefix(got, blue+"10.0%") {
+			t.Errorf("custom color should be used, got: %q", got)
+		}
+	})
+
+	t.Run("malformed string is rejected", func(t *testing.T) {
+		for _, bad := range []string{"\033[31", "red", "\033]0;title\a", "\033[31mX"} {
+			cfg := defaultConfig()
+			cfg.ColorRed = bad
+			warnings := cfg.validate()
+			if len(warnings) != 1 || !strings.Contains(warnings[0], "color_red") {
+				t.Errorf("validate(%q) = %v, expected a color_red warning", bad, warnings)
+			}
+			if got := colorizeUsageWithStyle(90.0, cfg.barStyle()); !strings.HasPrefix(got, colorRed+"90.0%") {
+				t.Errorf("default color should be used for %q, got: %q", bad, got)
+			}
+		}
+	})
+}
+
+func TestAPIEndpoint(t *testing.T) {
+	newServer := func(hits *atomic.Int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			fmt.Fprint(w, `{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":61.0}}`)
+		}))
+	}
+	run := func(t *testing.T, server *httptest.Server) string {
+		t.Helper()
+		sl := NewStatusLine(
+			WithStderr(io.Discard),
+			WithHTTPClient(server.Client()),
+			WithAccessTokenFunc(func() (string, error) { return "test-token", nil }),
+			WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }),
+		)
+		stdout := &bytes.Buffer{}
+		if err := sl.run(strings.NewReader(`{"model": {"display_name": "Sonnet 4"}}`), stdout, filepath.Join(t.TempDir(), "cache.json")); err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+		return stdout.String()
+	}
+	writeConfig := func(t *testing.T, cfg map[string]any) {
+		t.Helper()
+		dir := t.TempDir()
+		t.Setenv("XDG_CONFIG_HOME", dir)
+		data, _ := json.Marshal(cfg)
+		if err := os.MkdirAll(filepath.Join(dir, appName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, appName, "config.json"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("config", func(t *testing.T) {
+		var hits atomic.Int32
+		server := newServer(&hits)
+		defer server.Close()
+		writeConfig(t, map[string]any{"api_endpoint": server.URL + "/usage"})
+
+		if out := run(t, server); !strings.Contains(out, "61.0%") {
+			t.Errorf("output should use the gateway response, got: %q", out)
+		}
+		if hits.Load() != 1 {
+			t.Errorf("gateway hits = %d, expected 1", hits.Load())
+		}
+	})
+
+	t.Run("environment variable", func(t *testing.T) {
+		var hits atomic.Int32
+		server := newServer(&hits)
+		defer server.Close()
+		writeConfig(t, map[string]any{"api_endpoint": "https://ignored.example.com/usage"})
+		t.Setenv("ANTHROPIC_USAGE_ENDPOINT", server.URL)
+
+		run(t, server)
+		if hits.Load() != 1 {
+			t.Errorf("gateway hits = %d, expected 1", hits.Load())
+		}
+	})
+
+	t.Run("invalid URL falls back to the default", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.APIEndpoint = "not a url"
+		if warnings := cfg.validate(); len(warnings) != 1 {
+			t.Errorf("validate() = %v, expected 1 warning", warnings)
+		}
+		if cfg.endpoint() != apiEndpoint {
+			t.Errorf("endpoint() = %q, expected %q", cfg.endpoint(), apiEndpoint)
+		}
+	})
+
+	t.Run("plain http is only allowed for loopback hosts", func(t *testing.T) {
+		tests := []struct {
+			endpoint string
+			valid    bool
+		}{
+			{"https://gateway.example.com/usage", true},
+			{"http://gateway.example.com/usage", false},
+			{"http://10.0.0.1:8080/usage", false},
+			{"http://localhost:8080/usage", true},
+			{"http://127.0.0.1:54321", true},
+			{"http://[::1]/usage", true},
+		}
+		for _, tt := range tests {
+			cfg := defaultConfig()
+			cfg.APIEndpoint = tt.endpoint
+			warnings := cfg.validate()
+			if tt.valid && (len(warnings) != 0 || cfg.endpoint() != tt.endpoint) {
+				t.Errorf("%s: validate() = %v, endpoint() = %q, expected it to be accepted", tt.endpoint, warnings, cfg.endpoint())
+			}
+			if !tt.valid && (len(warnings) != 1 || cfg.endpoint() != apiEndpoint) {
+				t.Errorf("%s: validate() = %v, endpoint() = %q, expected it to be rejected", tt.endpoint, warnings, cfg.endpoint())
+			}
+		}
+	})
+
+	t.Run("plain http environment variable is rejected", func(t *testing.T) {
+		t.Setenv("ANTHROPIC_USAGE_ENDPOINT", "http://gateway.example.com/usage")
+		cfg := defaultConfig()
+		applyEnvOverrides(cfg)
+		if warnings := cfg.validate(); len(warnings) != 1 || cfg.endpoint() != apiEndpoint {
+			t.Errorf("validate() = %v, endpoint() = %q, expected %q", warnings, cfg.endpoint(), apiEndpoint)
+		}
+	})
+}
+
+func TestCacheDoubleCheck(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		fmt.Fprint(w, `{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":99.0}}`)
+	}))
+	defer server.Close()
+
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	if err := saveCache(cacheFile, &CacheData{
+		ResetsAt:    "2026-01-27T12:00:00Z",
+		Utilization: 30.0,
+		CachedAt:    time.Now().Add(-time.Minute).Unix(),
+	}); err != nil {
+		t.Fatalf("saveCache failed: %v", err)
+	}
+
+	// 最初の有効性チェックの最中（読み込みと取得の間）に別プロセスが新しいキャッシュを書き込む
+	var historyCalls int
+	sl := NewStatusLine(
+		WithStderr(io.Discard),
+		WithHTTPClient(server.Client()),
+		WithAccessTokenFunc(func() (string, error) { return "test-token", nil }),
+		WithHistoryModTimeFunc(func() (time.Time, error) {
+			historyCalls++
+			if historyCalls == 1 {
+				time.Sleep(10 * time.Millisecond) // 更新時刻が確実に変わるようにする
+				if err := saveCache(cacheFile, &CacheData{
+					ResetsAt:    "2026-01-27T12:00:00Z",
+					Utilization: 45.0,
+					CachedAt:    time.Now().Unix(),
+				}); err != nil {
+					t.Errorf("saveCache failed: %v", err)
+				}
+			}
+			// 履歴はキャッシュより新しいため、読み込んだキャッシュは無効
+			return time.Now(), nil
+		}),
+	)
+
+	cache, err := sl.getCachedOrFetch(cacheFile, server.URL)
+	if err != nil {
+		t.Fatalf("getCachedOrFetch failed: %v", err)
+	}
+	if cache.Utilization != 45.0 {
+		t.Errorf("Utilization = %f, expected 45.0 (written by the other process)", cache.Utilization)
+	}
+	if got := hits.Load(); got != 0 {
+		t.Errorf("API hits = %d, expected 0", got)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	req, err := http.NewRequest("GET", apiEndpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transportProxy := func(sl *StatusLine) func(*http.Request) (*url.URL, error) {
+		transport, ok := sl.httpClient.Transport.(*http.Transport)
+		if !ok || transport.Proxy == nil {
+			t.Fatalf("default client should have a transport with a proxy function")
+		}
+		return transport.Proxy
+	}
+
+	t.Run("environment", func(t *testing.T) {
+		// http.ProxyFromEnvironment はプロセス内で最初に参照した環境変数を使い続けるため、
+		// 既に別のテストで参照されていれば期待値もその値になる
+		t.Setenv("HTTPS_PROXY", "http://proxy.example.com:8080")
+		want, _ := http.ProxyFromEnvironment(req)
+		got, err := transportProxy(NewStatusLine())(req)
+		if err != nil {
+			t.Fatalf("proxy failed: %v", err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("proxy = %v, expected %v", got, want)
+		}
+	})
+
+	t.Run("proxy_url overrides the environment", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.ProxyURL = "http://gateway.internal:3128"
+		got, err := transportProxy(NewStatusLine(WithConfig(cfg)))(req)
+		if err != nil {
+			t.Fatalf("proxy failed: %v", err)
+		}
+		if got == nil || got.String() != cfg.ProxyURL {
+			t.Errorf("proxy = %v, expected %s", got, cfg.ProxyURL)
+		}
+	})
+
+	t.Run("injected client is untouched", func(t *testing.T) {
+		client := &http.Client{}
+		if sl := NewStatusLine(WithHTTPClient(client)); sl.httpClient != client || client.Transport != nil {
+			t.Error("injected client should be used as is")
+		}
+	})
+}
+
+func TestDryRun(t *testing.T) {
+	now := time.Date(2026, 1, 27, 10, 0, 0, 0, time.UTC)
+	inputJSON := `{"model":{"display_name":"Opus"},"context_window":{"total_input_tokens":1000,"total_output_tokens":0}}`
+
+	tests := []struct {
+		name        string
+		cache       *CacheData // nil の場合はキャッシュファイルを作らない
+		wantStderr  string
+		wantPercent string
+	}{
+		{
+			name:        "valid",
+			cache:       &CacheData{ResetsAt: "2026-01-27T12:00:00Z", Utilization: 30.0, CachedAt: now.Add(-90 * time.Second).Unix()},
+			wantStderr:  "cache valid (age 1m30s, history older)\n",
+			wantPercent: "30.0%",
+		},
+		{
+			name:        "expired",
+			cache:       &CacheData{ResetsAt: "2026-01-27T12:00:00Z", Utilization: 55.0, CachedAt: now.Add(-time.Hour).Unix()},
+			wantStderr:  "would fetch: cache expired\n",
+			wantPercent: "55.0%",
+		},
+		{
+			name:        "missing cache",
+			wantStderr:  "would fetch: cache missing\n",
+			wantPercent: "0.0%",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheFile := filepath.Join(t.TempDir(), "cache.json")
+			if tt.cache != nil {
+				if err := saveCache(cacheFile, tt.cache); err != nil {
+					t.Fatalf("saveCache failed: %v", err)
+				}
+			}
+			before := fileModTime(cacheFile)
+
+			var hits atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+			}))
+			defer server.Close()
+
+			cfg := defaultConfig()
+			cfg.NoColor = true
+			cfg.APIEndpoint = server.URL
+			var stderr bytes.Buffer
+			sl := NewStatusLine(
+				WithDryRun(true),
+				WithStderr(&stderr),
+				WithNowFunc(func() time.Time { return now }),
+				WithHTTPClient(server.Client()),
+				WithAccessTokenFunc(func() (string, error) { return "test-token", nil }),
+				WithHistoryModTimeFunc(func() (time.Time, error) { return now.Add(-time.Hour * 2), nil }),
+			)
+			var stdout bytes.Buffer
+			if err := sl.runWithConfig(strings.NewReader(inputJSON), &stdout, cacheFile, cfg); err != nil {
+				t.Fatalf("runWithConfig failed: %v", err)
+			}
+
+			if got := stderr.String(); got != tt.wantStderr {
+				t.Errorf("stderr = %q, expected %q", got, tt.wantStderr)
+			}
+			if !strings.Contains(stdout.String(), "5h: "+tt.wantPercent) {
+				t.Errorf("output %q should contain 5h: %s", stdout.String(), tt.wantPercent)
+			}
+			if got := hits.Load(); got != 0 {
+				t.Errorf("API hits = %d, expected 0", got)
+			}
+			if !fileModTime(cacheFile).Equal(before) {
+				t.Error("cache file should not be written in dry-run mode")
+			}
+		})
+	}
+
+	t.Run("notify and mirror file", func(t *testing.T) {
+		dir := t.TempDir()
+		cacheFile := filepath.Join(dir, "cache.json")
+		if err := saveCache(cacheFile, &CacheData{ResetsAt: "2026-01-27T12:00:00Z", Utilization: 90.0, CachedAt: now.Add(-90 * time.Second).Unix()}); err != nil {
+			t.Fatalf("saveCache failed: %v", err)
+		}
+		// 更新時刻の比較が確実になるよう過去の時刻にしておく
+		past := now.Add(-time.Hour)
+		if err := os.Chtimes(cacheFile, past, past); err != nil {
+			t.Fatal(err)
+		}
+		before, err := os.ReadFile(cacheFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		beforeMod := fileModTime(cacheFile)
+
+		cfg := defaultConfig()
+		cfg.NoColor = true
+		cfg.NotifyAbove = 80
+		cfg.MirrorFile = filepath.Join(dir, "mirror.txt")
+		sl := NewStatusLine(
+			WithDryRun(true),
+			WithStderr(io.Discard),
+			WithNowFunc(func() time.Time { return now }),
+			WithHistoryModTimeFunc(func() (time.Time, error) { return now.Add(-time.Hour * 2), nil }),
+		)
+		if err := sl.runWithConfig(strings.NewReader(inputJSON), io.Discard, cacheFile, cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+
+		after, err := os.ReadFile(cacheFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(after, before) || !fileModTime(cacheFile).Equal(beforeMod) {
+			t.Errorf("cache file should not be written in dry-run mode, got: %s", after)
+		}
+		if fileExists(cfg.MirrorFile) {
+			t.Error("mirror file should not be written in dry-run mode")
+		}
+		if fileExists(stateFilePath(cacheFile)) {
+			t.Error("state file should not be written in dry-run mode")
+		}
+	})
+}
+
+func TestPercentPosition(t *testing.T) {
+	bar := "████▅" + strings.Repeat(" ", 5)
+	tests := []struct {
+		position string
+		noColor  bool
+		want     string
+	}{
+		{percentPositionLeft, true, "45.0% [" + bar + "]"},
+		{percentPositionRight, true, "[" + bar + "] 45.0%"},
+		{percentPositionLeft, false, colorYellow + "45.0% [" + bar + "]" + colorReset},
+		{percentPositionRight, false, colorYellow + "[" + bar + "] 45.0%" + colorReset},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/noColor=%v", tt.position, tt.noColor), func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.BarWidth = 10
+			cfg.PercentPosition = tt.position
+			cfg.NoColor = tt.noColor
+			if got := colorizeUsageWithStyle(45.0, cfg.barStyle()); got != tt.want {
+				t.Errorf("colorizeUsageWithStyle = %q, expected %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("unknown value falls back to left", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.PercentPosition = "center"
+		if warnings := cfg.validate(); len(warnings) != 1 {
+			t.Errorf("expected 1 warning, got %v", warnings)
+		}
+		if cfg.PercentPosition != percentPositionLeft {
+			t.Errorf("PercentPosition = %q, expected %q", cfg.PercentPosition, percentPositionLeft)
+		}
+	})
+}
+
+func TestWeeklyThresholds(t *testing.T) {
+	inputJSON := `{
+		"model": {"display_name": "Opus"},
+		"rate_limits": {
+			"five_hour": {"used_percentage": 30, "resets_at": 1743580800},
+			"seven_day": {"used_percentage": 30, "resets_at": 1744185600}
+		}
+	}`
+
+	t.Run("defaults match the 5h scale", func(t *testing.T) {
+		cfg := defaultConfig()
+		if cfg.weeklyThresholds() != (colorThresholds{cfg.ThresholdYellow, cfg.ThresholdOrange, cfg.ThresholdRed}) {
+			t.Errorf("weekly thresholds = %+v, expected the 5h thresholds", cfg.weeklyThresholds())
+		}
+	})
+
+	t.Run("segments color differently at the same utilization", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.WeeklyThresholdYellow = 10
+		cfg.WeeklyThresholdOrange = 20
+		cfg.WeeklyThresholdRed = 30
+		cfg.PrimaryWindow = windowSevenDay
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(WithStderr(io.Discard))
+		if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		out := stdout.String()
+		for _, want := range []string{"5h: " + colorYellow + "30.0%", "week: " + colorRed + "30.0%"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("output should contain %q, got: %q", want, out)
+			}
+		}
+		if sl.severity != severityRed {
+			t.Errorf("severity = %d, expected %d (from the weekly scale)", sl.severity, severityRed)
+		}
+	})
+
+	t.Run("invalid weekly thresholds fall back to defaults", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.WeeklyThresholdYellow = 80
+		cfg.WeeklyThresholdOrange = 20
+		if warnings := cfg.validate(); len(warnings) != 1 || !strings.Contains(warnings[0], "weekly") {
+			t.Errorf("expected 1 weekly warning, got %v", warnings)
+		}
+		if cfg.weeklyThresholds() != defaultColorThresholds {
+			t.Errorf("weekly thresholds = %+v, expected defaults", cfg.weeklyThresholds())
+		}
+	})
+}
+
+func TestSoonestResetCountdown(t *testing.T) {
+	now := time.Date(2026, 1, 27, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		fiveH   time.Time
+		weekly  time.Time
+		want    string
+		wantNot bool
+	}{
+		{"5h is sooner", now.Add(38 * time.Minute), now.Add(3 * 24 * time.Hour), "next limit in 38m (5h)", false},
+		{"weekly is sooner", now.Add(4 * time.Hour), now.Add(90 * time.Minute), "next limit in 1h30m (week)", false},
+		{"past reset is skipped", now.Add(-time.Minute), now.Add(2 * time.Hour), "next limit in 2h0m (week)", false},
+		{"no future reset", now.Add(-time.Minute), now.Add(-time.Hour), "next limit", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inputJSON := fmt.Sprintf(`{
+				"model": {"display_name": "Opus"},
+				"rate_limits": {
+					"five_hour": {"used_percentage": 10, "resets_at": %d},
+					"seven_day": {"used_percentage": 20, "resets_at": %d}
+				}
+			}`, tt.fiveH.Unix(), tt.weekly.Unix())
+			cfg := defaultConfig()
+			cfg.NoColor = true
+			cfg.ShowSoonestResetCountdown = true
+			stdout := &bytes.Buffer{}
+			sl := NewStatusLine(WithStderr(io.Discard), WithNowFunc(func() time.Time { return now }))
+			if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+				t.Fatalf("runWithConfig failed: %v", err)
+			}
+			if got := strings.Contains(stdout.String(), tt.want); got == tt.wantNot {
+				t.Errorf("output %q: contains %q = %v, expected %v", stdout.String(), tt.want, got, !tt.wantNot)
+			}
+		})
+	}
+}
+
+func TestUsageDelta(t *testing.T) {
+	inputJSON := `{"model":{"display_name":"Opus"},"context_window":{"total_input_tokens":1000,"total_output_tokens":0}}`
+	tests := []struct {
+		name      string
+		prev      *CacheData // nil の場合は初回（キャッシュなし）
+		fetched   float64
+		wantDelta string
+	}{
+		{"first run", nil, 45.0, ""},
+		{"increase", &CacheData{ResetsAt: "2026-01-27T12:00:00Z", Utilization: 41.8}, 45.0, " (+3.2)"},
+		{"decrease", &CacheData{ResetsAt: "2026-01-27T12:00:00Z", Utilization: 50.0}, 45.0, " (-5.0)"},
+		{"no change", &CacheData{ResetsAt: "2026-01-27T12:00:00Z", Utilization: 45.0}, 45.0, " (+0.0)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":%g}}`, tt.fetched)
+			}))
+			defer server.Close()
+
+			cacheFile := filepath.Join(t.TempDir(), "cache.json")
+			if tt.prev != nil {
+				if err := saveCache(cacheFile, tt.prev); err != nil {
+					t.Fatalf("saveCache failed: %v", err)
+				}
+			}
+
+			cfg := defaultConfig()
+			cfg.NoColor = true
+			cfg.ShowUsageDelta = true
+			cfg.ShowBar = false
+			cfg.APIEndpoint = server.URL
+			stdout := &bytes.Buffer{}
+			sl := NewStatusLine(
+				WithStderr(io.Discard),
+				WithForceRefresh(true),
+				WithHTTPClient(server.Client()),
+				WithAccessTokenFunc(func() (string, error) { return "test-token", nil }),
+			)
+			if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, cacheFile, cfg); err != nil {
+				t.Fatalf("runWithConfig failed: %v", err)
+			}
+
+			out := stdout.String()
+			if want := "5h: 45.0%" + tt.wantDelta + " "; !strings.Contains(out, want) {
+				t.Errorf("output %q should contain %q", out, want)
+			}
+			if tt.wantDelta == "" && strings.Contains(out, "5h: 45.0% (") {
+				t.Errorf("first run should show no delta, got: %q", out)
+			}
+		})
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	configHome := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", configHome)
+	t.Setenv("ANTHROPIC_USAGE_ENDPOINT", "")
+	t.Setenv("NO_COLOR", "")
+	configPath := filepath.Join(configHome, appName, "config.json")
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(configPath, []byte(`{"bar_width": 12, "show_model": false}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := &bytes.Buffer{}
+	sl := NewStatusLine(WithStderr(io.Discard))
+	if err := sl.printConfig(stdout); err != nil {
+		t.Fatalf("printConfig failed: %v", err)
+	}
+
+	var dumped struct {
+		ConfigPath string          `json:"config_path"`
+		Config     json.RawMessage `json:"config"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &dumped); err != nil {
+		t.Fatalf("output is not valid JSON: %v\n%s", err, stdout.String())
+	}
+	if dumped.ConfigPath != configPath {
+		t.Errorf("config_path = %q, expected %q", dumped.ConfigPath, configPath)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(dumped.Config, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]any{
+		"bar_width":        12.0,                // 設定ファイルの値
+		"show_model":       false,               // 設定ファイルの値
+		"show_app_name":    true,                // デフォルト値
+		"threshold_red":    75.0,                // デフォルト値
+		"reset_display":    resetDisplayClock,   // デフォルト値
+		"percent_position": percentPositionLeft, // デフォルト値
+	} {
+		if fields[key] != want {
+			t.Errorf("%s = %v, expected %v", key, fields[key], want)
+		}
+	}
+	if !strings.Contains(stdout.String(), "\n  \"config\": {") {
+		t.Errorf("output should be indented, got:\n%s", stdout.String())
+	}
+}
+
+func TestStaleText(t *testing.T) {
+	now := time.Date(2026, 1, 27, 10, 0, 0, 0, time.UTC)
+	inputJSON := `{"model": {"display_name": "Sonnet 4"}}`
+
+	tests := []struct {
+		name      string
+		status    int
+		staleText string
+		want      string
+		wantNot   string
+	}{
+		{"outage with expired cache", http.StatusInternalServerError, defaultStaleText, "5h: 42.0% (stale 7m)", ""},
+		{"weekly is marked too", http.StatusInternalServerError, defaultStaleText, "week: 12.0% (stale 7m)", ""},
+		{"custom text without parentheses", http.StatusInternalServerError, "old", "42.0% old 7m", ""},
+		{"disabled", http.StatusInternalServerError, "", "42.0% ", "stale"},
+		{"fresh fetch", http.StatusOK, defaultStaleText, "55.0%", "stale"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, `{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":55.0}}`)
+			}))
+			defer server.Close()
+
+			cacheFile := filepath.Join(t.TempDir(), "cache.json")
+			if err := saveCache(cacheFile, &CacheData{
+				ResetsAt:          "2026-01-27T12:00:00Z",
+				Utilization:       42.0,
+				WeeklyResetsAt:    "2026-01-30T12:00:00Z",
+				WeeklyUtilization: 12.0,
+				CachedAt:          now.Add(-7 * time.Minute).Unix(),
+			}); err != nil {
+				t.Fatalf("saveCache failed: %v", err)
+			}
+
+			cfg := defaultConfig()
+			cfg.NoColor = true
+			cfg.ShowBar = false
+			cfg.APIMaxAttempts = 1
+			cfg.APIEndpoint = server.URL
+			cfg.StaleText = tt.staleText
+			stdout := &bytes.Buffer{}
+			sl := NewStatusLine(
+				WithStderr(io.Discard),
+				WithNowFunc(func() time.Time { return now }),
+				WithHTTPClient(server.Client()),
+				WithAccessTokenFunc(func() (string, error) { return "test-token", nil }),
+				WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }),
+			)
+			if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, cacheFile, cfg); err != nil {
+				t.Fatalf("runWithConfig failed: %v", err)
+			}
+			out := stdout.String()
+			if !strings.Contains(out, tt.want) {
+				t.Errorf("output should contain %q, got: %q", tt.want, out)
+			}
+			if tt.wantNot != "" && strings.Contains(out, tt.wantNot) {
+				t.Errorf("output should not contain %q, got: %q", tt.wantNot, out)
+			}
+		})
+	}
+}
+
+func TestUnknownConfigKeys(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configPath, []byte(`{"bar_width": 12, "show_tokns": false}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfigFromPath(configPath)
+	if err != nil {
+		t.Fatalf("loadConfigFromPath should not fail on unknown keys: %v", err)
+	}
+	if cfg.BarWidth != 12 {
+		t.Errorf("BarWidth = %d, expected 12", cfg.BarWidth)
+	}
+	if !cfg.ShowTokens {
+		t.Error("ShowTokens should keep its default")
+	}
+	warnings := cfg.validate()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], `"show_tokns"`) {
+		t.Errorf("expected a warning naming show_tokns, got %v", warnings)
+	}
+
+	t.Run("reported on stderr", func(t *testing.T) {
+		configHome := t.TempDir()
+		t.Setenv("XDG_CONFIG_HOME", configHome)
+		path := filepath.Join(configHome, appName, "config.json")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(`{"show_tokns": false}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		stderr := &bytes.Buffer{}
+		if err := NewStatusLine(WithStderr(stderr)).printConfig(io.Discard); err != nil {
+			t.Fatalf("printConfig failed: %v", err)
+		}
+		if want := `warning: unknown config key "show_tokns", ignored`; !strings.Contains(stderr.String(), want) {
+			t.Errorf("stderr = %q, expected it to contain %q", stderr.String(), want)
+		}
+	})
+
+	t.Run("default config has no unknown keys", func(t *testing.T) {
+		data, err := json.Marshal(defaultConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unknown := unknownConfigKeys(data); len(unknown) != 0 {
+			t.Errorf("unknown keys in default config: %v", unknown)
+		}
+	})
+}
+
+func TestBurnRate(t *testing.T) {
+	now := time.Date(2026, 1, 27, 10, 0, 0, 0, time.UTC)
+	inputJSON := `{"model":{"display_name":"Opus"},"context_window":{"total_input_tokens":1000,"total_output_tokens":0}}`
+	prev := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		name  string
+		cache *CacheData
+		want  string // 空の場合は表示しない
+	}{
+		{
+			name: "over budget",
+			cache: &CacheData{
+				ResetsAt: "2026-01-27T12:00:00Z", Utilization: 50.0, CachedAt: now.Add(-time.Minute).Unix(),
+				PrevUtilization: prev(40.0), PrevCachedAt: now.Add(-11 * time.Minute).Unix(),
+			},
+			want: "~over in 49m",
+		},
+		{
+			name: "under budget",
+			cache: &CacheData{
+				ResetsAt: "2026-01-27T12:00:00Z", Utilization: 50.0, CachedAt: now.Add(-time.Minute).Unix(),
+				PrevUtilization: prev(49.0), PrevCachedAt: now.Add(-11 * time.Minute).Unix(),
+			},
+			want: "~ok",
+		},
+		{
+			name: "decreasing",
+			cache: &CacheData{
+				ResetsAt: "2026-01-27T12:00:00Z", Utilization: 10.0, CachedAt: now.Add(-time.Minute).Unix(),
+				PrevUtilization: prev(90.0), PrevCachedAt: now.Add(-11 * time.Minute).Unix(),
+			},
+			want: "~ok",
+		},
+		{
+			name: "insufficient data",
+			cache: &CacheData{
+				ResetsAt: "2026-01-27T12:00:00Z", Utilization: 50.0, CachedAt: now.Add(-time.Minute).Unix(),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cacheFile := filepath.Join(t.TempDir(), "cache.json")
+			if err := saveCache(cacheFile, tt.cache); err != nil {
+				t.Fatalf("saveCache failed: %v", err)
+			}
+			cfg := defaultConfig()
+			cfg.NoColor = true
+			cfg.ShowBurnRate = true
+			stdout := &bytes.Buffer{}
+			sl := NewStatusLine(
+				WithStderr(io.Discard),
+				WithNowFunc(func() time.Time { return now }),
+				WithHistoryModTimeFunc(func() (time.Time, error) { return now.Add(-time.Hour), nil }),
+				WithAccessTokenFunc(func() (string, error) { return "", errors.New("no token") }),
+			)
+			if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, cacheFile, cfg); err != nil {
+				t.Fatalf("runWithConfig failed: %v", err)
+			}
+			out := stdout.String()
+			if tt.want == "" {
+				if strings.Contains(out, "~") {
+					t.Errorf("output should not contain a burn rate, got: %q", out)
+				}
+			} else if !strings.Contains(out, tt.want) {
+				t.Errorf("output should contain %q, got: %q", tt.want, out)
+			}
+		})
+	}
+
+	t.Run("previous fetch time is stored", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":50.0}}`)
+		}))
+		defer server.Close()
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		prevCachedAt := now.Add(-10 * time.Minute).Unix()
+		if err := saveCache(cacheFile, &CacheData{ResetsAt: "2026-01-27T12:00:00Z", Utilization: 40.0, CachedAt: prevCachedAt}); err != nil {
+			t.Fatalf("saveCache failed: %v", err)
+		}
+		sl := NewStatusLine(
+			WithStderr(io.Discard),
+			WithNowFunc(func() time.Time { return now }),
+			WithHTTPClient(server.Client()),
+			WithAccessTokenFunc(func() (string, error) { return "test-token", nil }),
+		)
+		cache, err := sl.fetchFromAPI(cacheFile, server.URL)
+		if err != nil {
+			t.Fatalf("fetchFromAPI failed: %v", err)
+		}
+		if cache.PrevCachedAt != prevCachedAt || cache.PrevUtilization == nil || *cache.PrevUtilization != 40.0 {
+			t.Errorf("PrevCachedAt = %d, PrevUtilization = %v, expected %d and 40.0", cache.PrevCachedAt, cache.PrevUtilization, prevCachedAt)
+		}
+	})
+}
+
+func TestFetchLock(t *testing.T) {
+	newServer := func(hits *atomic.Int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits.Add(1)
+			time.Sleep(100 * time.Millisecond)
+			fmt.Fprint(w, `{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":40.0}}`)
+		}))
+	}
+	// 別プロセスを想定し、呼び出しごとに StatusLine を作る
+	newStatusLine := func(server *httptest.Server) *StatusLine {
+		return NewStatusLine(
+			WithStderr(io.Discard),
+			WithHTTPClient(server.Client()),
+			WithAccessTokenFunc(func() (string, error) { return "test-token", nil }),
+			WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }),
+		)
+	}
+
+	t.Run("concurrent processes hit the API once", func(t *testing.T) {
+		var hits atomic.Int32
+		server := newServer(&hits)
+		defer server.Close()
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				cache, err := newStatusLine(server).getCachedOrFetch(cacheFile, server.URL)
+				if err != nil {
+					t.Errorf("getCachedOrFetch failed: %v", err)
+					return
+				}
+				if cache.Utilization != 40.0 {
+					t.Errorf("Utilization = %f, expected 40.0", cache.Utilization)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if got := hits.Load(); got != 1 {
+			t.Errorf("API hits = %d, expected 1", got)
+		}
+		if fileExists(cacheFile + ".lock") {
+			t.Error("lock file should be removed after fetching")
+		}
+	})
+
+	t.Run("stale lock is taken over", func(t *testing.T) {
+		var hits atomic.Int32
+		server := newServer(&hits)
+		defer server.Close()
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		lockFile := cacheFile + ".lock"
+		if err := os.WriteFile(lockFile, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		sl := newStatusLine(server)
+		old := time.Now().Add(-2 * sl.fetchLockStale())
+		if err := os.Chtimes(lockFile, old, old); err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		if _, err := sl.getCachedOrFetch(cacheFile, server.URL); err != nil {
+			t.Fatalf("getCachedOrFetch failed: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed >= fetchLockWait {
+			t.Errorf("stale lock should not be waited for, took %v", elapsed)
+		}
+		if got := hits.Load(); got != 1 {
+			t.Errorf("API hits = %d, expected 1", got)
+		}
+	})
+
+	t.Run("stale threshold exceeds the longest fetch", func(t *testing.T) {
+		sl := NewStatusLine()
+		sl.cfg.APIMaxAttempts = 5
+		sl.cfg.APIRetryBaseDelayMillis = 1000
+		// トークンの取得、5回のリクエスト、1+2+4+8秒のバックオフ
+		longest := keychainTimeout + 5*apiTimeout + 15*time.Second
+		if got := sl.maxFetchDuration(); got != longest {
+			t.Errorf("maxFetchDuration = %v, expected %v", got, longest)
+		}
+		if got := sl.fetchLockStale(); got <= longest {
+			t.Errorf("fetchLockStale = %v, should exceed %v", got, longest)
+		}
+	})
+
+	t.Run("release keeps a lock taken over by another process", func(t *testing.T) {
+		lockFile := filepath.Join(t.TempDir(), "cache.json.lock")
+		release, waited := acquireFetchLock(lockFile, time.Minute)
+		if waited {
+			t.Error("lock should be acquired without waiting")
+		}
+		if owner, err := os.ReadFile(lockFile); err != nil || !strings.HasPrefix(string(owner), strconv.Itoa(os.Getpid())+" ") {
+			t.Errorf("lock file should record the PID, got %q (err %v)", owner, err)
+		}
+
+		// 異常に長い取得の間に別のプロセスがロックを取り直した場合
+		if err := os.WriteFile(lockFile, []byte("12345 1"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		release()
+		if !fileExists(lockFile) {
+			t.Error("release should not remove a lock owned by another process")
+		}
+	})
+}
+
+func TestVerbosity(t *testing.T) {
+	const token = "sk-ant-oat01-secret-token"
+	run := func(t *testing.T, verbosity, logFile string) string {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":40.0}}`)
+		}))
+		defer server.Close()
+
+		cfg := defaultConfig()
+		cfg.APIEndpoint = server.URL
+		cfg.LogFile = logFile
+		cfg.LogLevel = logLevelDebug
+		stderr := &bytes.Buffer{}
+		sl := NewStatusLine(
+			WithStderr(stderr),
+			WithVerbosity(verbosity),
+			WithHTTPClient(server.Client()),
+			WithAccessTokenFunc(func() (string, error) { return token, nil }),
+			WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }),
+		)
+		inputJSON := `{"model":{"display_name":"Opus"}}`
+		if err := sl.runWithConfig(strings.NewReader(inputJSON), io.Discard, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		return stderr.String()
+	}
+
+	t.Run("default is warn only", func(t *testing.T) {
+		if got := run(t, logLevelWarn, ""); got != "" {
+			t.Errorf("stderr should be empty, got: %q", got)
+		}
+	})
+
+	t.Run("info", func(t *testing.T) {
+		got := run(t, logLevelInfo, "")
+		if !strings.Contains(got, "info: API responded") || !strings.Contains(got, "status=200") {
+			t.Errorf("stderr should contain the API response, got: %q", got)
+		}
+		if strings.Contains(got, "debug:") {
+			t.Errorf("stderr should not contain debug messages, got: %q", got)
+		}
+	})
+
+	t.Run("debug logs cache decisions, API URLs and timings without the token", func(t *testing.T) {
+		logFile := filepath.Join(t.TempDir(), "statusline.log")
+		got := run(t, logLevelDebug, logFile)
+		for _, want := range []string{
+			"debug: cache unavailable",
+			"debug: requesting usage url=http://",
+			"debug: phase finished elapsed=",
+			"info: API responded",
+		} {
+			if !strings.Contains(got, want) {
+				t.Errorf("stderr should contain %q, got: %q", want, got)
+			}
+		}
+		logData, err := os.ReadFile(logFile)
+		if err != nil {
+			t.Fatalf("failed to read log file: %v", err)
+		}
+		for name, out := range map[string]string{"stderr": got, "log file": string(logData)} {
+			if strings.Contains(out, token) {
+				t.Errorf("%s should not contain the token: %q", name, out)
+			}
+		}
+	})
+
+	t.Run("LOG_LEVEL", func(t *testing.T) {
+		for env, want := range map[string]string{"": logLevelWarn, "debug": logLevelDebug, "INFO": logLevelInfo, "trace": logLevelWarn} {
+			t.Setenv("LOG_LEVEL", env)
+			if got := (&Options{}).verbosity(); got != want {
+				t.Errorf("LOG_LEVEL=%q: verbosity = %q, expected %q", env, got, want)
+			}
+		}
+		t.Setenv("LOG_LEVEL", "warn")
+		if got := (&Options{Verbose: true}).verbosity(); got != logLevelDebug {
+			t.Errorf("-v should override LOG_LEVEL, got %q", got)
+		}
+	})
+}
+
+func TestRedact(t *testing.T) {
+	const token = "sk-ant-oat01-secret-token"
+	if got := redact("Bearer "+token+" rejected", token); got != "Bearer *** rejected" {
+		t.Errorf("redact = %q", got)
+	}
+	if got := redact("no token here", ""); got != "no token here" {
+		t.Errorf("redact with empty token = %q", got)
+	}
+
+	// トークンを含むエラーを返すトランスポート
+	leakyClient := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("proxy rejected header %q", r.Header.Get("Authorization"))
+	})}
+	cfg := defaultConfig()
+	cfg.APIMaxAttempts = 1
+	stderr := &bytes.Buffer{}
+	sl := NewStatusLine(
+		WithConfig(cfg),
+		WithStderr(stderr),
+		WithVerbosity(logLevelDebug),
+		WithHTTPClient(leakyClient),
+		WithAccessTokenFunc(func() (string, error) { return token, nil }),
+	)
+
+	_, err := sl.fetchFromAPI(filepath.Join(t.TempDir(), "cache.json"), apiEndpoint)
+	if err == nil {
+		t.Fatal("fetchFromAPI should fail")
+	}
+	if strings.Contains(err.Error(), token) || !strings.Contains(err.Error(), "Bearer ***") {
+		t.Errorf("error should have the token redacted: %q", err.Error())
+	}
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) {
+		t.Errorf("redacted error should still unwrap to the original error, got %T", err)
+	}
+
+	sl.warnf("background fetch failed: %v", urlErr)
+	if strings.Contains(stderr.String(), token) || !strings.Contains(stderr.String(), "warning: background fetch failed: ") {
+		t.Errorf("stderr should have the token redacted: %q", stderr.String())
+	}
+}
+
+func TestShowAccount(t *testing.T) {
+	inputJSON := `{"model":{"display_name":"Opus"}}`
+	keychainFails := WithExecCommand(func(ctx context.Context, name string, arg ...string) *exec.Cmd { return exec.Command("false") })
+
+	tests := []struct {
+		name        string
+		response    string
+		credentials string
+		want        string // 空の場合は表示しない
+	}{
+		{
+			name:        "from API response",
+			response:    `{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":40.0},"account":{"email_address":"me@work.com"}}`,
+			credentials: `{"claudeAiOauth":{"accessToken":"test-token"},"oauthAccount":{"emailAddress":"me@home.com"}}`,
+			want:        "acct: me@work.com",
+		},
+		{
+			name:        "from credentials",
+			response:    `{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":40.0}}`,
+			credentials: `{"claudeAiOauth":{"accessToken":"test-token"},"oauthAccount":{"organizationName":"Acme Inc."}}`,
+			want:        "acct: Acme Inc.",
+		},
+		{
+			name:        "absent",
+			response:    `{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":40.0}}`,
+			credentials: `{"claudeAiOauth":{"accessToken":"test-token"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, tt.response)
+			}))
+			defer server.Close()
+
+			dir := t.TempDir()
+			credFile := filepath.Join(dir, ".credentials.json")
+			if err := os.WriteFile(credFile, []byte(tt.credentials), 0600); err != nil {
+				t.Fatal(err)
+			}
+			cfg := defaultConfig()
+			cfg.NoColor = true
+			cfg.ShowAccount = true
+			cfg.APIEndpoint = server.URL
+			cfg.CredentialsPath = credFile
+			stdout := &bytes.Buffer{}
+			sl := NewStatusLine(WithStderr(io.Discard), WithConfig(cfg), WithHTTPClient(server.Client()), keychainFails)
+			if err := sl.runWithConfig(strings.NewReader(inputJSON), stdout, filepath.Join(dir, "cache.json"), cfg); err != nil {
+				t.Fatalf("runWithConfig failed: %v", err)
+			}
+
+			out := stdout.String()
+			if tt.want == "" {
+				if strings.Contains(out, "acct:") {
+					t.Errorf("output should not contain an account, got: %q", out)
+				}
+			} else if !strings.Contains(out, tt.want) {
+				t.Errorf("output should contain %q, got: %q", tt.want, out)
+			}
+		})
+	}
+}
+
+func TestProfile(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, "config"))
+	t.Setenv("NO_COLOR", "")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":40.0}}`)
+	}))
+	defer server.Close()
+	t.Setenv("ANTHROPIC_USAGE_ENDPOINT", server.URL)
+
+	legacyFile := getLegacyCacheFilePath()
+	if err := saveCache(legacyFile, &CacheData{ResetsAt: "2026-01-27T12:00:00Z", Utilization: 10.0, CachedAt: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(profile string) {
+		t.Helper()
+		sl := NewStatusLine(
+			WithProfile(profile),
+			WithStderr(io.Discard),
+			WithHTTPClient(server.Client()),
+			WithAccessTokenFunc(func() (string, error) { return "test-token", nil }),
+			WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }),
+		)
+		if err := sl.run(strings.NewReader(`{"model":{"display_name":"Opus"}}`), io.Discard, ""); err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+	}
+
+	workDir := filepath.Join(getConfigDir(), "profiles", "work")
+	run("work")
+	for _, path := range []string{filepath.Join(workDir, "config.json"), filepath.Join(workDir, "cache.json")} {
+		if !fileExists(path) {
+			t.Errorf("%s should be written for the work profile", path)
+		}
+	}
+	if fileExists(getCacheFilePath()) {
+		t.Error("default cache should not be written for the work profile")
+	}
+	if !fileExists(legacyFile) {
+		t.Error("legacy cache should not be migrated for a named profile")
+	}
+
+	run("")
+	if !fileExists(getCacheFilePath()) {
+		t.Error("default cache should be written without a profile")
+	}
+	if fileExists(legacyFile) {
+		t.Error("legacy cache should be migrated for the default profile")
+	}
+
+	t.Run("per-profile credentials", func(t *testing.T) {
+		credFile := filepath.Join(workDir, ".credentials.json")
+		if err := os.WriteFile(credFile, []byte(`{"claudeAiOauth":{"accessToken":"work-token"}}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		sl := NewStatusLine(
+			WithProfile("work"),
+			WithExecCommand(func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+				t.Error("keychain should not be used for a named profile")
+				return exec.Command("false")
+			}),
+		)
+		token, err := sl.defaultAccessToken()
+		if err != nil {
+			t.Fatalf("defaultAccessToken failed: %v", err)
+		}
+		if token != "work-token" {
+			t.Errorf("token = %q, expected work-token", token)
+		}
+	})
+}
+
+func TestSessionAndCwd(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		wantCwd     string
+		wantSession string
+	}{
+		{
+			name:        "with fields",
+			input:       `{"model":{"display_name":"Opus"},"session_id":"1a2b3c4d-5e6f-7a8b-9c0d-1e2f3a4b5c6d","cwd":"/home/me/src/go-statusline"}`,
+			wantCwd:     "cwd: go-statusline",
+			wantSession: "session: 1a2b3c4d",
+		},
+		{
+			name:    "workspace current_dir",
+			input:   `{"model":{"display_name":"Opus"},"workspace":{"current_dir":"/home/me/notes"}}`,
+			wantCwd: "cwd: notes",
+		},
+		{
+			name:  "without fields",
+			input: `{"model":{"display_name":"Opus"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var input InputData
+			if err := json.Unmarshal([]byte(tt.input), &input); err != nil {
+				t.Fatalf("failed to parse input: %v", err)
+			}
+			if tt.wantSession == "" && input.SessionID != "" {
+				t.Errorf("SessionID = %q, expected empty", input.SessionID)
+			}
+			if tt.wantCwd == "" && input.cwdName() != "" {
+				t.Errorf("cwdName() = %q, expected empty", input.cwdName())
+			}
+
+			cfg := defaultConfig()
+			cfg.NoColor = true
+			cfg.ShowCwd = true
+			cfg.ShowSession = true
+			stdout := &bytes.Buffer{}
+			sl := NewStatusLine(
+				WithStderr(io.Discard),
+				WithAccessTokenFunc(func() (string, error) { return "", errors.New("no token") }),
+			)
+			if err := sl.runWithConfig(strings.NewReader(tt.input), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+				t.Fatalf("runWithConfig failed: %v", err)
+			}
+			out := stdout.String()
+			for prefix, want := range map[string]string{"cwd:": tt.wantCwd, "session:": tt.wantSession} {
+				if want == "" {
+					if strings.Contains(out, prefix) {
+						t.Errorf("output should not contain %q, got: %q", prefix, out)
+					}
+				} else if !strings.Contains(out, want) {
+					t.Errorf("output should contain %q, got: %q", want, out)
+				}
+			}
+		})
+	}
+}
+
+func TestGitBranch(t *testing.T) {
+	writeFile := func(t *testing.T, path, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("branch", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, ".git", "HEAD"), "ref: refs/heads/feature/x\n")
+		sub := filepath.Join(dir, "src", "pkg")
+		if err := os.MkdirAll(sub, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range []string{dir, sub} {
+			branch, err := gitBranch(d)
+			if err != nil {
+				t.Fatalf("gitBranch(%q) failed: %v", d, err)
+			}
+			if branch != "feature/x" {
+				t.Errorf("gitBranch(%q) = %q, expected %q", d, branch, "feature/x")
+			}
+		}
+	})
+
+	t.Run("worktree gitdir file", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, "repo", ".git", "worktrees", "wt", "HEAD"), "ref: refs/heads/wt-branch\n")
+		writeFile(t, filepath.Join(dir, "wt", ".git"), "gitdir: ../repo/.git/worktrees/wt\n")
+		branch, err := gitBranch(filepath.Join(dir, "wt"))
+		if err != nil {
+			t.Fatalf("gitBranch failed: %v", err)
+		}
+		if branch != "wt-branch" {
+			t.Errorf("gitBranch = %q, expected %q", branch, "wt-branch")
+		}
+	})
+
+	t.Run("detached HEAD", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, ".git", "HEAD"), "0123456789abcdef0123456789abcdef01234567\n")
+		branch, err := gitBranch(dir)
+		if err != nil {
+			t.Fatalf("gitBranch failed: %v", err)
+		}
+		if branch != "" {
+			t.Errorf("gitBranch = %q, expected empty", branch)
+		}
+	})
+
+	t.Run("not a repository", func(t *testing.T) {
+		branch, err := gitBranch(t.TempDir())
+		if err != nil {
+			t.Fatalf("gitBranch failed: %v", err)
+		}
+		if branch != "" {
+			t.Errorf("gitBranch = %q, expected empty", branch)
+		}
+	})
+
+	t.Run("segment", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			branch  string
+			err     error
+			enabled bool
+			want    string
+		}{
+			{name: "enabled", branch: "main", enabled: true, want: "branch: main"},
+			{name: "disabled", branch: "main"},
+			{name: "no branch", enabled: true},
+			{name: "read error", err: errors.New("permission denied"), enabled: true},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				var gotDir string
+				cfg := defaultConfig()
+				cfg.NoColor = true
+				cfg.ShowGitBranch = tt.enabled
+				stdout := &bytes.Buffer{}
+				sl := NewStatusLine(
+					WithStderr(io.Discard),
+					WithAccessTokenFunc(func() (string, error) { return "", errors.New("no token") }),
+					WithGitBranchFunc(func(dir string) (string, error) {
+						gotDir = dir
+						return tt.branch, tt.err
+					}),
+				)
+				input := `{"model":{"display_name":"Opus"},"cwd":"/home/me/src/go-statusline"}`
+				if err := sl.runWithConfig(strings.NewReader(input), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+					t.Fatalf("runWithConfig failed: %v", err)
+				}
+				out := stdout.String()
+				if tt.want == "" {
+					if strings.Contains(out, "branch:") {
+						t.Errorf("output should not contain branch, got: %q", out)
+					}
+				} else if !strings.Contains(out, tt.want) {
+					t.Errorf("output should contain %q, got: %q", tt.want, out)
+				}
+				if tt.enabled && gotDir != "/home/me/src/go-statusline" {
+					t.Errorf("gitBranch called with %q, expected the input cwd", gotDir)
+				}
+			})
+		}
+	})
+}
+
+func TestOffline(t *testing.T) {
+	now := time.Date(2026, 1, 6, 9, 0, 0, 0, time.UTC)
+	newStatusLine := func(hits *int32, stderr io.Writer) *StatusLine {
+		client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			atomic.AddInt32(hits, 1)
+			return nil, errors.New("network unreachable")
+		})}
+		return NewStatusLine(
+			WithHTTPClient(client),
+			WithStderr(stderr),
+			WithOffline(true),
+			WithNowFunc(func() time.Time { return now }),
+			WithAccessTokenFunc(func() (string, error) {
+				t.Error("offline mode should not look up the access token")
+				return "test-token", nil
+			}),
+		)
+	}
+	input := `{"model":{"display_name":"Opus"}}`
+
+	t.Run("stale cache is shown without fetching", func(t *testing.T) {
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		saveCache(cacheFile, &CacheData{
+			ResetsAt:    "2026-01-06T12:00:00Z",
+			Utilization: 42.0,
+			CachedAt:    now.Add(-time.Hour).Unix(),
+		})
+
+		var hits int32
+		stderr := &bytes.Buffer{}
+		stdout := &bytes.Buffer{}
+		cfg := defaultConfig()
+		cfg.NoColor = true
+		if err := newStatusLine(&hits, stderr).runWithConfig(strings.NewReader(input), stdout, cacheFile, cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		if hits != 0 {
+			t.Errorf("expected no HTTP requests, got %d", hits)
+		}
+		if !strings.Contains(stdout.String(), "42.0%") || !strings.Contains(stdout.String(), "(stale 1h0m)") {
+			t.Errorf("output should show the stale cached usage, got: %q", stdout.String())
+		}
+		if stderr.Len() != 0 {
+			t.Errorf("offline mode should print no warnings, got: %s", stderr.String())
+		}
+	})
+
+	t.Run("no cache shows zeroed defaults", func(t *testing.T) {
+		var hits int32
+		stderr := &bytes.Buffer{}
+		stdout := &bytes.Buffer{}
+		cfg := defaultConfig()
+		cfg.NoColor = true
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		if err := newStatusLine(&hits, stderr).runWithConfig(strings.NewReader(input), stdout, cacheFile, cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		if hits != 0 {
+			t.Errorf("expected no HTTP requests, got %d", hits)
+		}
+		if !strings.Contains(stdout.String(), "0.0%") {
+			t.Errorf("output should show 0%%, got: %q", stdout.String())
+		}
+		if stderr.Len() != 0 {
+			t.Errorf("offline mode should print no warnings, got: %s", stderr.String())
+		}
+		if fileExists(cacheFile) {
+			t.Error("offline mode should not write the cache")
+		}
+	})
+}
+
+func TestPowerlineOutput(t *testing.T) {
+	t.Run("segments", func(t *testing.T) {
+		line := renderPowerline([]segment{
+			{key: segModel, text: "model: Opus"},
+			{key: segTokens, text: "tokens: 1.5k"},
+			{key: seg5h, text: "5h: \033[31m80.0%\033[0m", usage: true, level: severityRed},
+			{key: segWeek, text: "week: \033[32m10.0%\033[0m", usage: true, level: severityGreen},
+		}, false)
+		want := "\033[38;5;15;48;5;238m model: Opus " +
+			"\033[38;5;15m" + powerlineThinArrow + "\033[38;5;15;48;5;238m tokens: 1.5k " +
+			"\033[38;5;238;48;5;1m" + powerlineArrow + "\033[38;5;0;48;5;1m 5h: 80.0% " +
+			"\033[38;5;1;48;5;2m" + powerlineArrow + "\033[38;5;0;48;5;2m week: 10.0% " +
+			"\033[0m\033[38;5;2m" + powerlineArrow + "\033[0m"
+		if line != want {
+			t.Errorf("renderPowerline() = %q, expected %q", line, want)
+		}
+	})
+
+	t.Run("no color", func(t *testing.T) {
+		line := renderPowerline([]segment{
+			{key: segModel, text: "model: Opus"},
+			{key: seg5h, text: "5h: 80.0%", usage: true, level: severityRed},
+		}, true)
+		want := " model: Opus " + powerlineThinArrow + " 5h: 80.0% " + powerlineArrow
+		if line != want {
+			t.Errorf("renderPowerline() = %q, expected %q", line, want)
+		}
+	})
+
+	t.Run("usage background follows the thresholds", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.OutputFormat = outputFormatPowerline
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(WithHistoryModTimeFunc(func() (time.Time, error) {
+			return time.Time{}, os.ErrNotExist
+		}))
+		input := `{"model":{"display_name":"Opus"},"rate_limits":{"five_hour":{"used_percentage":80.0,"resets_at":1767609000},"seven_day":{"used_percentage":30.0,"resets_at":1767954600}}}`
+		if err := sl.runWithConfig(strings.NewReader(input), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		out := stdout.String()
+		if !strings.Contains(out, powerlineArrow) {
+			t.Errorf("output should contain the arrow glyph, got: %q", out)
+		}
+		if strings.Contains(out, " | ") {
+			t.Errorf("output should not contain the text separator, got: %q", out)
+		}
+		for _, want := range []string{"48;5;1m 5h: ", "48;5;3m week: ", "48;5;238m Model: Opus "} {
+			if !strings.Contains(out, want) {
+				t.Errorf("output should contain %q, got: %q", want, out)
+			}
+		}
+		for _, segment := range strings.Split(strings.TrimSuffix(out, "\n"), powerlineArrow) {
+			if segment != "\033[0m" && !strings.Contains(segment, "48;5;") {
+				t.Errorf("segment %q should carry a background color", segment)
+			}
+		}
+	})
+
+	t.Run("--output powerline", func(t *testing.T) {
+		opts, err := parseArgs([]string{"--output", "powerline"}, io.Discard)
+		if err != nil {
+			t.Fatalf("parseArgs failed: %v", err)
+		}
+		if opts.Output != outputFormatPowerline {
+			t.Errorf("Output = %q, expected %q", opts.Output, outputFormatPowerline)
+		}
+	})
+
+	t.Run("--help lists powerline", func(t *testing.T) {
+		usage := &bytes.Buffer{}
+		parseArgs([]string{"--help"}, usage)
+		if !strings.Contains(usage.String(), "powerline") {
+			t.Errorf("usage should list the powerline output format, got: %s", usage.String())
+		}
+	})
+}
+
+func TestTmuxOutput(t *testing.T) {
+	t.Run("ansiToTmux", func(t *testing.T) {
+		tests := []struct {
+			input    string
+			expected string
+		}{
+			{colorGreen + "10.0%" + colorReset, "#[fg=green]10.0%#[default]"},
+			{colorOrange + "60.0%" + colorReset, "#[fg=colour208]60.0%#[default]"},
+			{"\033[1;91mhot\033[m", "#[bold,fg=brightred]hot#[default]"},
+			{"\033[38;2;255;128;0mx\033[39m", "#[fg=#ff8000]x#[fg=default]"},
+			{"\033[48;5;238m bg \033[49m", "#[bg=colour238] bg #[bg=default]"},
+			{"issue #12", "issue ##12"},
+		}
+		for _, tt := range tests {
+			if got := ansiToTmux(tt.input); got != tt.expected {
+				t.Errorf("ansiToTmux(%q) = %q, expected %q", tt.input, got, tt.expected)
+			}
+		}
+	})
+
+	t.Run("render", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.OutputFormat = outputFormatTmux
+		cfg.NotifyAbove = 50
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(
+			WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }),
+			WithIsTerminalFunc(func(io.Writer) bool { return false }),
+		)
+		input := `{"model":{"display_name":"Opus"},"rate_limits":{"five_hour":{"used_percentage":80.0,"resets_at":1767609000},"seven_day":{"used_percentage":10.0,"resets_at":1767954600}}}`
+		if err := sl.runWithConfig(strings.NewReader(input), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		out := stdout.String()
+		for _, want := range []string{"#[fg=red]80.0% [", "#[fg=green]10.0% [", "#[default]", "████"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("output should contain %q, got: %q", want, out)
+			}
+		}
+		if strings.ContainsAny(out, "\033\a") {
+			t.Errorf("output should not contain raw escape bytes, got: %q", out)
+		}
+	})
+
+	t.Run("idle label is escaped", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.OutputFormat = outputFormatTmux
+		cfg.IdleLabel = "#[fg=red]idle #1"
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(
+			WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }),
+			WithIsTerminalFunc(func(io.Writer) bool { return false }),
+		)
+		input := `{"model":{"display_name":"Opus"},"rate_limits":{"five_hour":{"used_percentage":0,"resets_at":1767609000}}}`
+		if err := sl.runWithConfig(strings.NewReader(input), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		if got, want := stdout.String(), "##[fg=red]idle ##1\n"; got != want {
+			t.Errorf("output = %q, expected %q", got, want)
+		}
+	})
+
+	t.Run("colors are kept when stdout is not a terminal", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.OutputFormat = outputFormatTmux
+		sl := NewStatusLine(WithIsTerminalFunc(func(io.Writer) bool { return false }))
+		if sl.colorDisabledForOutput(io.Discard, cfg) {
+			t.Error("tmux output should not disable colors for a non-terminal stdout")
+		}
+	})
+
+	t.Run("--help lists tmux", func(t *testing.T) {
+		usage := &bytes.Buffer{}
+		parseArgs([]string{"--help"}, usage)
+		if !strings.Contains(usage.String(), "tmux") {
+			t.Errorf("usage should list the tmux output format, got: %s", usage.String())
+		}
+	})
+}
+
+func TestHideEmptySegments(t *testing.T) {
+	render := func(t *testing.T, input string, hide bool) string {
+		t.Helper()
+		cfg := defaultConfig()
+		cfg.NoColor = true
+		cfg.HideEmptySegments = hide
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(
+			WithStderr(io.Discard),
+			WithAccessTokenFunc(func() (string, error) { return "", errors.New("no token") }),
+		)
+		if err := sl.runWithConfig(strings.NewReader(input), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		return stdout.String()
+	}
+	noData := `{"model":{"display_name":"Opus"}}`
+	fiveHourOnly := `{"model":{"display_name":"Opus"},"rate_limits":{"five_hour":{"used_percentage":42.0,"resets_at":1767609000}}}`
+
+	t.Run("N/A by default", func(t *testing.T) {
+		out := render(t, noData, false)
+		if strings.Count(out, "resets: N/A") != 2 || !strings.Contains(out, "5h: ") || !strings.Contains(out, "week: ") {
+			t.Errorf("output should contain the placeholders, got: %q", out)
+		}
+	})
+
+	t.Run("hidden without data", func(t *testing.T) {
+		out := render(t, noData, true)
+		for _, absent := range []string{"N/A", "5h: ", "week: "} {
+			if strings.Contains(out, absent) {
+				t.Errorf("output should not contain %q, got: %q", absent, out)
+			}
+		}
+		if !strings.Contains(out, "Model: Opus") {
+			t.Errorf("other segments should remain, got: %q", out)
+		}
+	})
+
+	t.Run("only the missing weekly segments are hidden", func(t *testing.T) {
+		out := render(t, fiveHourOnly, true)
+		if !strings.Contains(out, "5h: 42.0%") || strings.Count(out, "resets: ") != 1 {
+			t.Errorf("5h segments should remain, got: %q", out)
+		}
+		if strings.Contains(out, "week: ") || strings.Contains(out, "N/A") {
+			t.Errorf("weekly segments should be hidden, got: %q", out)
+		}
+	})
+}
+
+func TestLabels(t *testing.T) {
+	render := func(t *testing.T, cfg *Config) string {
+		t.Helper()
+		cfg.NoColor = true
+		cfg.ShowBar = false
+		stdout := &bytes.Buffer{}
+		sl := NewStatusLine(WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }))
+		input := `{"model":{"display_name":"Sonnet 4.5"},"context_window":{"total_input_tokens":1200,"total_output_tokens":300},"rate_limits":{"five_hour":{"used_percentage":45.0,"resets_at":1767609000},"seven_day":{"used_percentage":10.0,"resets_at":1767954600}}}`
+		if err := sl.runWithConfig(strings.NewReader(input), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		return stdout.String()
+	}
+
+	t.Run("custom labels replace only their segments", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Labels = map[string]string{"model": "🤖 ", "5h": "⏱ ", "week_resets": "↻ "}
+		out := render(t, cfg)
+		for _, want := range []string{"go-statusline", "🤖 Sonnet 4.5", "Total Tokens: 1.5k", "⏱ 45.0%", "resets: 10:30", "week: 10.0%", "↻ 01/09(Fri) 10:30"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("output should contain %q, got: %q", want, out)
+			}
+		}
+		for _, absent := range []string{"Model:", "5h:"} {
+			if strings.Contains(out, absent) {
+				t.Errorf("output should not contain %q, got: %q", absent, out)
+			}
+		}
+	})
+
+	t.Run("app label replaces the app name", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Labels = map[string]string{"app": "cc", "tokens": "T "}
+		out := render(t, cfg)
+		if !strings.HasPrefix(out, "cc | Model: Sonnet 4.5 | T 1.5k") {
+			t.Errorf("output = %q, expected the app and tokens labels to be replaced", out)
+		}
+	})
+
+	t.Run("unknown keys are warned", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.Labels = map[string]string{"model": "M ", "ctx": "C ", "cost": "$"}
+		warnings := cfg.validate()
+		if len(warnings) != 2 || !strings.Contains(warnings[0], `"cost"`) || !strings.Contains(warnings[1], `"ctx"`) {
+			t.Errorf("validate() = %v, expected warnings for cost and ctx", warnings)
+		}
+	})
+}
+
+func TestEmptyInput(t *testing.T) {
+	newStatusLine := func(stderr io.Writer, allow bool) *StatusLine {
+		return NewStatusLine(
+			WithStderr(stderr),
+			WithAllowEmptyInput(allow),
+			WithAccessTokenFunc(func() (string, error) { return "", errors.New("no token") }),
+		)
+	}
+
+	t.Run("fails by default", func(t *testing.T) {
+		stdout := &bytes.Buffer{}
+		err := newStatusLine(io.Discard, false).runWithConfig(strings.NewReader(""), stdout, filepath.Join(t.TempDir(), "cache.json"), defaultConfig())
+		if err == nil || !errors.Is(err, io.EOF) {
+			t.Errorf("runWithConfig() error = %v, expected EOF", err)
+		}
+		if stdout.Len() != 0 {
+			t.Errorf("nothing should be rendered, got: %q", stdout.String())
+		}
+	})
+
+	t.Run("renders with a hint when allowed", func(t *testing.T) {
+		for _, input := range []string{"", "  \n"} {
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+			cfg := defaultConfig()
+			cfg.NoColor = true
+			if err := newStatusLine(stderr, true).runWithConfig(strings.NewReader(input), stdout, filepath.Join(t.TempDir(), "cache.json"), cfg); err != nil {
+				t.Fatalf("runWithConfig(%q) failed: %v", input, err)
+			}
+			if !strings.Contains(stderr.String(), "no input on stdin") || !strings.Contains(stderr.String(), "Claude Code") {
+				t.Errorf("stderr should contain a hint, got: %q", stderr.String())
+			}
+			if !strings.Contains(stdout.String(), "5h: 0.0%") {
+				t.Errorf("output should be rendered with zero values, got: %q", stdout.String())
+			}
+		}
+	})
+
+	t.Run("invalid JSON still fails when allowed", func(t *testing.T) {
+		err := newStatusLine(io.Discard, true).runWithConfig(strings.NewReader("{"), io.Discard, filepath.Join(t.TempDir(), "cache.json"), defaultConfig())
+		if err == nil {
+			t.Error("runWithConfig should fail for invalid JSON")
+		}
+	})
+}
+
+func TestDoctor(t *testing.T) {
+	newStatusLine := func(t *testing.T, status int, token string, tokenErr error) *StatusLine {
+		t.Helper()
+		t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			fmt.Fprint(w, `{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":64.0}}`)
+		}))
+		t.Cleanup(server.Close)
+		t.Setenv("ANTHROPIC_USAGE_ENDPOINT", server.URL)
+		return NewStatusLine(
+			WithStderr(io.Discard),
+			WithAccessTokenFunc(func() (string, error) { return token, tokenErr }),
+			WithHistoryModTimeFunc(func() (time.Time, error) { return time.Now().Add(-time.Minute), nil }),
+		)
+	}
+	lineFor := func(out, name string) string {
+		for _, line := range strings.Split(out, "\n") {
+			if fields := strings.Fields(line); len(fields) >= 2 && fields[1] == name {
+				return line
+			}
+		}
+		return ""
+	}
+
+	t.Run("all checks pass", func(t *testing.T) {
+		stdout := &bytes.Buffer{}
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		if err := newStatusLine(t, http.StatusOK, "test-token", nil).doctor(stdout, cacheFile); err != nil {
+			t.Fatalf("doctor failed: %v\n%s", err, stdout.String())
+		}
+		for _, name := range []string{"config", "credentials", "api", "cache", "history"} {
+			if line := lineFor(stdout.String(), name); !strings.HasPrefix(line, "PASS") {
+				t.Errorf("%s check should pass, got: %q", name, line)
+			}
+		}
+		if fileExists(cacheFile) {
+			t.Error("doctor should not write the cache")
+		}
+	})
+
+	t.Run("missing token", func(t *testing.T) {
+		stdout := &bytes.Buffer{}
+		err := newStatusLine(t, http.StatusOK, "", errors.New("keychain item not found")).doctor(stdout, filepath.Join(t.TempDir(), "cache.json"))
+		if err == nil {
+			t.Fatal("doctor should fail without a token")
+		}
+		out := stdout.String()
+		if line := lineFor(out, "credentials"); !strings.HasPrefix(line, "FAIL") || !strings.Contains(line, "keychain item not found") {
+			t.Errorf("credentials check should fail, got: %q", line)
+		}
+		if !strings.Contains(out, "hint: log in to Claude Code") {
+			t.Errorf("output should contain a hint, got: %s", out)
+		}
+		if line := lineFor(out, "api"); !strings.HasPrefix(line, "FAIL") || !strings.Contains(line, "skipped") {
+			t.Errorf("api check should be skipped, got: %q", line)
+		}
+		if line := lineFor(out, "config"); !strings.HasPrefix(line, "PASS") {
+			t.Errorf("config check should pass, got: %q", line)
+		}
+	})
+
+	t.Run("API 401", func(t *testing.T) {
+		stdout := &bytes.Buffer{}
+		err := newStatusLine(t, http.StatusUnauthorized, "test-token", nil).doctor(stdout, filepath.Join(t.TempDir(), "cache.json"))
+		if err == nil || !strings.Contains(err.Error(), "1 of 5 checks failed") {
+			t.Fatalf("doctor error = %v, expected one failed check", err)
+		}
+		out := stdout.String()
+		if line := lineFor(out, "credentials"); !strings.HasPrefix(line, "PASS") {
+			t.Errorf("credentials check should pass, got: %q", line)
+		}
+		if line := lineFor(out, "api"); !strings.HasPrefix(line, "FAIL") || !strings.Contains(line, "status 401") {
+			t.Errorf("api check should fail with 401, got: %q", line)
+		}
+		if strings.Contains(out, "test-token") {
+			t.Errorf("output should not contain the token, got: %s", out)
+		}
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		sl := newStatusLine(t, http.StatusOK, "test-token", nil)
+		configPath := profileConfigFilePath("")
+		os.MkdirAll(filepath.Dir(configPath), 0755)
+		if err := os.WriteFile(configPath, []byte("{"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		stdout := &bytes.Buffer{}
+		if err := sl.doctor(stdout, filepath.Join(t.TempDir(), "cache.json")); err == nil {
+			t.Fatal("doctor should fail with an invalid config")
+		}
+		if line := lineFor(stdout.String(), "config"); !strings.HasPrefix(line, "FAIL") {
+			t.Errorf("config check should fail, got: %q", line)
+		}
+	})
+
+	t.Run("invalid config values", func(t *testing.T) {
+		sl := newStatusLine(t, http.StatusOK, "test-token", nil)
+		configPath := profileConfigFilePath("")
+		os.MkdirAll(filepath.Dir(configPath), 0755)
+		if err := os.WriteFile(configPath, []byte(`{"cache_ttl_seconds": 10, "min_fetch_interval_seconds": 60, "output_format": "yaml"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		stdout := &bytes.Buffer{}
+		err := sl.doctor(stdout, filepath.Join(t.TempDir(), "cache.json"))
+		if err == nil || !strings.Contains(err.Error(), "2 of 6 checks failed") {
+			t.Fatalf("doctor error = %v, expected the two invalid values to fail\n%s", err, stdout.String())
+		}
+		out := stdout.String()
+		for _, want := range []string{"invalid cache intervals", "output_format"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("output should report %q, got: %s", want, out)
+			}
+		}
+		if strings.Contains(out, "PASS config") {
+			t.Errorf("config check should not pass, got: %s", out)
+		}
+	})
+
+	t.Run("API key", func(t *testing.T) {
+		t.Setenv(apiKeyEnv, "sk-ant-test")
+		sl := newStatusLine(t, http.StatusOK, "", nil)
+		WithAccessTokenFunc(sl.defaultAccessToken)(sl)
+		WithExecCommand(func(ctx context.Context, name string, arg ...string) *exec.Cmd { return exec.Command("false") })(sl)
+		t.Setenv("CLAUDE_CONFIG_DIR", t.TempDir())
+		stdout := &bytes.Buffer{}
+		if err := sl.doctor(stdout, filepath.Join(t.TempDir(), "cache.json")); err != nil {
+			t.Fatalf("doctor failed: %v\n%s", err, stdout.String())
+		}
+		if line := lineFor(stdout.String(), "credentials"); !strings.Contains(line, apiKeyEnv) {
+			t.Errorf("credentials check should mention %s, got: %q", apiKeyEnv, line)
+		}
+	})
+
+	t.Run("credentials hint mentions the API key", func(t *testing.T) {
+		stdout := &bytes.Buffer{}
+		newStatusLine(t, http.StatusOK, "", errors.New("not found")).doctor(stdout, filepath.Join(t.TempDir(), "cache.json"))
+		if !strings.Contains(stdout.String(), apiKeyEnv) {
+			t.Errorf("hint should mention %s, got: %s", apiKeyEnv, stdout.String())
+		}
+	})
+
+	t.Run("hung token lookup times out", func(t *testing.T) {
+		block := make(chan struct{})
+		defer close(block)
+		sl := newStatusLine(t, http.StatusOK, "", nil)
+		WithKeychainTimeout(100 * time.Millisecond)(sl)
+		WithAccessTokenFunc(func() (string, error) {
+			<-block
+			return "", errors.New("unreachable")
+		})(sl)
+		stdout := &bytes.Buffer{}
+		start := time.Now()
+		if err := sl.doctor(stdout, filepath.Join(t.TempDir(), "cache.json")); err == nil {
+			t.Fatal("doctor should fail when the token lookup hangs")
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("doctor took %v, expected it to stop waiting for the token", elapsed)
+		}
+		if line := lineFor(stdout.String(), "credentials"); !strings.HasPrefix(line, "FAIL") || !strings.Contains(line, "timed out") {
+			t.Errorf("credentials check should time out, got: %q", line)
+		}
+	})
+}
+
+func TestErrorBody(t *testing.T) {
+	t.Run("401 with a JSON error body", func(t *testing.T) {
+		body := `{"type":"error","error":{"type":"authentication_error","message":"invalid token secret-token"}}`
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, body)
+		}))
+		defer server.Close()
+		sl := NewStatusLine(
+			WithStderr(io.Discard),
+			WithAccessTokenFunc(func() (string, error) { return "secret-token", nil }),
+		)
+		_, err := sl.fetchFromAPI(filepath.Join(t.TempDir(), "cache.json"), server.URL)
+		if err == nil {
+			t.Fatal("fetchFromAPI should fail")
+		}
+		for _, want := range []string{"status 401", "authentication_error", "invalid token ***"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("error should contain %q, got: %v", want, err)
+			}
+		}
+		if strings.Contains(err.Error(), "secret-token") {
+			t.Errorf("error should not contain the token, got: %v", err)
+		}
+	})
+
+	t.Run("long bodies are truncated", func(t *testing.T) {
+		resp := &http.Response{StatusCode: http.StatusBadGateway, Body: io.NopCloser(strings.NewReader(strings.Repeat("x", 2000)))}
+		got := statusWithBody(resp, "")
+		if want := "status 502: " + strings.Repeat("x", maxErrorBodyBytes) + "…"; got != want {
+			t.Errorf("statusWithBody() = %q (%d bytes), expected %d bytes", got, len(got), len(want))
+		}
+	})
+
+	t.Run("empty body", func(t *testing.T) {
+		resp := &http.Response{StatusCode: http.StatusInternalServerError, Body: io.NopCloser(strings.NewReader(" \n"))}
+		if got := statusWithBody(resp, ""); got != "status 500" {
+			t.Errorf("statusWithBody() = %q, expected %q", got, "status 500")
+		}
+	})
+
+	t.Run("doctor shows the body", func(t *testing.T) {
+		t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":{"message":"OAuth token has expired"}}`)
+		}))
+		defer server.Close()
+		t.Setenv("ANTHROPIC_USAGE_ENDPOINT", server.URL)
+		sl := NewStatusLine(
+			WithStderr(io.Discard),
+			WithAccessTokenFunc(func() (string, error) { return "secret-token", nil }),
+			WithHistoryModTimeFunc(func() (time.Time, error) { return time.Now(), nil }),
+		)
+		stdout := &bytes.Buffer{}
+		sl.doctor(stdout, filepath.Join(t.TempDir(), "cache.json"))
+		if !strings.Contains(stdout.String(), "status 401: {\"error\":{\"message\":\"OAuth token has expired\"}}") {
+			t.Errorf("doctor output should contain the error body, got: %s", stdout.String())
+		}
+	})
+}
+
+func TestCorruptCache(t *testing.T) {
+	for _, content := range []string{"{\"resets_at\": \"2026-01-27T1", "garbage", ""} {
+		t.Run(fmt.Sprintf("%q", content), func(t *testing.T) {
+			cacheFile := filepath.Join(t.TempDir(), "cache.json")
+			if err := os.WriteFile(cacheFile, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := readCache(cacheFile); !errors.Is(err, errCorruptCache) {
+				t.Fatalf("readCache() error = %v, expected errCorruptCache", err)
+			}
+
+			var hits int32
+			client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				atomic.AddInt32(&hits, 1)
+				return nil, errors.New("network unreachable")
+			})}
+			stderr := &bytes.Buffer{}
+			cfg := defaultConfig()
+			cfg.APIMaxAttempts = 1
+			sl := NewStatusLine(
+				WithHTTPClient(client),
+				WithStderr(stderr),
+				WithConfig(cfg),
+				WithAccessTokenFunc(func() (string, error) { return "test-token", nil }),
+			)
+			if _, err := sl.getCachedOrFetch(cacheFile, apiEndpoint); err == nil {
+				t.Error("getCachedOrFetch should fail when the fetch fails")
+			}
+			if hits != 1 {
+				t.Errorf("expected a fetch attempt, got %d requests", hits)
+			}
+			if fileExists(cacheFile) {
+				t.Error("corrupt cache file should be removed")
+			}
+			if !strings.Contains(stderr.String(), "removing corrupt cache file") {
+				t.Errorf("stderr should contain a warning, got: %q", stderr.String())
+			}
+		})
+	}
+}
+
+func TestAPIKeyFromEnv(t *testing.T) {
+	failingKeychain := WithExecCommand(func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+		return exec.Command("false")
+	})
+	newStatusLine := func(credentialsPath string, opts ...StatusLineOption) *StatusLine {
+		cfg := defaultConfig()
+		cfg.CredentialsPath = credentialsPath
+		cfg.APIMaxAttempts = 1
+		return NewStatusLine(append([]StatusLineOption{failingKeychain, WithConfig(cfg), WithStderr(io.Discard)}, opts...)...)
+	}
+
+	t.Run("used when keychain and file fail", func(t *testing.T) {
+		t.Setenv(apiKeyEnv, "sk-ant-api-test")
+		var gotKey, gotAuth, gotVersion string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotKey, gotAuth, gotVersion = r.Header.Get("x-api-key"), r.Header.Get("Authorization"), r.Header.Get("anthropic-version")
+			fmt.Fprint(w, `{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":64.0}}`)
+		}))
+		defer server.Close()
+
+		sl := newStatusLine(filepath.Join(t.TempDir(), "missing.json"))
+		cache, err := sl.fetchFromAPI(filepath.Join(t.TempDir(), "cache.json"), server.URL)
+		if err != nil {
+			t.Fatalf("fetchFromAPI failed: %v", err)
+		}
+		if cache.Utilization != 64.0 {
+			t.Errorf("Utilization = %v, expected 64", cache.Utilization)
+		}
+		if gotKey != "sk-ant-api-test" || gotAuth != "" || gotVersion != apiVersion {
+			t.Errorf("headers = (x-api-key %q, Authorization %q, anthropic-version %q), expected the API key style", gotKey, gotAuth, gotVersion)
+		}
+	})
+
+	t.Run("OAuth credentials take precedence", func(t *testing.T) {
+		t.Setenv(apiKeyEnv, "sk-ant-api-test")
+		credFile := filepath.Join(t.TempDir(), ".credentials.json")
+		if err := os.WriteFile(credFile, []byte(`{"claudeAiOauth":{"accessToken":"oauth-token"}}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		sl := newStatusLine(credFile)
+		token, err := sl.defaultAccessToken()
+		if err != nil || token != "oauth-token" {
+			t.Fatalf("defaultAccessToken() = (%q, %v), expected oauth-token", token, err)
+		}
+		req, err := sl.newUsageRequest(apiEndpoint, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if req.Header.Get("Authorization") != "Bearer oauth-token" || req.Header.Get("x-api-key") != "" {
+			t.Errorf("OAuth tokens should be sent as a bearer token, got headers %v", req.Header)
+		}
+	})
+
+	t.Run("error without the env var", func(t *testing.T) {
+		t.Setenv(apiKeyEnv, "")
+		sl := newStatusLine(filepath.Join(t.TempDir(), "missing.json"))
+		if _, err := sl.defaultAccessToken(); err == nil {
+			t.Error("defaultAccessToken should fail without any token source")
+		}
+	})
+}
+
+func TestShadeSteps(t *testing.T) {
+	// 幅10のバーで 21% / 25% / 28% は2ブロック + 小数部 0.1 / 0.5 / 0.8
+	tests := []struct {
+		usage float64
+		steps int
+		shade string
+	}{
+		{21, 6, "▁"},
+		{21, 3, "▂"},
+		{21, 1, "▄"},
+		{25, 6, "▅"},
+		{25, 3, "▄"},
+		{25, 1, "▄"},
+		{28, 6, "▆"},
+		{28, 3, "▆"},
+		{28, 1, "▄"},
+		{20, 3, " "},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%.0f%%/%d", tt.usage, tt.steps), func(t *testing.T) {
+			got := colorizeUsageWithStyle(tt.usage, barStyle{width: 10, noColor: true, shades: tt.steps})
+			want := fmt.Sprintf("%.1f%% [██%s%s]", tt.usage, tt.shade, strings.Repeat(" ", 7))
+			if got != want {
+				t.Errorf("colorizeUsageWithStyle(%v, shades=%d) = %q, expected %q", tt.usage, tt.steps, got, want)
+			}
+		})
+	}
+
+	t.Run("config", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.ShadeSteps = 3
+		if warnings := cfg.validate(); len(warnings) != 0 || cfg.barStyle().shades != 3 {
+			t.Errorf("validate() = %v, shades = %d", warnings, cfg.barStyle().shades)
+		}
+		cfg.ShadeSteps = 4
+		if warnings := cfg.validate(); len(warnings) != 1 || cfg.ShadeSteps != defaultShadeSteps {
+			t.Errorf("validate() = %v, ShadeSteps = %d", warnings, cfg.ShadeSteps)
+		}
+	})
+}
+
+func TestUsageAsFraction(t *testing.T) {
+	tests := []struct {
+		usage float64
+		scale int
+		label string
+		color string
+	}{
+		{0, 100, "0/100", colorGreen},
+		{20, 100, "20/100", colorGreen},
+		{45, 100, "45/100", colorYellow},
+		{60, 100, "60/100", colorOrange},
+		{80, 100, "80/100", colorRed},
+		{45, 200, "90/200", colorYellow},
+		{33.3, 10, "3/10", colorYellow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.label, func(t *testing.T) {
+			// バーは分数ではなく使用率をそのまま反映する
+			plain := colorizeUsageWithStyle(tt.usage, barStyle{width: 10, noColor: true, fraction: tt.scale})
+			percent := colorizeUsageWithStyle(tt.usage, barStyle{width: 10, noColor: true})
+			want := strings.Replace(percent, fmt.Sprintf("%.1f%%", tt.usage), tt.label, 1)
+			if plain != want {
+				t.Errorf("colorizeUsageWithStyle(%v, fraction=%d) = %q, expected %q", tt.usage, tt.scale, plain, want)
+			}
+			colored := colorizeUsageWithStyle(tt.usage, barStyle{width: 10, fraction: tt.scale})
+			if !strings.HasPrefix(colored, tt.color+tt.label) {
+				t.Errorf("colorizeUsageWithStyle(%v, fraction=%d) = %q, expected prefix %q", tt.usage, tt.scale, colored, tt.color+tt.label)
+			}
+		})
+	}
+
+	t.Run("config", func(t *testing.T) {
+		cfg := defaultConfig()
+		if cfg.barStyle().fraction != 0 {
+			t.Errorf("fraction = %d, expected 0 by default", cfg.barStyle().fraction)
+		}
+		cfg.UsageAsFraction = true
+		if warnings := cfg.validate(); len(warnings) != 0 || cfg.barStyle().fraction != defaultUsageFractionScale {
+			t.Errorf("validate() = %v, fraction = %d", warnings, cfg.barStyle().fraction)
+		}
+		cfg.UsageFractionScale = 0
+		if warnings := cfg.validate(); len(warnings) != 1 || cfg.UsageFractionScale != defaultUsageFractionScale {
+			t.Errorf("validate() = %v, UsageFractionScale = %d", warnings, cfg.UsageFractionScale)
+		}
+	})
+
+	t.Run("quantize takes priority", func(t *testing.T) {
+		got := colorizeUsageWithStyle(60, barStyle{width: 0, noColor: true, quantize: 4, fraction: 100})
+		if got != "2/4" {
+			t.Errorf("colorizeUsageWithStyle() = %q, expected %q", got, "2/4")
+		}
+	})
+}
+
+func TestQuiet(t *testing.T) {
+	for _, arg := range []string{"--quiet", "-q"} {
+		opts, err := parseArgs([]string{arg}, io.Discard)
+		if err != nil {
+			t.Fatalf("parseArgs(%s) failed: %v", arg, err)
+		}
+		if !opts.Quiet {
+			t.Errorf("parseArgs(%s): Quiet should be true", arg)
+		}
+	}
+
+	// 不正な設定値で警告を発生させる
+	run := func(t *testing.T, quiet bool) string {
+		t.Helper()
+		configHome := t.TempDir()
+		t.Setenv("XDG_CONFIG_HOME", configHome)
+		if err := os.MkdirAll(filepath.Join(configHome, appName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(configHome, appName, "config.json"), []byte(`{"shade_steps":4}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		stderr := &bytes.Buffer{}
+		opts := append([]StatusLineOption{
+			WithStderr(stderr),
+			WithAccessTokenFunc(func() (string, error) { return "", errors.New("no token") }),
+		}, (&Options{Quiet: quiet}).statusLineOptions()...)
+		sl := NewStatusLine(opts...)
+		if err := sl.run(strings.NewReader(`{"model":{"display_name":"Opus"}}`), io.Discard, filepath.Join(t.TempDir(), "cache.json")); err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+		return stderr.String()
+	}
+
+	if got := run(t, false); !strings.Contains(got, "warning:") {
+		t.Fatalf("warnings should be printed without --quiet, got: %q", got)
+	}
+	if got := run(t, true); got != "" {
+		t.Errorf("nothing should be written to stderr with --quiet, got: %q", got)
+	}
+
+	t.Run("keeps explicitly requested output", func(t *testing.T) {
+		stderr := &bytes.Buffer{}
+		sl := NewStatusLine(
+			WithStderr(stderr),
+			WithQuiet(true),
+			WithVerbosity(logLevelInfo),
+			WithDryRun(true),
+			WithTimings(true),
+		)
+		sl.warnf("should be suppressed")
+		sl.info("fetching usage", nil)
+		sl.printTimings()
+		sl.dryRunCache(filepath.Join(t.TempDir(), "cache.json"))
+		got := stderr.String()
+		if strings.Contains(got, "should be suppressed") {
+			t.Errorf("warnings should be suppressed with --quiet, got: %q", got)
+		}
+		for _, want := range []string{"info: fetching usage", "timing: ", "would fetch: cache missing"} {
+			if !strings.Contains(got, want) {
+				t.Errorf("stderr should contain %q with --quiet, got: %q", want, got)
+			}
+		}
+	})
+}
+
+func TestCacheFileFlag(t *testing.T) {
+	opts, err := parseArgs([]string{"--cache-file", "/tmp/custom.json"}, io.Discard)
+	if err != nil {
+		t.Fatalf("parseArgs failed: %v", err)
+	}
+	if opts.CacheFile != "/tmp/custom.json" {
+		t.Errorf("CacheFile = %q, expected %q", opts.CacheFile, "/tmp/custom.json")
+	}
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, "config"))
+
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, `{"five_hour":{"resets_at":"2026-01-27T12:00:00Z","utilization":40.0}}`)
+	}))
+	defer server.Close()
+	t.Setenv("ANTHROPIC_USAGE_ENDPOINT", server.URL)
+
+	legacyFile := getLegacyCacheFilePath()
+	if err := saveCache(legacyFile, &CacheData{ResetsAt: "2026-01-27T12:00:00Z", Utilization: 10.0, CachedAt: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	cacheFile := filepath.Join(t.TempDir(), "custom.json")
+	run := func() string {
+		t.Helper()
+		sl := NewStatusLine(
+			WithStderr(io.Discard),
+			WithHTTPClient(server.Client()),
+			WithAccessTokenFunc(func() (string, error) { return "test-token", nil }),
+			WithHistoryModTimeFunc(func() (time.Time, error) { return time.Time{}, os.ErrNotExist }),
+		)
+		stdout := &bytes.Buffer{}
+		if err := sl.run(strings.NewReader(`{"model":{"display_name":"Opus"}}`), stdout, cacheFile); err != nil {
+			t.Fatalf("run failed: %v", err)
+		}
+		return stdout.String()
+	}
+
+	// 初回は API から取得して指定したパスに書き込む
+	if out := run(); !strings.Contains(out, "40.0%") {
+		t.Errorf("output should contain the fetched usage, got: %q", out)
+	}
+	cache, err := readCache(cacheFile)
+	if err != nil || cache.Utilization != 40.0 {
+		t.Fatalf("cache should be written to %s: %+v, %v", cacheFile, cache, err)
+	}
+	if fileExists(getCacheFilePath()) {
+		t.Error("default cache should not be written")
+	}
+	if !fileExists(legacyFile) {
+		t.Error("legacy cache should not be migrated")
+	}
+
+	// 2回目は指定したパスのキャッシュを読む
+	if err := saveCache(cacheFile, &CacheData{ResetsAt: "2026-01-27T12:00:00Z", Utilization: 55.0, CachedAt: time.Now().Unix()}); err != nil {
+		t.Fatal(err)
+	}
+	if out := run(); !strings.Contains(out, "55.0%") {
+		t.Errorf("output should contain the cached usage, got: %q", out)
+	}
+	if requests != 1 {
+		t.Errorf("API should be called once, got %d", requests)
+	}
+}
+
+func TestShowRemaining(t *testing.T) {
+	tests := []struct {
+		usage float64
+		label string
+		color string
+	}{
+		{10, "90.0%", colorGreen},
+		{45, "55.0%", colorYellow},
+		{60, "40.0%", colorOrange},
+		{90, "10.0%", colorRed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.label, func(t *testing.T) {
+			used := colorizeUsageWithStyle(tt.usage, barStyle{width: 10})
+			got := colorizeUsageWithStyle(tt.usage, barStyle{width: 10, remaining: true})
+			// 色は使用率と同じ段階、数値とバーは残り容量
+			if !strings.HasPrefix(used, tt.color) || !strings.HasPrefix(got, tt.color+tt.label) {
+				t.Errorf("remaining(%v) = %q, expected prefix %q (used: %q)", tt.usage, got, tt.color+tt.label, used)
+			}
+			want := colorizeUsageWithStyle(100-tt.usage, barStyle{width: 10, noColor: true})
+			if plain := colorizeUsageWithStyle(tt.usage, barStyle{width: 10, noColor: true, remaining: true}); plain != want {
+				t.Errorf("remaining(%v) = %q, expected %q", tt.usage, plain, want)
+			}
+		})
+	}
+
+	t.Run("status line", func(t *testing.T) {
+		cfg := defaultConfig()
+		cfg.NoColor = true
+		cfg.ShowRemaining = true
+		cfg.BarWidth = 0
+		cfg.PrimaryWindow = windowSevenDay
+		cache := &CacheData{ResetsAt: "2099-01-01T00:00:00Z", Utilization: 30, WeeklyResetsAt: "2099-01-07T00:00:00Z", WeeklyUtilization: 80, CachedAt: time.Now().Unix()}
+		cacheFile := filepath.Join(t.TempDir(), "cache.json")
+		if err := saveCache(cacheFile, cache); err != nil {
+			t.Fatal(err)
+		}
+		sl := NewStatusLine(
+			WithStderr(io.Discard),
+			WithHistoryModTimeFunc(func() (time.Time, error) { return time.Now(), nil }),
+		)
+		stdout := &bytes.Buffer{}
+		if err := sl.runWithConfig(strings.NewReader(`{"model":{"display_name":"Opus"}}`), stdout, cacheFile, cfg); err != nil {
+			t.Fatalf("runWithConfig failed: %v", err)
+		}
+		for _, want := range []string{"5h: 70.0%", "week: 20.0%"} {
+			if !strings.Contains(stdout.String(), want) {
+				t.Errorf("output should contain %q, got: %q", want, stdout.String())
+			}
+		}
+		// 終了コードなどに使う段階は使用率のまま
+		if sl.severity != severityRed {
+			t.Errorf("severity = %v, expected %v", sl.severity, severityRed)
+		}
+	})
+}